@@ -17,13 +17,13 @@ func (t *TXN) Put(key []byte, value []byte) error {
 }
 
 func (db *DB) NewTXN(options WriteBatchOptions) *TXN {
+	//初始化当前一个事务的时候，db的latestRevison就会原子地自增1
+	beginRev := atomic.AddInt64(&db.latestRevision, 1) - 1
 	txn := &TXN{
-		beginRev:  db.latestRevision, //当前事务启动时候的版本号
+		beginRev:  beginRev, //当前事务启动时候的版本号
 		nextSub:   0,
-		writeView: db.NewWriteBatch(options, db.latestRevision),
+		writeView: db.NewWriteBatch(options, beginRev),
 	}
-	//初始化完当前一个事务之后，db的latestRevison就会自增1
-	atomic.AddInt64(&db.latestRevision, 1)
 
 	return txn
 }
@@ -1,50 +1,285 @@
 package FlexDB
 
 import (
-	"log"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-//const revInterval = 60 * time.Second
+/*
+	后台任务调度器
+	每个后台任务（刷盘，统计状态，merge等）都注册成一个Task，由调度器为每个任务启动一个goroutine
+	任务可以按照固定的周期执行，也可以设置触发条件，只有满足条件的时候才执行，还可以通过TriggerTask立即唤醒执行
+	调度器会记录每个任务的执行次数，耗时以及最近一次的错误，在Close的时候等待所有的任务退出
+*/
 
-//startBackgroundTask 执行一些后台需要执行的代码
-func (db *DB) startBackgroundTask() {
-	//创建一些定时触发的操作
+const (
+	syncTaskName       = "sync"
+	statTaskName       = "stat"
+	mergeTaskName      = "merge"
+	checkpointTaskName = "checkpoint"
+	shardTaskName      = "shard"
+)
+
+//Task 后台任务
+type Task struct {
+	Name     string          //任务的名字，不能重复
+	Interval time.Duration   //任务执行的周期，小于等于0的话只能通过TriggerTask来触发
+	Trigger  func(*DB) bool  //触发条件，为空的话每个周期都会执行，否则只有满足条件的时候才会执行
+	Run      func(*DB) error //任务的具体执行逻辑
+}
+
+//TaskStat 后台任务的运行指标
+type TaskStat struct {
+	Name          string        //任务的名字
+	RunCount      uint64        //任务执行的次数
+	ErrCount      uint64        //任务执行出错的次数
+	TotalDuration time.Duration //任务执行的总耗时
+	LastDuration  time.Duration //最近一次执行的耗时
+	LastRunAt     time.Time     //最近一次开始执行的时间
+	LastErr       error         //最近一次执行的错误
+}
+
+//taskEntry 调度器中注册的一个任务
+type taskEntry struct {
+	task   Task
+	stat   TaskStat
+	notify chan struct{} //用来立即唤醒任务
+}
+
+//scheduler 后台任务调度器
+type scheduler struct {
+	db     *DB
+	mu     *sync.Mutex
+	tasks  map[string]*taskEntry
+	exit   chan struct{} //退出信号的管道，用于控制Goroutine的退出
+	wg     sync.WaitGroup
+	closed bool
+}
+
+func newScheduler(db *DB) *scheduler {
+	return &scheduler{
+		db:    db,
+		mu:    new(sync.Mutex),
+		tasks: make(map[string]*taskEntry),
+		exit:  make(chan struct{}),
+	}
+}
+
+//register 注册一个任务并启动对应的goroutine
+func (s *scheduler) register(task Task) error {
+	if task.Name == "" || task.Run == nil {
+		return ErrTaskInvalid
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSchedulerClosed
+	}
+	if _, ok := s.tasks[task.Name]; ok {
+		return ErrTaskExists
+	}
+	entry := &taskEntry{
+		task:   task,
+		stat:   TaskStat{Name: task.Name},
+		notify: make(chan struct{}, 1),
+	}
+	s.tasks[task.Name] = entry
+	s.wg.Add(1)
+	go s.loop(entry)
+	return nil
+}
 
-	flushTicker := time.NewTicker(time.Duration(db.options.TimeSync) * time.Second) //创建刷盘定时器
-	StatTicker := time.NewTicker(time.Duration(db.options.TimeGetStat) * time.Second)
-	//CompactTicker := time.NewTicker(time.Duration(revInterval) * time.Second) //定时5分钟进行对数据进行压缩
-	defer flushTicker.Stop()
+//loop 任务的执行循环，没有任务需要执行的时候阻塞等待，不会空转占用CPU
+func (s *scheduler) loop(entry *taskEntry) {
+	defer s.wg.Done()
+	var tick <-chan time.Time
+	if entry.task.Interval > 0 {
+		ticker := time.NewTicker(entry.task.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
 	for {
 		select {
-		case <-flushTicker.C:
-			//刷盘的时间到了,在这个地方进行刷盘
-			if err := db.Sync(); err != nil {
-				log.Printf("Flush error :%s \n", err)
+		case <-tick:
+			//周期到了，满足触发条件才执行
+			if entry.task.Trigger != nil && !entry.task.Trigger(s.db) {
+				continue
 			}
-		case <-StatTicker.C:
-			db.Stat()
-		//case <-CompactTicker.C:
-		//当前的时间到了，就要进行压缩，采样一定的数量
-
-		case <-db.exitSignal:
+			s.run(entry)
+		case <-entry.notify:
+			//用户主动唤醒，直接执行
+			s.run(entry)
+		case <-s.exit:
 			//如果用户Close DB，就退出当前的goroutine
 			return
-		default:
-			//当打到一定的数据量就进行对数据进行持久化
-			if db.needSync() {
-				if err := db.Sync(); err != nil {
-					log.Printf("Flush error :%s \n", err)
-				}
-			}
-			//判断是否需要进行merge操作,如果打到阈值才开始操作
-			if db.stat != nil && db.stat.DiskSize != 0 && float32(db.reclaimSize)/float32(db.stat.DiskSize) > db.options.DataFileMergeRatio {
-				if err := db.Merge(false); err != nil {
-					log.Printf("Background Merge error:%s \n", err)
-				}
+		}
+	}
+}
+
+//run 执行一次任务并记录运行指标
+func (s *scheduler) run(entry *taskEntry) {
+	start := time.Now()
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("background task %s panic: %v", entry.task.Name, r)
 			}
+		}()
+		return entry.task.Run(s.db)
+	}()
+	duration := time.Since(start)
+
+	s.mu.Lock()
+	entry.stat.RunCount++
+	entry.stat.TotalDuration += duration
+	entry.stat.LastDuration = duration
+	entry.stat.LastRunAt = start
+	entry.stat.LastErr = err
+	if err != nil {
+		entry.stat.ErrCount++
+	}
+	s.mu.Unlock()
+	if err != nil {
+		s.db.options.Logger.Warn("background task failed", "task", entry.task.Name, "duration", duration, "err", err)
+	} else {
+		s.db.options.Logger.Debug("background task finished", "task", entry.task.Name, "duration", duration)
+	}
+}
+
+//trigger 立即唤醒一个任务
+func (s *scheduler) trigger(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.tasks[name]
+	if !ok {
+		return ErrTaskNotFound
+	}
+	select {
+	case entry.notify <- struct{}{}:
+	default:
+		//已经有一个唤醒信号还没有处理，不需要重复唤醒
+	}
+	return nil
+}
+
+//stats 获得所有任务的运行指标
+func (s *scheduler) stats() []TaskStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]TaskStat, 0, len(s.tasks))
+	for _, entry := range s.tasks {
+		stats = append(stats, entry.stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+//stop 通知所有的任务退出，并等待正在执行的任务完成
+func (s *scheduler) stop() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.exit)
+	s.mu.Unlock()
+	s.wg.Wait()
+}
 
+//RegisterTask 注册一个后台任务，例如TTL过期清理，版本压缩等
+func (db *DB) RegisterTask(task Task) error {
+	return db.scheduler.register(task)
+}
+
+//TriggerTask 立即执行一次指定的后台任务
+func (db *DB) TriggerTask(name string) error {
+	return db.scheduler.trigger(name)
+}
+
+//TaskStats 获得所有后台任务的运行指标
+func (db *DB) TaskStats() []TaskStat {
+	return db.scheduler.stats()
+}
+
+//startBackgroundTask 注册db内置的后台任务
+func (db *DB) startBackgroundTask() error {
+	//定时刷盘
+	if err := db.RegisterTask(Task{
+		Name:     syncTaskName,
+		Interval: time.Duration(db.options.TimeSync) * time.Second,
+		Run: func(db *DB) error {
+			return db.Sync()
+		},
+	}); err != nil {
+		return err
+	}
+	//定时获得db的状态
+	if err := db.RegisterTask(Task{
+		Name:     statTaskName,
+		Interval: time.Duration(db.options.TimeGetStat) * time.Second,
+		Run: func(db *DB) error {
+			return db.collectStat()
+		},
+	}); err != nil {
+		return err
+	}
+	//定时将内存索引写入到checkpoint文件中
+	if err := db.RegisterTask(Task{
+		Name:     checkpointTaskName,
+		Interval: time.Duration(db.options.TimeCheckpoint) * time.Second,
+		Run: func(db *DB) error {
+			return db.checkpointIndex()
+		},
+	}); err != nil {
+		return err
+	}
+	//范围分片的时候定期分裂热点分片，合并冷分片
+	if db.options.ShardType == RangeShard && db.options.IndexType != BPT {
+		if err := db.RegisterTask(Task{
+			Name:     shardTaskName,
+			Interval: time.Duration(db.options.TimeRebalanceShard) * time.Second,
+			Run: func(db *DB) error {
+				_, err := db.RebalanceShards()
+				return err
+			},
+		}); err != nil {
+			return err
 		}
+	}
+	//无效数据达到阈值的时候进行merge操作
+	return db.RegisterTask(Task{
+		Name:     mergeTaskName,
+		Interval: time.Duration(db.options.TimeCheckMerge) * time.Second,
+		Trigger: func(db *DB) bool {
+			return db.reachMergeRatio()
+		},
+		Run: func(db *DB) error {
+			return db.Merge(false)
+		},
+	})
+}
 
+//collectStat 获得db的状态，供merge等任务使用
+func (db *DB) collectStat() error {
+	stat := db.Stat()
+	if stat == nil {
+		return ErrStatUnavailable
 	}
+	db.mu.Lock()
+	db.stat = stat
+	db.mu.Unlock()
+	return nil
+}
+
+//reachMergeRatio 判断无效数据的比例是否达到了merge的阈值
+func (db *DB) reachMergeRatio() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.stat != nil && db.stat.DiskSize != 0 && float32(atomic.LoadUint64(&db.reclaimSize))/float32(db.stat.DiskSize) > db.options.DataFileMergeRatio
 }
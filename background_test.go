@@ -0,0 +1,135 @@
+package FlexDB
+
+import (
+	"FlexDB/logger"
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//syncBuffer 可以并发写入的缓冲
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+//等待某个后台任务至少执行count次
+func waitTaskRun(t *testing.T, db *DB, name string, count uint64) TaskStat {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, stat := range db.TaskStats() {
+			if stat.Name == name && stat.RunCount >= count {
+				return stat
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("task %s did not run %d times", name, count)
+	return TaskStat{}
+}
+
+func TestDB_RegisterTask(t *testing.T) {
+	logBuf := new(syncBuffer)
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.Logger = logger.New(logBuf, logger.LevelWarn)
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	//内置的任务
+	stats := db.TaskStats()
+	assert.Equal(t, 4, len(stats))
+	assert.Equal(t, checkpointTaskName, stats[0].Name)
+	assert.Equal(t, mergeTaskName, stats[1].Name)
+	assert.Equal(t, statTaskName, stats[2].Name)
+	assert.Equal(t, syncTaskName, stats[3].Name)
+
+	//非法的任务
+	assert.Equal(t, ErrTaskInvalid, db.RegisterTask(Task{Name: "empty"}))
+	assert.Equal(t, ErrTaskInvalid, db.RegisterTask(Task{Run: func(db *DB) error { return nil }}))
+	assert.Equal(t, ErrTaskExists, db.RegisterTask(Task{Name: syncTaskName, Run: func(db *DB) error { return nil }}))
+	assert.Equal(t, ErrTaskNotFound, db.TriggerTask("not-exist"))
+
+	//周期执行，并且只有满足触发条件的时候才执行
+	var ticks, runs int32
+	err = db.RegisterTask(Task{
+		Name:     "periodic",
+		Interval: 10 * time.Millisecond,
+		Trigger: func(db *DB) bool {
+			return atomic.AddInt32(&ticks, 1)%2 == 0
+		},
+		Run: func(db *DB) error {
+			atomic.AddInt32(&runs, 1)
+			return nil
+		},
+	})
+	assert.Nil(t, err)
+	stat := waitTaskRun(t, db, "periodic", 3)
+	assert.Nil(t, stat.LastErr)
+	assert.True(t, atomic.LoadInt32(&ticks) >= 2*atomic.LoadInt32(&runs)-1)
+
+	//没有周期的任务只能手动触发，出错和panic都需要记录下来
+	errTest := errors.New("task failed")
+	var manual int32
+	err = db.RegisterTask(Task{
+		Name: "manual",
+		Run: func(db *DB) error {
+			if atomic.AddInt32(&manual, 1) == 1 {
+				return errTest
+			}
+			panic("task panic")
+		},
+	})
+	assert.Nil(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&manual))
+	assert.Nil(t, db.TriggerTask("manual"))
+	stat = waitTaskRun(t, db, "manual", 1)
+	assert.Equal(t, errTest, stat.LastErr)
+	assert.Nil(t, db.TriggerTask("manual"))
+	stat = waitTaskRun(t, db, "manual", 2)
+	assert.NotNil(t, stat.LastErr)
+	assert.Equal(t, uint64(2), stat.ErrCount)
+	//任务失败的时候需要输出日志
+	assert.True(t, strings.Contains(logBuf.String(), "WARN background task failed task=manual"))
+
+	//Close之后所有的任务都会退出
+	assert.Nil(t, db.Close())
+	runsAfterClose := atomic.LoadInt32(&runs)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, runsAfterClose, atomic.LoadInt32(&runs))
+	assert.Equal(t, ErrSchedulerClosed, db.RegisterTask(Task{Name: "late", Run: func(db *DB) error { return nil }}))
+}
+
+func TestDB_BackgroundStat(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.TriggerTask(statTaskName))
+	stat := waitTaskRun(t, db, statTaskName, 1)
+	assert.Nil(t, stat.LastErr)
+	db.mu.RLock()
+	assert.NotNil(t, db.stat)
+	db.mu.RUnlock()
+	assert.Nil(t, db.Close())
+}
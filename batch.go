@@ -16,6 +16,15 @@ var txnFinKey = []byte("txn-fin")
 type RecordWithVersion struct {
 	logRecord *data.LogRecord //当前操作对应的记录信息
 	rev       mvcc.Revision   //当前操作对应的版本号信息
+	oldRev    mvcc.Revision   //删除操作要删除的旧版本号信息
+}
+
+//indexKey 获得这次操作在索引和数据文件中的key，删除的是写入时的旧版本
+func (rw *RecordWithVersion) indexKey() []byte {
+	if rw.logRecord.Type == data.LogRecordDeleted {
+		return keyWithRevision(rw.logRecord.Key, rw.oldRev)
+	}
+	return keyWithRevision(rw.logRecord.Key, rw.rev)
 }
 
 //WriteBatch 原子批量写数据，保证原子性
@@ -88,14 +97,20 @@ func (wb *WriteBatch) Delete(key []byte, nextSub int64) error {
 	if err != nil {
 		return err
 	}
-	encodedKey := append(key, oldRev.Encode()...)
+	if oldRev == nil {
+		return ErrKeyNotFound
+	}
+	encodedKey := keyWithRevision(key, *oldRev)
 
-	node, err := wb.db.hashRing.Get(string(encodedKey)) //获得对应实例
+	idx, err := wb.db.indexShards().get(encodedKey) //获得对应实例
 	if err != nil {
 		return err
 	}
 	//先在内存索引中查看数据是否存在
-	logRecordPos := wb.db.index[node].Get(encodedKey)
+	logRecordPos, err := idx.Get(encodedKey)
+	if err != nil {
+		return indexReadError(err)
+	}
 	if logRecordPos == nil {
 		//数据不存在
 		if wb.pendingWrite[string(key)] != nil {
@@ -110,7 +125,7 @@ func (wb *WriteBatch) Delete(key []byte, nextSub int64) error {
 
 	//将LogRecord 暂存起来
 	logRecord := &data.LogRecord{Key: key, Type: data.LogRecordDeleted}
-	rv := &RecordWithVersion{logRecord: logRecord, rev: rev}
+	rv := &RecordWithVersion{logRecord: logRecord, rev: rev, oldRev: *oldRev}
 
 	wb.pendingWrite[string(key)] = rv
 	return nil
@@ -130,20 +145,26 @@ func (wb *WriteBatch) Commit() error {
 		return ErrExceedMaxBatchNum
 	}
 
+	//写入数据文件和更新索引的期间不能进行checkpoint和reshard，checkpoint不会落在一个事务的中间
+	wb.db.indexMu.RLock()
+	defer wb.db.indexMu.RUnlock()
 	//获取当前最新事务的序列号
 	seqNo := atomic.AddUint64(&wb.db.seqNo, 1) //原子加1
 	//内存索引信息保存,key是用户的key+revision编码后的数据
 	position := make(map[string]*data.LogRecordPos)
-	//开始写数据到数据文件中，当前的
+	//开始写数据到数据文件中，写数据的时候需要持有db的锁，避免和其他的写入以及后台的刷盘并发修改活跃文件
+	wb.db.mu.Lock()
 	for _, rw := range wb.pendingWrite {
-		//记录批量写入，具有相同的事务序列号，同时上面已经加锁了，这里就不需要再加锁
+		//记录批量写入，具有相同的事务序列号，和普通的写入一样，数据文件中的key追加了版本号，重启之后重放的索引和写入时一致
+		//注意这里改变了批量写入的数据格式，旧版本写入的是原始的key，重启之后这些记录没有版本号，不会被读取到
 		logRecordPos, err := wb.db.appendLogRecord(&data.LogRecord{
-			Key:   logRecordKeyWithSeq(rw.logRecord.Key, seqNo),
+			Key:   logRecordKeyWithSeq(rw.indexKey(), seqNo),
 			Value: rw.logRecord.Value,
 			Type:  rw.logRecord.Type,
 		})
 		if err != nil {
-			return nil
+			wb.db.mu.Unlock()
+			return err
 		}
 		//记录当前的位置信息
 		position[string(rw.logRecord.Key)] = logRecordPos
@@ -156,48 +177,81 @@ func (wb *WriteBatch) Commit() error {
 		Type: data.LogRecordTxnFinished,
 	}
 	if _, err := wb.db.appendLogRecord(finishedRecord); err != nil {
+		wb.db.mu.Unlock()
+		return err
+	}
+	//事务中的所有修改作为一条记录写入到wal中
+	if err := wb.db.writeWal(seqNo, wb.walEntries(position)...); err != nil {
+		wb.db.mu.Unlock()
 		return err
 	}
 	//根据配置进行持久化
 	if wb.options.SyncWrite {
-		if err := wb.db.activeFile.Sync(); err != nil {
+		if err := wb.db.syncActiveFile(); err != nil {
+			wb.db.mu.Unlock()
 			return err
 		}
 	}
-	//根据前面append获得的position映射，来更新内存索引,同时更新treeIndex
-
+	wb.db.mu.Unlock()
+	//根据前面append获得的position映射，按照索引实例分组之后批量更新内存索引
+	//删除操作和普通的删除一样，保留索引中被删除的版本
+	shards := wb.db.indexShards()
+	shardOps := make(map[string][]*indexOp)
 	for _, rw := range wb.pendingWrite {
 		rawKey := rw.logRecord.Key //用户最初的key
-		encodedKey := append(rawKey, rw.rev.Encode()...)
-
-		pos := position[string(rawKey)]                     //获得该数据的位置信息
-		node, err := wb.db.hashRing.Get(string(encodedKey)) //获得对应实例
+		encodedKey := rw.indexKey()
+		node, err := shards.router.route(encodedKey) //获得对应实例
 		if err != nil {
 			return err
 		}
-		var oldPos *data.LogRecordPos
-		//根据当前的操作类型，
-		if rw.logRecord.Type == data.LogRecordNormal {
-			//正常数据，就正常进行更新
-			oldPos = wb.db.index[node].Put(encodedKey, pos)
-			wb.db.VersionPut(rawKey, rw.rev) //更新版本号信息
-
-		}
-		if rw.logRecord.Type == data.LogRecordDeleted {
-			//数据需要从内存中进行一个删除
-			oldPos, _ = wb.db.index[node].Delete(encodedKey)
-			wb.db.VersionDelete(rawKey, rw.rev)
+		shardOps[node] = append(shardOps[node], &indexOp{
+			key: encodedKey,
+			typ: rw.logRecord.Type,
+			pos: position[string(rawKey)], //获得该数据的位置信息
+		})
+	}
+	for node, ops := range shardOps {
+		reclaimSize, err := applyIndexOps(shards.index[node], ops)
+		if err != nil {
+			return err
 		}
-		if oldPos != nil {
-			wb.db.reclaimSize += uint64(oldPos.Size)
+		atomic.AddUint64(&wb.db.reclaimSize, reclaimSize)
+	}
+	//索引更新完成之后再更新treeIndex中的版本号信息
+	for _, rw := range wb.pendingWrite {
+		if rw.logRecord.Type == data.LogRecordNormal {
+			wb.db.VersionPut(rw.logRecord.Key, rw.rev)
+		} else if rw.logRecord.Type == data.LogRecordDeleted {
+			wb.db.VersionDelete(rw.logRecord.Key, rw.rev)
 		}
-
 	}
 	//清空暂存数据
 	wb.pendingWrite = make(map[string]*RecordWithVersion)
 	return nil
 }
 
+//walEntries 获得事务中对索引和版本信息的所有修改
+func (wb *WriteBatch) walEntries(position map[string]*data.LogRecordPos) []walEntry {
+	if wb.db.wal == nil {
+		return nil
+	}
+	entries := make([]walEntry, 0, len(wb.pendingWrite)*2)
+	for _, rw := range wb.pendingWrite {
+		rawKey := rw.logRecord.Key
+		pos := position[string(rawKey)]
+		if rw.logRecord.Type == data.LogRecordDeleted {
+			entries = append(entries,
+				walEntry{typ: walIndexDelete, key: rw.indexKey(), pos: pos},
+				walEntry{typ: walVersionDelete, key: rawKey, rev: rw.rev})
+		} else {
+			entries = append(entries,
+				walEntry{typ: walIndexPut, key: rw.indexKey(), pos: pos},
+				walEntry{typ: walVersionPut, key: rawKey, rev: rw.rev})
+		}
+	}
+	return entries
+}
+
 //SeqNo+key 进行编码,编码出一个新的key
 func logRecordKeyWithSeq(key []byte, seqNo uint64) []byte {
 	seq := make([]byte, binary.MaxVarintLen64)
@@ -212,6 +266,12 @@ func logRecordKeyWithSeq(key []byte, seqNo uint64) []byte {
 	return encKey
 }
 
+//logRecordSeqSize LogRecord的key中事务序列号编码之后的长度
+func logRecordSeqSize(key []byte) uint8 {
+	_, n := binary.Uvarint(key)
+	return uint8(n)
+}
+
 //解析LogRecord的key，获取实际的key和事务
 func parseLogRecordKey(key []byte) ([]byte, uint64) {
 	seqNo, n := binary.Uvarint(key)
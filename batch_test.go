@@ -102,3 +102,24 @@ func TestDB_WriteBatch3(t *testing.T) {
 	err = wb.Commit()
 	assert.Nil(t, err)
 }
+
+//B+树索引按照索引实例批量更新，每个索引实例只提交一次bbolt事务
+func TestDB_WriteBatchBPT(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.IndexType = BPT
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	wb := db.NewWriteBatch(DefaultWriteBatchOption, 1)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.RandomValue(16), 0))
+	}
+	assert.Nil(t, wb.Commit())
+	var keyNum int
+	for _, stat := range db.ShardStats() {
+		keyNum += stat.KeyNum
+	}
+	assert.Equal(t, 1000, keyNum)
+}
@@ -3,8 +3,11 @@ package benchmark
 import (
 	"FlexDB"
 	"FlexDB/utils"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
+	"os"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -63,3 +66,52 @@ func Benchmark_Delete(b *testing.B) {
 	}
 
 }
+
+//openBenchDataSize 启动测试使用的数据量大小
+const openBenchDataSize = 2 * 1024 * 1024 * 1024
+
+//prepareOpenBenchData 准备启动测试需要的数据目录,目录已经存在的话直接复用
+func prepareOpenBenchData(b *testing.B, dirPath string) FlexDB.Options {
+	opt := FlexDB.DefaultOperations
+	opt.DirPath = dirPath
+	opt.IndexType = FlexDB.Btree
+	if _, err := os.Stat(dirPath); err == nil {
+		return opt
+	}
+	db, err := FlexDB.Open(opt)
+	if err != nil {
+		b.Fatal(err)
+	}
+	value := utils.RandomValue(1024)
+	for i := 0; i < openBenchDataSize/len(value); i++ {
+		if err := db.Put(utils.GetTestKey(i), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		b.Fatal(err)
+	}
+	return opt
+}
+
+//Benchmark_Open 测试不同的并行度下启动构建索引的耗时
+func Benchmark_Open(b *testing.B) {
+	opt := prepareOpenBenchData(b, DirPath+"-open")
+	for _, concurrency := range []int{1, 4, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			opt.LoadConcurrency = concurrency
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				db, err := FlexDB.Open(opt)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				if err := db.Close(); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package FlexDB
+
+import (
+	"FlexDB/data"
+	"FlexDB/fio"
+	"FlexDB/index"
+	"FlexDB/mvcc"
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+/*
+	内存索引(Btree，ART，跳表)的checkpoint
+	后台任务定期将每个索引实例中的key和位置信息写入到checkpoint文件中，同时记录checkpoint覆盖到的数据文件id和偏移量
+	启动的时候先加载checkpoint，然后只需要重放这个位置之后的数据，启动的时间和数据的历史长度无关
+	checkpoint文件中每条记录的key是索引中的key，value是编码之后的位置信息，最后一条记录是LogRecordHintFinished类型，value中记录了checkpoint的元数据
+	先写入到临时文件中，写完之后再重命名，保证checkpoint文件总是完整的
+	merge之后数据文件发生了变化，checkpoint中的位置信息就失效了，加载merge文件的时候会删除checkpoint文件
+*/
+
+const checkpointTmpSuffix = ".tmp"
+
+//checkpointMeta checkpoint的元数据
+//fileId offset seqNo reclaimSize entryNum walGen
+//变长    变长    变长   变长          变长      变长(可选)
+type checkpointMeta struct {
+	fileId      uint32 //checkpoint覆盖到的数据文件id
+	offset      uint64 //checkpoint覆盖到的数据文件的偏移量，这个位置之前的数据都已经在checkpoint中了
+	seqNo       uint64 //事务序列号
+	reclaimSize uint64 //无效数据的大小
+	entryNum    uint64 //checkpoint中索引数据的条数
+	walGen      uint64 //checkpoint的时候切换到的wal的generation，这个generation中的索引修改都在checkpoint之后，为0表示没有开启wal
+}
+
+func (meta *checkpointMeta) encode() []byte {
+	buf := make([]byte, binary.MaxVarintLen32+binary.MaxVarintLen64*5)
+	var n = 0
+	n += binary.PutUvarint(buf[n:], uint64(meta.fileId))
+	n += binary.PutUvarint(buf[n:], meta.offset)
+	n += binary.PutUvarint(buf[n:], meta.seqNo)
+	n += binary.PutUvarint(buf[n:], meta.reclaimSize)
+	n += binary.PutUvarint(buf[n:], meta.entryNum)
+	if meta.walGen > 0 {
+		n += binary.PutUvarint(buf[n:], meta.walGen)
+	}
+	return buf[:n]
+}
+
+func decodeCheckpointMeta(buf []byte) (*checkpointMeta, bool) {
+	var values [5]uint64
+	var offset = 0
+	for i := range values {
+		v, n := binary.Uvarint(buf[offset:])
+		if n <= 0 {
+			return nil, false
+		}
+		values[i] = v
+		offset += n
+	}
+	meta := &checkpointMeta{
+		fileId:      uint32(values[0]),
+		offset:      values[1],
+		seqNo:       values[2],
+		reclaimSize: values[3],
+		entryNum:    values[4],
+	}
+	//之前的版本中没有记录wal的generation
+	if offset < len(buf) {
+		walGen, n := binary.Uvarint(buf[offset:])
+		if n <= 0 {
+			return nil, false
+		}
+		meta.walGen = walGen
+	}
+	return meta, true
+}
+
+//checkpointIndex 将内存索引写入到checkpoint文件中
+func (db *DB) checkpointIndex() error {
+	//B+树的索引本身就是持久化的，不需要checkpoint，只需要切换wal，删除之前的generation
+	if db.options.IndexType == BPT {
+		return db.checkpointVersionWal()
+	}
+	//阻塞写操作，保证获得的索引快照和数据文件的位置是一致的，checkpoint覆盖的位置之前的数据都已经更新到索引中了
+	db.indexMu.Lock()
+	db.mu.RLock()
+	if db.activeFile == nil {
+		db.mu.RUnlock()
+		db.indexMu.Unlock()
+		return nil
+	}
+	meta := &checkpointMeta{
+		fileId:      db.activeFile.FileId,
+		offset:      db.activeFile.WriteOff,
+		seqNo:       atomic.LoadUint64(&db.seqNo),
+		reclaimSize: atomic.LoadUint64(&db.reclaimSize),
+	}
+	if db.lastCheckpoint != nil && db.lastCheckpoint.fileId == meta.fileId && db.lastCheckpoint.offset == meta.offset {
+		//checkpoint之后没有新的写入
+		db.mu.RUnlock()
+		db.indexMu.Unlock()
+		return nil
+	}
+	//切换到新的generation，之后的索引修改都写入到新的generation中，版本索引的快照在释放锁之后再写入
+	var versions *mvcc.TreeIndex
+	if db.wal != nil {
+		snapshot, err := db.rotateWal()
+		if err != nil {
+			db.mu.RUnlock()
+			db.indexMu.Unlock()
+			return err
+		}
+		versions, meta.walGen = snapshot, db.walGen
+	}
+	//索引的迭代器中保存了索引的快照，获得快照之后就可以释放锁了
+	shards := db.indexShards()
+	iters := make([]index.Iterator, 0, len(shards.index))
+	var iterErr error
+	for _, idx := range shards.index {
+		iter, err := idx.Iterator(false)
+		if err != nil {
+			iterErr = err
+			break
+		}
+		iters = append(iters, iter)
+	}
+	db.mu.RUnlock()
+	db.indexMu.Unlock()
+	defer func() {
+		for _, iter := range iters {
+			iter.Close()
+		}
+	}()
+	if iterErr != nil {
+		return indexReadError(iterErr)
+	}
+	if versions != nil {
+		if err := db.writeWalSnapshot(meta.walGen, versions); err != nil {
+			return err
+		}
+	}
+
+	fileName := filepath.Join(db.options.DirPath, data.IndexCheckpointFileName)
+	tmpFile, err := os.OpenFile(fileName+checkpointTmpSuffix, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fio.DataFilePerm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	writer := bufio.NewWriter(tmpFile)
+	for _, iter := range iters {
+		for ; iter.Valid(); iter.Next() {
+			encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+				Key:   iter.Key(),
+				Value: data.EncodeLogRecordPos(iter.Value()),
+				Type:  data.LogRecordNormal,
+			})
+			if _, err := writer.Write(encRecord); err != nil {
+				_ = tmpFile.Close()
+				return err
+			}
+			meta.entryNum++
+		}
+	}
+	//最后写入元数据，标识checkpoint写入完成
+	encMeta, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   []byte(data.IndexCheckpointFileName),
+		Value: meta.encode(),
+		Type:  data.LogRecordHintFinished,
+	})
+	if _, err := writer.Write(encMeta); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), fileName); err != nil {
+		return err
+	}
+	db.lastCheckpoint = meta
+	if meta.walGen > 0 {
+		if err := db.truncateWal(meta.walGen); err != nil {
+			return err
+		}
+	}
+	db.options.Logger.Debug("index checkpoint", "dir", db.options.DirPath, "fid", meta.fileId, "offset", meta.offset, "entries", meta.entryNum)
+	return nil
+}
+
+//loadIndexCheckpoint 启动的时候加载checkpoint文件到内存索引中
+//checkpoint不存在，损坏或者已经失效的时候不会加载，退化成重放全部的数据
+func (db *DB) loadIndexCheckpoint() error {
+	fileName := filepath.Join(db.options.DirPath, data.IndexCheckpointFileName)
+	if _, err := os.Stat(fileName); err != nil {
+		return nil
+	}
+	meta, records, ok := db.readIndexCheckpoint()
+	if !ok {
+		db.options.Logger.Warn("ignore invalid index checkpoint", "dir", db.options.DirPath)
+		return removeIndexCheckpoint(db.options.DirPath)
+	}
+
+	ops := make([]*indexOp, len(records))
+	for i, record := range records {
+		ops[i] = &indexOp{key: record.Record.Key, typ: data.LogRecordNormal, pos: record.Pos}
+	}
+	if _, err := db.applyShardOps(ops); err != nil {
+		return err
+	}
+	db.checkpoint = meta
+	db.lastCheckpoint = meta
+	return nil
+}
+
+//readIndexCheckpoint 读取checkpoint文件，只有当checkpoint完整并且和当前的数据文件匹配的时候才返回true
+func (db *DB) readIndexCheckpoint() (*checkpointMeta, []*data.TransactionRecord, bool) {
+	ckptFile, err := data.OpenIndexCheckpointFile(db.options.DirPath, fio.MMapFio)
+	if err != nil {
+		return nil, nil, false
+	}
+	defer ckptFile.Close()
+
+	var (
+		records []*data.TransactionRecord
+		meta    *checkpointMeta
+		offset  uint64
+	)
+	for {
+		logRecord, size, err := ckptFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, false
+		}
+		//文件被截断的时候读取不到完整的记录
+		if logRecord == nil {
+			return nil, nil, false
+		}
+		if meta != nil {
+			//元数据之后不应该还有数据
+			return nil, nil, false
+		}
+		if logRecord.Type == data.LogRecordHintFinished {
+			var ok bool
+			//检查checkpoint中的数据条数是否完整
+			if meta, ok = decodeCheckpointMeta(logRecord.Value); !ok || meta.entryNum != uint64(len(records)) {
+				return nil, nil, false
+			}
+		} else {
+			records = append(records, &data.TransactionRecord{
+				Record: &data.LogRecord{Key: logRecord.Key, Type: logRecord.Type},
+				Pos:    data.DecodeLogRecordPos(logRecord.Value),
+			})
+		}
+		offset += size
+	}
+	if meta == nil {
+		return nil, nil, false
+	}
+	//检查checkpoint覆盖到的数据文件是否存在，并且数据文件没有被截断
+	var dataFile *data.DataFile
+	if db.activeFile != nil && db.activeFile.FileId == meta.fileId {
+		dataFile = db.activeFile
+	} else {
+		dataFile = db.olderFile[meta.fileId]
+	}
+	if dataFile == nil {
+		return nil, nil, false
+	}
+	size, err := dataFile.IoManager.Size()
+	if err != nil || uint64(size) < meta.offset {
+		return nil, nil, false
+	}
+	return meta, records, true
+}
+
+//removeIndexCheckpoint 删除checkpoint文件
+func removeIndexCheckpoint(dirPath string) error {
+	fileName := filepath.Join(dirPath, data.IndexCheckpointFileName)
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package FlexDB
+
+import (
+	"FlexDB/data"
+	"FlexDB/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//indexPositions 获得所有索引中的key和位置信息，忽略写入时记录的时间戳，重放数据文件得到的位置信息中没有时间戳
+func indexPositions(db *DB) map[string]data.LogRecordPos {
+	res := indexSnapshot(db)
+	for key, pos := range res {
+		pos.Tstamp = 0
+		res[key] = pos
+	}
+	return res
+}
+
+//从checkpoint恢复的索引需要和重放全部数据得到的索引一致
+func TestDB_IndexCheckpoint(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.FileSize = 256 * 1024
+	opts.TimeCheckpoint = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 1000; i++ {
+		_, err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.checkpointIndex())
+	ckptFile := filepath.Join(DirPath, data.IndexCheckpointFileName)
+	_, err = os.Stat(ckptFile)
+	assert.Nil(t, err)
+
+	//checkpoint之后继续写入，包括覆盖写，删除和事务
+	for i := 4000; i < 8000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 1000; i < 1500; i++ {
+		_, err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOption, db.latestRevision)
+	for i := 8000; i < 8500; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.RandomValue(64), int64(i)))
+	}
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Close())
+
+	//从checkpoint恢复
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db.lastCheckpoint)
+	fromCheckpoint := indexPositions(db)
+	reclaimFromCheckpoint := db.reclaimSize
+	seqNoFromCheckpoint := db.seqNo
+	assert.Nil(t, db.Close())
+
+	//删除checkpoint之后重放全部的数据
+	assert.Nil(t, os.Remove(ckptFile))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.lastCheckpoint)
+	assert.Equal(t, indexPositions(db), fromCheckpoint)
+	assert.Equal(t, db.reclaimSize, reclaimFromCheckpoint)
+	assert.Equal(t, db.seqNo, seqNoFromCheckpoint)
+
+	//没有新的写入的时候不会重复写入checkpoint
+	assert.Nil(t, db.checkpointIndex())
+	ckpt := db.lastCheckpoint
+	assert.Nil(t, db.checkpointIndex())
+	assert.True(t, ckpt == db.lastCheckpoint)
+}
+
+//损坏的checkpoint会被忽略，重放全部的数据
+func TestDB_IndexCheckpoint_Corrupted(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.TimeCheckpoint = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.checkpointIndex())
+	expected := indexPositions(db)
+	assert.Nil(t, db.Close())
+
+	//截断checkpoint文件，缺少了元数据
+	ckptFile := filepath.Join(DirPath, data.IndexCheckpointFileName)
+	info, err := os.Stat(ckptFile)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(ckptFile, info.Size()-10))
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.lastCheckpoint)
+	assert.Equal(t, expected, indexPositions(db))
+	_, err = os.Stat(ckptFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+//merge之后checkpoint失效，会被删除
+func TestDB_IndexCheckpoint_Merge(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.FileSize = 64 * 1024
+	opts.TimeCheckpoint = 0
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i%500), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.checkpointIndex())
+	assert.Nil(t, db.Merge(true))
+	_, err = os.Stat(filepath.Join(DirPath, data.IndexCheckpointFileName))
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, db.lastCheckpoint)
+
+	//merge之后可以重新写入checkpoint
+	assert.Nil(t, db.checkpointIndex())
+	expected := indexPositions(db)
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db.lastCheckpoint)
+	assert.Equal(t, expected, indexPositions(db))
+}
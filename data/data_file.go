@@ -6,15 +6,19 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"os"
 	"path/filepath"
 	"strconv"
 )
 
 const (
 	DataFileSuffix        = ".data"
+	DataHintFileSuffix    = ".dhint"     //每个封存的数据文件对应的hint文件
 	HintFileName          = "hint-index" //里面存储的都是索引信息
 	MergeFinishedFileName = "merge-finished"
 	SeqNoFileName         = "seq-no"
+
+	IndexCheckpointFileName = "index-checkpoint" //内存索引的checkpoint文件
 )
 
 var (
@@ -40,6 +44,12 @@ func OpenHintFile(dirPath string, managerType fio.IOManagerType) (*DataFile, err
 	return newDataFile(fileName, 0, managerType)
 }
 
+// OpenDataHintFile 打开一个数据文件对应的hint文件，在活跃文件封存的时候写入
+func OpenDataHintFile(dirPath string, fileId uint32) (*DataFile, error) {
+	fileName := GetDataHintFileName(dirPath, fileId)
+	return newDataFile(fileName, fileId, fio.StanderFIO)
+}
+
 // OpenMergeFinishedFile 打开一个merge完成的文件
 func OpenMergeFinishedFile(dirPath string) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, MergeFinishedFileName)
@@ -52,9 +62,25 @@ func OpenSeqNoFile(dirPath string) (*DataFile, error) {
 	return newDataFile(fileName, 0, fio.StanderFIO)
 }
 
+// OpenIndexCheckpointFile 打开内存索引的checkpoint文件
+func OpenIndexCheckpointFile(dirPath string, managerType fio.IOManagerType) (*DataFile, error) {
+	fileName := filepath.Join(dirPath, IndexCheckpointFileName)
+	return newDataFile(fileName, 0, managerType)
+}
+
+//OpenActiveDataFile 打开新的活跃文件，capacity是可读写的mmap预分配的文件大小
+func OpenActiveDataFile(dirPath string, fileId uint32, managerType fio.IOManagerType, capacity int64) (*DataFile, error) {
+	fileName := GetDataFileName(dirPath, fileId)
+	return newDataFileWithCapacity(fileName, fileId, managerType, capacity)
+}
+
 //生成datafile文件
 func newDataFile(fileName string, fileId uint32, ioType fio.IOManagerType) (*DataFile, error) {
-	ioManager, err := fio.NewIOManager(fileName, ioType)
+	return newDataFileWithCapacity(fileName, fileId, ioType, 0)
+}
+
+func newDataFileWithCapacity(fileName string, fileId uint32, ioType fio.IOManagerType, capacity int64) (*DataFile, error) {
+	ioManager, err := fio.NewIOManagerWithCapacity(fileName, ioType, capacity)
 	if err != nil {
 		return nil, err
 	}
@@ -71,6 +97,11 @@ func GetDataFileName(dirPath string, fileId uint32) string {
 	return fileName
 }
 
+func GetDataHintFileName(dirPath string, fileId uint32) string {
+	fileName := filepath.Join(dirPath, fmt.Sprintf("%09d%s", fileId, DataHintFileSuffix))
+	return fileName
+}
+
 //ReadLogRecord 根据offset从数据文件中读取LogRecord
 //返回的第一个参数是读取的这个日志信息
 //返回的第二个参数是该日志的长度
@@ -126,6 +157,33 @@ func (df *DataFile) ReadLogRecord(offset uint64) (*LogRecord, uint64, error) {
 	//检验正确，有效数据进行返回
 	return logRecord, uint64(recordSize), nil
 }
+//ScanWriteOff 获得数据文件实际写入的位置，忽略预分配的空间中没有写入数据的0
+//文件的最后一个字节不是0的时候文件的大小就是写入的位置，否则从头扫描到第一条空的记录
+func (df *DataFile) ScanWriteOff() (uint64, error) {
+	size, err := df.IoManager.Size()
+	if err != nil || size == 0 {
+		return 0, err
+	}
+	last, err := df.readNByte(1, uint64(size-1))
+	if err != nil {
+		return 0, err
+	}
+	if last[0] != 0 {
+		return uint64(size), nil
+	}
+	var offset uint64
+	for {
+		_, recordSize, err := df.ReadLogRecord(offset)
+		if err == io.EOF || (err == nil && recordSize == 0) {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		offset += recordSize
+	}
+}
+
 func (df *DataFile) Sync() error {
 	return df.IoManager.Sync()
 }
@@ -151,6 +209,18 @@ func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
 	return df.Write(encRecord)
 }
 
+// EncodeDataHintRecord 对数据文件中一条记录的hint信息进行编码
+// key是写入数据文件时带有事务序列号的key,value是该记录的位置信息,type和原记录保持一致
+func EncodeDataHintRecord(key []byte, typ LogRecordType, pos *LogRecordPos) []byte {
+	record := &LogRecord{
+		Key:   key,
+		Value: EncodeLogRecordPos(pos),
+		Type:  typ,
+	}
+	encRecord, _ := EncodeLogRecord(record)
+	return encRecord
+}
+
 //WriteAndSyncMergeFinishRecord 写入持久化并关闭
 func (df *DataFile) WriteAndSyncMergeFinishRecord(key []byte, nonMergeFileId int) error {
 	//
@@ -197,3 +267,35 @@ func (df *DataFile) SetIOManager(dirPath string, ioType fio.IOManagerType) error
 	df.IoManager = IOmanager
 	return nil
 }
+
+//SetWritableIOManager 将数据文件切换为可写的IO类型，capacity是预分配的文件大小
+//崩溃的时候没有裁剪预分配的空间，WriteOff之后都是没有写入数据的0，切换之前截断到WriteOff
+func (df *DataFile) SetWritableIOManager(dirPath string, ioType fio.IOManagerType, capacity int64) error {
+	if err := df.IoManager.Close(); err != nil {
+		return err
+	}
+	fileName := GetDataFileName(dirPath, df.FileId)
+	if capacity > 0 {
+		if err := truncateFile(fileName, int64(df.WriteOff)); err != nil {
+			return err
+		}
+	}
+	IOmanager, err := fio.NewIOManagerWithCapacity(fileName, ioType, capacity)
+	if err != nil {
+		return err
+	}
+	df.IoManager = IOmanager
+	return nil
+}
+
+//truncateFile 文件大于size的时候截断到size
+func truncateFile(fileName string, size int64) error {
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	if stat.Size() <= size {
+		return nil
+	}
+	return os.Truncate(fileName, size)
+}
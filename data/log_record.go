@@ -11,7 +11,42 @@ type LogRecordPos struct {
 	Fid    uint32 //文件ID，该数据存储在哪个文件中
 	Offset uint64 //偏移，数据存储到数据文件的哪个位置
 	Size   uint32 //该数据存储在磁盘中的大小
-	Tstamp uint32 //内存索引的时间戳，代表该key的最新版本号
+	Tstamp uint32 //内存索引的时间戳，代表该key的最新版本号，内存索引中使用PackedPos保存的时候不会保留
+	//数据文件中key前面的事务序列号编码之后的长度，用于不读取数据文件计算value的大小，为0表示未知，按照非事务写入的1个字节计算
+	SeqSize uint8
+}
+
+//PackedPos 紧凑编码的位置信息，内存索引中直接保存这个结构体，不需要为每一个位置信息单独分配LogRecordPos
+//fid   size   seqSize   offset
+//32位  32位    4位       60位
+//不保存时间戳，和重放数据文件构建出来的索引保持一致
+type PackedPos struct {
+	fidSize uint64
+	offset  uint64
+}
+
+//packedOffsetBits PackedPos中offset占用的位数，剩下的高位保存事务序列号的长度
+const packedOffsetBits = 60
+
+//PackedPosSize PackedPos在内存中占用的字节数
+const PackedPosSize = 16
+
+//PackLogRecordPos 将位置信息编码成PackedPos
+func PackLogRecordPos(pos *LogRecordPos) PackedPos {
+	return PackedPos{
+		fidSize: uint64(pos.Fid)<<32 | uint64(pos.Size),
+		offset:  uint64(pos.SeqSize)<<packedOffsetBits | pos.Offset,
+	}
+}
+
+//Unpack 将PackedPos解码成位置信息
+func (p PackedPos) Unpack() *LogRecordPos {
+	return &LogRecordPos{
+		Fid:     uint32(p.fidSize >> 32),
+		Offset:  p.offset & (1<<packedOffsetBits - 1),
+		Size:    uint32(p.fidSize),
+		SeqSize: uint8(p.offset >> packedOffsetBits),
+	}
 }
 
 //将Logrecordtype等价于byte类型，增加可读性质
@@ -22,10 +57,12 @@ const (
 	//LogRecordNormal：正常写入
 	//LogRecordDeleted:删除数据
 	//LogRecordTxnFinished :事务结束的标志
+	//LogRecordHintFinished :数据文件hint写入完成的标志
 
 	LogRecordNormal LogRecordType = iota
 	LogRecordDeleted
 	LogRecordTxnFinished
+	LogRecordHintFinished
 )
 
 //LogRecordHeader 写入到磁盘中数据的数据头
@@ -87,15 +124,46 @@ func EncodeLogRecord(logRecord *LogRecord) ([]byte, uint64) {
 	return encByteBuf, size
 }
 
+//ValueSize 根据数据在磁盘中的大小计算出value的长度，keySize是写入到数据文件中去掉事务序列号之后的key的长度
+//不需要读取数据文件，只根据位置信息就可以得到value的大小
+func (pos *LogRecordPos) ValueSize(keySize int) uint32 {
+	if pos.SeqSize == 0 {
+		keySize++
+	} else {
+		keySize += int(pos.SeqSize)
+	}
+	//去掉header中固定长度的crc type tstamp，以及key和key的长度
+	rest := int64(pos.Size) - 9 - int64(keySize) - int64(uvarintSize(uint64(keySize)))
+	//剩下的是value的长度编码之后的大小加上value本身的大小
+	for n := 1; n <= binary.MaxVarintLen32; n++ {
+		if rest-int64(n) >= 0 && uvarintSize(uint64(rest-int64(n))) == n {
+			return uint32(rest - int64(n))
+		}
+	}
+	return 0
+}
+
+//uvarintSize 获得x按照uvarint编码之后的长度
+func uvarintSize(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
+
 // EncodeLogRecordPos 将位置信息进行编码
 func EncodeLogRecordPos(pos *LogRecordPos) []byte {
-	buf := make([]byte, binary.MaxVarintLen64+binary.MaxVarintLen32*2+4)
+	buf := make([]byte, binary.MaxVarintLen64+binary.MaxVarintLen32*2+5)
 	var index = 0
 	index += binary.PutUvarint(buf[index:], uint64(pos.Fid))
 	index += binary.PutUvarint(buf[index:], pos.Offset)
 	index += binary.PutUvarint(buf[index:], uint64(pos.Size))
 	binary.LittleEndian.PutUint32(buf[index:], pos.Tstamp)
 	index += 4
+	buf[index] = pos.SeqSize
+	index++
 
 	return buf[:index]
 }
@@ -110,12 +178,19 @@ func DecodeLogRecordPos(buf []byte) *LogRecordPos {
 	size, n := binary.Uvarint(buf[index:])
 	index += n
 	stamp := binary.LittleEndian.Uint32(buf[index:])
+	index += 4
+	//之前的版本编码的时候没有事务序列号的长度
+	var seqSize uint8
+	if index < len(buf) {
+		seqSize = buf[index]
+	}
 
 	return &LogRecordPos{
-		Fid:    uint32(fileId),
-		Offset: offset,
-		Size:   uint32(size),
-		Tstamp: stamp,
+		Fid:     uint32(fileId),
+		Offset:  offset,
+		Size:    uint32(size),
+		Tstamp:  stamp,
+		SeqSize: seqSize,
 	}
 }
 
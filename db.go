@@ -3,20 +3,21 @@ package FlexDB
 import (
 	"FlexDB/data"
 	"FlexDB/fio"
-	"FlexDB/index"
+	"FlexDB/logger"
 	"FlexDB/mvcc"
 	"FlexDB/utils"
+	"FlexDB/wal"
+	"bytes"
 	"encoding/binary"
 	"github.com/gofrs/flock"
-	"io"
 	"os"
 	"path/filepath"
 	"sort"
-	"stathat.com/c/consistent"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -31,8 +32,7 @@ type DB struct {
 	mu                     *sync.RWMutex
 	activeFile             *data.DataFile            //当前活跃文件，可以用来写入,在加载数据文件的时候，活跃文件和老文件都会被初始化
 	olderFile              map[uint32]*data.DataFile //旧的数据文件，用来读取
-	hashRing               *consistent.Consistent    //一致性哈希环，用来保证数据负载均衡式的分配到各个索引中
-	index                  map[string]index.Indexer  //数据的内存索引,TODO 索引数据可以定期写入到磁盘中，保证故障回复,B+树本身就是写入到磁盘的，
+	shards                 atomic.Value              //当前的索引分片*indexShards，包含一致性哈希环和数据的内存索引，reshard的时候整体替换
 	seqNo                  uint64                    //事务序列号，全局递增
 	seqNoFileExists        bool                      //存储事务序列号的文件是否存在
 	isInitialDBInitialized bool                      //是否是第一次初始化此数据目录
@@ -40,18 +40,28 @@ type DB struct {
 	ByteWritten            uint64                    //记录一个周期中写入的字节数
 	reclaimSize            uint64                    //这个是记录当前有多少字节是无效的
 	mergeInfo              MergeInfo                 //保存merge相关信息
-	exitSignal             chan struct{}             //退出信号的管道，用于控制Goroutine的退出
+	scheduler              *scheduler                //后台任务调度器
 	stat                   *Stat                     //记录某一个时刻的db的状态
 	latestRevision         int64                     //下一次进来需要使用的版本号,每次事务都更新当前的版本号信息
 	versionIndex           *mvcc.TreeIndex           //全局只能拥有一个TreeIndex，这个是内存级别的，所以在db启动的时候，就需要构造这个对象,我们可以使用WAL，把数据存储在WAL中,
+	activeHint             []byte                    //当前活跃文件中所有记录的hint信息，活跃文件封存的时候写入到hint文件中
+	activeHintValid        bool                      //hint缓冲是否完整的记录了活跃文件中的所有记录
+	indexMu                sync.RWMutex              //写操作在写入数据文件和更新索引的期间持有读锁，checkpoint和reshard的时候持有写锁
+	checkpoint             *checkpointMeta           //启动的时候加载的checkpoint，只需要重放这个位置之后的数据
+	lastCheckpoint         *checkpointMeta           //最近一次写入或者加载的checkpoint
+	wal                    *wal.Wal                  //记录索引和版本信息修改的wal，没有开启的时候为空
+	walGen                 uint64                    //当前wal的generation
+	walMu                  sync.Mutex                //保护wal的并发写入和切换
 }
 
 //Stat 可以记录某一个时刻的db状态
 type Stat struct {
-	KeyNum          int    //key的总数量
-	DataFileNum     uint   //磁盘中数据文件的数量
-	ReclaimableSize uint64 //可以进行merge回收的数据量
-	DiskSize        uint64 //所占磁盘空间的大小
+	KeyNum          int              //key的总数量
+	DataFileNum     uint             //磁盘中数据文件的数量
+	ReclaimableSize uint64           //可以进行merge回收的数据量
+	DiskSize        uint64           //所占磁盘空间的大小
+	IndexMemory     int64            //所有内存索引占用内存的估算值
+	ShardMemory     map[string]int64 //每个索引实例占用内存的估算值
 }
 
 //Open 打开bitcask存储引擎实例
@@ -80,23 +90,53 @@ func Open(options Options) (*DB, error) {
 		//没有获得锁，说明这个锁被其他进程给使用了
 		return nil, ErrDataBaseIsUsing
 	}
+	options.Logger = logger.OrDefault(options.Logger)
 	//初始化DB的实例，并对数据结构进行初始化
 	db := &DB{
 		options:                options,
 		mu:                     new(sync.RWMutex),
 		olderFile:              make(map[uint32]*data.DataFile),
-		hashRing:               consistent.New(),                                 //
-		index:                  make(map[string]index.Indexer, options.indexNum), //初始化内存索引
 		seqNo:                  nonTransactionSeq,
 		isInitialDBInitialized: isInitial,
 		fileLock:               fileFlock,
-		exitSignal:             make(chan struct{}),
 		versionIndex:           mvcc.NewTreeIndex(), //初始化一个版本的索引树，当前的数据还没有实现对数据的持久化
 	}
-	db.initIndex()
+	db.scheduler = newScheduler(db)
+	shards, err := newIndexShards(options, options.IndexNum) //初始化内存索引
+	if err != nil {
+		_ = fileFlock.Unlock()
+		return nil, err
+	}
+	db.shards.Store(shards)
+	//加载数据文件并恢复索引
+	recoverStart := time.Now()
+	err = db.recoverData()
+	db.listener().OnRecovery(RecoveryEvent{
+		DirPath:     options.DirPath,
+		DataFileNum: len(db.fileIds),
+		Duration:    time.Since(recoverStart),
+		Err:         err,
+	})
+	if err != nil {
+		options.Logger.Error("fail to recover database", "dir", options.DirPath, "err", err)
+		return nil, err
+	}
+	options.Logger.Info("database recovered", "dir", options.DirPath, "files", len(db.fileIds), "duration", time.Since(recoverStart))
+
+	//注册后台的定时任务
+	if err := db.startBackgroundTask(); err != nil {
+		return nil, err
+	}
+
+	//在这个地方启动一个后台线程进行每5分钟定期清理一定量的数据，减轻压力，避免一次性清理过多的数据，导致服务中断
+	return db, nil
+}
+
+//recoverData 启动的时候加载merge文件和数据文件，并恢复内存索引
+func (db *DB) recoverData() error {
 	//加载merge数据目录,将merge目录下的数据都移动过来
 	if err := db.loadMergeFiles(); err != nil {
-		return nil, err
+		return err
 	}
 	defer func() {
 		//完成merge后需要把关于merge的信息清空
@@ -105,45 +145,44 @@ func Open(options Options) (*DB, error) {
 
 	//正常的在进行加载数据文件
 	if err := db.loadDataFile(); err != nil {
-		return nil, err
+		return err
 	}
 
 	//加载内存索引
 	//非b+树是把索引存储在内存中
-	if options.IndexType != BPT {
+	if db.options.IndexType != BPT {
+		//先加载checkpoint，之后只需要重放checkpoint之后的数据
+		if err := db.loadIndexCheckpoint(); err != nil {
+			return err
+		}
+		defer func() {
+			db.checkpoint = nil
+		}()
+	}
+	//重放wal恢复版本索引，内存索引在checkpoint的基础上重放wal中的修改，之后只需要扫描wal没有覆盖的数据
+	if db.options.EnableWal {
+		if err := db.replayWal(); err != nil {
+			return err
+		}
+	}
+	if db.options.IndexType != BPT {
 		if err := db.loadIndex(); err != nil {
-			return nil, err
+			return err
 		}
 	}
 
 	//b+树是把索引存储在磁盘中,所以不需要把数据读取到内存中，需要的时候读取即可,取出当前的事务号
-	if options.IndexType == BPT {
+	if db.options.IndexType == BPT {
 		//加载事务序列号(merge的时候)
 		if err := db.loadSeqNo(); err != nil {
-			return nil, err
-		}
-		//B+树的active文件需要更新
-		//对于B+树模型，不会更新offset，所以这里要手动的更新active文件的offset
-		if db.activeFile != nil {
-			size, err := db.activeFile.IoManager.Size()
-			if err != nil {
-				return nil, err
-			}
-			db.activeFile.WriteOff = uint64(size)
+			return err
 		}
 	}
-	if db.options.MMapAtStartup {
-		//如果使用MMap加速启动的话，active文件是只读不能写的，所以我们需要设置成标准文件类型
-		if err := db.setIoManger(fio.StanderFIO); err != nil {
-			return nil, err
-		}
+	//加载的时候活跃文件可能是只读的mmap，或者没有预分配空间，构建索引得到WriteOff之后切换成可写的文件类型
+	if err := db.setActiveFileWritable(); err != nil {
+		return err
 	}
-
-	//启动goroutine处理定时任务
-	go db.startBackgroundTask()
-
-	//在这个地方启动一个后台线程进行每5分钟定期清理一定量的数据，减轻压力，避免一次性清理过多的数据，导致服务中断
-	return db, nil
+	return nil
 }
 
 //Put 将key和value添加到数据库中
@@ -152,15 +191,13 @@ func (db *DB) Put(key []byte, value []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
-	rev := mvcc.Revision{Main: db.latestRevision, Sub: 0}
-	//更新当前的版本号
-	//TODO db.latestRevision use atomic addition seqNo := atomic.AddUint64(&wb.db.seqNo, 1) //原子加1
-	atomic.AddInt64(&db.latestRevision, 1)
-	//db.latestRevision++
-	revEncoded := rev.Encode()
-	//将当前将当前的版本版本链信息添加到keyIndex中进行管理
-	db.VersionPut(key, rev)
-	key = append(key, revEncoded...) //当前的key追加上这个序列化之后的版本号信息
+	//写入数据文件和更新索引的期间不能进行checkpoint和reshard
+	db.indexMu.RLock()
+	defer db.indexMu.RUnlock()
+	//原子地获得当前的版本号，并更新下一次使用的版本号
+	rev := mvcc.Revision{Main: atomic.AddInt64(&db.latestRevision, 1) - 1, Sub: 0}
+	userKey := key
+	key = keyWithRevision(key, rev) //当前的key追加上这个序列化之后的版本号信息
 
 	//构造LogRecord结构体
 	logRecord := &data.LogRecord{
@@ -168,28 +205,38 @@ func (db *DB) Put(key []byte, value []byte) error {
 		Value: value,
 		Type:  data.LogRecordNormal,
 	}
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecordWithWal(logRecord, func(pos *data.LogRecordPos) []walEntry {
+		return []walEntry{
+			{typ: walIndexPut, key: key, pos: pos},
+			{typ: walVersionPut, key: userKey, rev: rev},
+		}
+	})
 	if err != nil {
 		return err
 	}
 	//获得索引信息，更新内存索引,内存索引中的key就是用户的key，没有进行任何的编码
-	node, err := db.hashRing.Get(string(key)) //获得对应实例
+	idx, err := db.indexShards().get(key) //获得对应实例
 	if err != nil {
 		return err
 	}
-	if oldPos := db.index[node].Put(key, pos); oldPos != nil {
+	oldPos, err := idx.Put(key, pos)
+	if err != nil {
+		//数据已经写入了数据文件，但是索引中没有，版本号也不会更新，这次写入对读不可见
+		return indexUpdateError(err)
+	}
+	if oldPos != nil {
 		//如果有数据，则出现无效数据，存在磁盘里，但内存中已更新。
-		db.reclaimSize += uint64(oldPos.Size)
+		atomic.AddUint64(&db.reclaimSize, uint64(oldPos.Size))
 	}
+	//索引更新完之后再将当前的版本链信息添加到keyIndex中进行管理，版本可见的时候索引中一定已经有数据了
+	db.VersionPut(userKey, rev)
 	return nil
 }
 
 //Get 根据Key读取数据,根据当前的revision信息进行处理
 //TODO 可以实现一个读缓存来存储一些数据，避免每次直接进行磁盘IO，可以考虑使用LRU（用到节点中里面的timestamp和内存索引的timestamp比较，看是否返回），同时也可以考虑使用布隆过滤器来过滤没找到的key，就不需要要取查找
 func (db *DB) Get(key []byte) ([]byte, error) {
-	val, err := db.GetVal(key, db.latestRevision)
-	db.latestRevision++
-	return val, err
+	return db.GetVal(key, atomic.AddInt64(&db.latestRevision, 1)-1)
 }
 
 //GetVal 根据给定的版本号，寻找合适符合条件的数据
@@ -206,15 +253,17 @@ func (db *DB) GetVal(key []byte, atRev int64) ([]byte, error) {
 		//当前的versionIndex中
 		return nil, ErrKeyNotFound
 	}
-	key = append(key, rev.Encode()...)
-	//更新当前的版本号
+	key = keyWithRevision(key, *rev)
 
 	//从内存中拿出索引位置信息
-	node, err := db.hashRing.Get(string(key)) //获得对应实例
+	idx, err := db.indexShards().get(key) //获得对应实例
 	if err != nil {
 		return nil, err
 	}
-	logRecordPos := db.index[node].Get(key)
+	logRecordPos, err := idx.Get(key)
+	if err != nil {
+		return nil, indexReadError(err)
+	}
 	if logRecordPos == nil {
 		return nil, ErrKeyNotFound
 	}
@@ -253,6 +302,8 @@ func (db *DB) getValueByPos(logRecordPos *data.LogRecordPos) ([]byte, error) {
 //ListKeys 获取数据中所有的key
 func (db *DB) ListKeys(options IteratorOptions) [][]byte {
 	var keys [][]byte
+	//只需要key，不用读取数据文件
+	options.KeysOnly = true
 	iterator := db.NewIterator(options)
 	defer iterator.Close()
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
@@ -261,10 +312,9 @@ func (db *DB) ListKeys(options IteratorOptions) [][]byte {
 	return keys
 }
 
-//Fold 获取所有的数据，并执行用户指定的操作
+//Fold 获取所有的数据，并执行用户指定的操作，options中指定了KeysOnly的时候value为空
+//迭代器读取数据的时候会自己加锁，这里不能再持有db的锁，否则有写操作等待的时候会死锁
 func (db *DB) Fold(fn func(key []byte, value []byte) bool, options IteratorOptions) error {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
 	iterator := db.NewIterator(options)
 	//使用完需要将他关闭掉,避免读写阻塞住
 	defer iterator.Close()
@@ -275,8 +325,99 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool, options IteratorOptio
 			break
 		}
 	}
-	return nil
+	return iterator.Err()
+
+}
+
+//KeyValue 范围查询返回的一条数据
+type KeyValue struct {
+	Key   []byte
+	Value []byte
+}
 
+//Scan 按照从小到大的顺序获得[start, end)范围内的数据，最多返回limit条数据
+//start或者end为空表示不限制对应的边界，limit小于等于0表示不限制数量
+func (db *DB) Scan(start, end []byte, limit int) ([]KeyValue, error) {
+	options := DefaultIteratorOptions
+	options.LowerBound = start
+	options.UpperBound = end
+	iterator := db.NewIterator(options)
+	defer iterator.Close()
+	if err := iterator.Err(); err != nil {
+		return nil, err
+	}
+	var kvs []KeyValue
+	for ; iterator.Valid(); iterator.Next() {
+		if limit > 0 && len(kvs) >= limit {
+			break
+		}
+		val, err := iterator.value()
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, KeyValue{Key: iterator.Key(), Value: val})
+	}
+	return kvs, nil
+}
+
+//ScanPage 分页遍历数据，每次最多返回limit条数据，以及用来获取下一页数据的游标，遍历结束的时候游标为空
+//cursor为空表示从头开始遍历，之后传入上一页返回的游标，options需要和获取第一页的时候保持一致
+//游标中记录了第一页的读版本号，之后的每一页都使用同一个读版本号，分页期间并发的写入和merge不会导致数据重复或者遗漏
+//limit小于等于0表示不限制数量
+func (db *DB) ScanPage(cursor []byte, limit int, options IteratorOptions) ([]KeyValue, []byte, error) {
+	var lastKey []byte
+	if len(cursor) > 0 {
+		readRev, key, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, nil, err
+		}
+		options.Revision = readRev
+		lastKey = key
+	}
+	iterator := db.NewIterator(options)
+	defer iterator.Close()
+	if err := iterator.Err(); err != nil {
+		return nil, nil, err
+	}
+	if lastKey != nil {
+		//从上一页的最后一个key之后开始遍历
+		iterator.Seek(lastKey)
+		if iterator.Valid() && bytes.Equal(iterator.Key(), lastKey) {
+			iterator.Next()
+		}
+	}
+	var kvs []KeyValue
+	for ; iterator.Valid(); iterator.Next() {
+		if limit > 0 && len(kvs) >= limit {
+			//还有数据没有遍历完，返回下一页的游标
+			return kvs, encodeCursor(iterator.readRev, kvs[len(kvs)-1].Key), nil
+		}
+		val, err := iterator.value()
+		if err != nil {
+			return nil, nil, err
+		}
+		kvs = append(kvs, KeyValue{Key: iterator.Key(), Value: val})
+	}
+	return kvs, nil, nil
+}
+
+//encodeCursor 将读版本号和最后一个key编码成游标
+//readRev   key
+//变长        变长
+func encodeCursor(readRev int64, key []byte) []byte {
+	buf := make([]byte, binary.MaxVarintLen64+len(key))
+	n := binary.PutVarint(buf, readRev)
+	copy(buf[n:], key)
+	return buf[:n+len(key)]
+}
+
+//decodeCursor 解析游标，获得读版本号和最后一个key
+func decodeCursor(cursor []byte) (int64, []byte, error) {
+	readRev, n := binary.Varint(cursor)
+	if n <= 0 || readRev <= 0 || n == len(cursor) {
+		return 0, nil, ErrInvalidCursor
+	}
+	return readRev, cursor[n:], nil
 }
 
 //Delete 根据key删除对应的数据,如果存在的话，返回true，否则返回失败
@@ -284,24 +425,29 @@ func (db *DB) Delete(key []byte) (bool, error) {
 	if len(key) == 0 {
 		return false, ErrKeyIsEmpty
 	}
-	rev := mvcc.Revision{Main: db.latestRevision, Sub: 0}
+	//写入数据文件和更新索引的期间不能进行checkpoint和reshard
+	db.indexMu.RLock()
+	defer db.indexMu.RUnlock()
+	rev := mvcc.Revision{Main: atomic.AddInt64(&db.latestRevision, 1) - 1, Sub: 0}
 	oldRev, err := db.VersionDelete(key, rev) //先查找当前的最近的一个版本号
 	if err != nil {
 		return false, err
 	}
-	atomic.AddInt64(&db.latestRevision, 1)
+	versionEntry := walEntry{typ: walVersionDelete, key: key, rev: rev}
 
-	oldRevEncoded := oldRev.Encode()
-	key = append(key, oldRevEncoded...) //当前的key追加上这个序列化之后的版本号信息
+	key = keyWithRevision(key, *oldRev) //当前的key追加上这个序列化之后的版本号信息
 
 	//在内存索引中查找这个key是否存在,避免用户一致调用delete方法去删除一个不存在的key，导致磁盘文件膨胀
-	node, err := db.hashRing.Get(string(key)) //获得对应实例
+	idx, err := db.indexShards().get(key) //获得对应实例
 	if err != nil {
 		return false, err
 	}
-	if pos := db.index[node].Get(key); pos == nil {
-		//当前key不存在，直接返回
-		return false, nil
+	valuePos, err := idx.Get(key)
+	if err != nil {
+		return false, indexReadError(err)
+	} else if valuePos == nil {
+		//当前key不存在，直接返回，版本索引中已经添加了墓碑，也需要写入到wal中
+		return false, db.writeWal(nonTransactionSeq, versionEntry)
 	}
 
 	//构造LogRecord标识其是被删除的
@@ -310,51 +456,45 @@ func (db *DB) Delete(key []byte) (bool, error) {
 		Type: data.LogRecordDeleted,
 	}
 	//写入到数据文件中
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecordWithWal(logRecord, func(pos *data.LogRecordPos) []walEntry {
+		return []walEntry{versionEntry, {typ: walIndexDelete, key: key, pos: pos}}
+	})
 	if err != nil {
 		return false, err
 	}
 	//删除的这个数据本身也是无效数据存储在磁盘中,也是可以删除的
-	db.reclaimSize += uint64(pos.Size)
-
-	if err != nil {
-		return false, err
-	}
-	//在内存索引中将对应的key删除掉
-	oldPos, ok := db.index[node].Delete(key)
+	atomic.AddUint64(&db.reclaimSize, uint64(pos.Size))
 
-	if !ok {
-		return false, ErrIndexUpdateFailed
-	}
-	if oldPos != nil {
-		db.reclaimSize += uint64(oldPos.Size)
-	}
+	//内存索引中保留被删除的版本，之前的读版本号仍然可以读取到，版本索引中的墓碑保证之后的读取看不到它
+	//被删除的版本在merge的时候才会被回收
+	atomic.AddUint64(&db.reclaimSize, uint64(valuePos.Size))
 	return true, nil
 }
 
 // Close 关闭数据库,清空所有的资源
-func (db *DB) Close() error {
+func (db *DB) Close() (err error) {
 
 	defer func() {
 		if err := db.fileLock.Unlock(); err != nil {
 			panic("fail to unlock the directory")
 		}
+		db.listener().OnClose(CloseEvent{DirPath: db.options.DirPath, Err: err})
 	}()
+	//先停止后台任务，并等待正在执行的任务完成，后台任务可能需要获得锁
+	db.scheduler.stop()
+	//关闭wal
+	if err := db.closeWal(); err != nil {
+		return err
+	}
 	if db.activeFile == nil {
 		return nil
 	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	close(db.exitSignal) //发送退出信号给goRuntine
-	// 等待后台 Goroutine 完全退出
-	<-db.exitSignal
 	//关闭索引
-	for i := 0; i < db.options.indexNum; i++ {
-		node := "index" + strconv.Itoa(i)
-		if err := db.index[node].Close(); err != nil {
-			return err
-		}
+	if err := db.indexShards().close(); err != nil {
+		return err
 	}
 	//保存当前的事务序列号，B+树需要
 	if err := db.saveSeqNo(); err != nil {
@@ -369,12 +509,32 @@ func (db *DB) Close() error {
 }
 
 func (db *DB) Sync() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.syncWal(); err != nil {
+		return err
+	}
 	if db.activeFile == nil {
 		return nil
 	}
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	return db.activeFile.Sync()
+	return db.syncActiveFile()
+}
+
+//dirSize 获得数据目录所占磁盘空间的大小，需要持有mu的锁
+//活跃文件预分配到了FileSize，文件的大小不是实际写入的大小，只计算已经写入的部分，否则较小的数据库永远达不到merge的比例
+func (db *DB) dirSize() (uint64, error) {
+	size, err := utils.DirSize(db.options.DirPath)
+	if err != nil || db.activeFile == nil {
+		return size, err
+	}
+	stat, err := os.Stat(data.GetDataFileName(db.options.DirPath, db.activeFile.FileId))
+	if err != nil {
+		return 0, err
+	}
+	if preallocated := uint64(stat.Size()); preallocated > db.activeFile.WriteOff && size >= preallocated {
+		size -= preallocated - db.activeFile.WriteOff
+	}
+	return size, nil
 }
 
 //Stat 获得当前db的状态,可以放到后台线程来进行执行,不定时进行更新
@@ -385,16 +545,23 @@ func (db *DB) Stat() *Stat {
 	if db.activeFile != nil {
 		dataFiles += 1
 	}
-	totalSize, err := utils.DirSize(db.options.DirPath)
+	totalSize, err := db.dirSize()
 	if err != nil {
 		return nil
 	}
-	return &Stat{
+	stat := &Stat{
 		//KeyNum:          db.index.Size(),
 		DataFileNum:     dataFiles,
-		ReclaimableSize: db.reclaimSize,
+		ReclaimableSize: atomic.LoadUint64(&db.reclaimSize),
 		DiskSize:        totalSize,
+		ShardMemory:     make(map[string]int64),
+	}
+	for node, idx := range db.indexShards().index {
+		memory := idx.MemoryUsage()
+		stat.ShardMemory[node] = memory
+		stat.IndexMemory += memory
 	}
+	return stat
 
 }
 
@@ -428,7 +595,7 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	//如果写入的数据已经达到了活跃文件的阈值，则关闭活跃文件（标记为旧文件），并打开新的活跃文件
 	if db.activeFile.WriteOff+size > db.options.FileSize {
 		//由于当前的活跃文件的大小超过了阈值，所以需要将该活跃文件先进行持久化到磁盘中
-		if err := db.activeFile.Sync(); err != nil {
+		if err := db.syncActiveFile(); err != nil {
 			return nil, err
 		}
 		//持久化之后，修改成MMap方式,无法进行修改，加快文件的读取
@@ -450,6 +617,10 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	}
 
 	db.ByteWritten += size
+	//返回位置信息,包含当前的位置信息
+	pos := &data.LogRecordPos{Fid: db.activeFile.FileId, Offset: writeOff, Size: uint32(size), Tstamp: binary.LittleEndian.Uint32(encRecord[5:9]), SeqSize: logRecordSeqSize(logRecord.Key)}
+	//记录当前记录的hint信息,在活跃文件封存的时候写入hint文件
+	db.appendDataHint(logRecord.Key, logRecord.Type, pos)
 	//binary.LittleEndian.Uint32(encRecord[5:9])
 
 	////判断是否需要对数据进行安全的持久化操作
@@ -459,16 +630,13 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	//	needSync = true
 	//}
 	if db.needSync() {
-		if err := db.activeFile.Sync(); err != nil {
+		if err := db.syncActiveFile(); err != nil {
 			return nil, err
 		}
 		db.ByteWritten = 0 //重新将数据进行清零
 
 	}
 
-	//返回位置信息,包含当前的位置信息
-	pos := &data.LogRecordPos{Fid: db.activeFile.FileId, Offset: writeOff, Size: uint32(size), Tstamp: binary.LittleEndian.Uint32(encRecord[5:9])}
-
 	return pos, nil
 
 }
@@ -488,16 +656,33 @@ func (db *DB) needSync() bool {
 func (db *DB) setActiveDataFile() error {
 	//设置初始的activeID
 	var initialFileId uint32 = 0
+	var sealedFile *data.DataFile
 	//如果active已经存在了，就说明前面的active文件已经写到阈值了，需要新开一个文件了
 	if db.activeFile != nil {
+		sealedFile = db.activeFile
 		initialFileId = db.activeFile.FileId + 1
+		//当前的活跃文件被封存了，将该文件的hint信息写入到hint文件中，加速下一次启动
+		if err := db.writeDataHintFile(); err != nil {
+			return err
+		}
 	}
 	//这个地方打开的文件需要使用标准IO的
-	dataFile, err := data.OpenDataFile(db.options.DirPath, initialFileId, fio.StanderFIO) //打开一个新的活跃文件用于读写
+	dataFile, err := data.OpenActiveDataFile(db.options.DirPath, initialFileId, db.options.DataFileIOType, int64(db.options.FileSize)) //打开一个新的活跃文件用于读写
 	if err != nil {
 		return err
 	}
 	db.activeFile = dataFile
+	//新的活跃文件是空的，后续写入的记录都会记录在hint缓冲中
+	db.resetDataHint(true)
+	if sealedFile != nil {
+		db.options.Logger.Debug("rotate active file", "dir", db.options.DirPath, "old_fid", sealedFile.FileId, "old_size", sealedFile.WriteOff, "new_fid", dataFile.FileId)
+		db.listener().OnFileRotated(FileRotatedEvent{
+			DirPath:     db.options.DirPath,
+			OldFileId:   sealedFile.FileId,
+			OldFileSize: sealedFile.WriteOff,
+			NewFileId:   dataFile.FileId,
+		})
+	}
 	return nil
 }
 
@@ -512,6 +697,18 @@ func checkOptions(options Options) error {
 	if options.DataFileMergeRatio < 0 || options.DataFileMergeRatio > 1 {
 		return ErrMergeRatio
 	}
+	if options.ShardType != HashShard && options.ShardType != RangeShard {
+		return ErrShardTypeInvalid
+	}
+	if err := checkIndexNum(options.ShardType, options.IndexNum); err != nil {
+		return err
+	}
+	if options.IndexKeyPrefixLen < 0 {
+		return ErrKeyPrefixLenInvalid
+	}
+	if options.DataFileIOType != fio.StanderFIO && options.DataFileIOType != fio.DirectFio && options.DataFileIOType != fio.MMapRWFio {
+		return ErrDataFileIOTypeInvalid
+	}
 	return nil
 }
 
@@ -548,9 +745,9 @@ func (db *DB) loadDataFile() error {
 
 	//遍历每个文件ID，打开对应的数据文件
 	for i, fid := range fileIds {
-		ioType := fio.StanderFIO
-		if db.options.MMapAtStartup {
-			//在启动的使用Mmap加速读取文件来构建索引
+		ioType := db.options.DataFileIOType
+		if db.options.MMapAtStartup || ioType == fio.MMapRWFio {
+			//在启动的使用Mmap加速读取文件来构建索引，可读写的mmap需要在构建索引得到WriteOff之后再切换
 			ioType = fio.MMapFio
 		}
 		dataFile, err := data.OpenDataFile(db.options.DirPath, uint32(fid), ioType)
@@ -566,106 +763,13 @@ func (db *DB) loadDataFile() error {
 		}
 
 	}
-	return nil
-}
-
-//loadIndexFromDataFiles 从数据文件中读取数据构造索引
-func (db *DB) loadIndexFromDataFiles() error {
-	//没有文件，说明当前是一个空的数据库
-	if len(db.fileIds) == 0 {
-		return nil
-	}
-
-	//更新内存索引,
-	updateIndex := func(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
-		node, _ := db.hashRing.Get(string(key)) //获得对应实例
-
-		var oldPos *data.LogRecordPos
-		if typ == data.LogRecordDeleted {
-			oldPos, _ = db.index[node].Delete(key)
-			db.reclaimSize += uint64(pos.Size)
-
-		} else {
-			oldPos = db.index[node].Put(key, pos)
-		}
-		//如果构建索引的时候，这个key之前已经被存在了，那么这个key之前的数据就是无效的，可以进行清理
-		if oldPos != nil {
-			db.reclaimSize += uint64(oldPos.Size)
-		}
-	}
-
-	//暂存事务的数据,一个事务里面是有多个数据的
-	transactionRecord := make(map[uint64][]*data.TransactionRecord)
-	var curSeqNo = nonTransactionSeq
-	//遍历所有的文件ID，处理文件中的记录
-	for i, fid := range db.fileIds {
-		var fileId = uint32(fid)
-		//如果比最近未参与merge的文件id小，说明已经从hint文件中加载了索引
-		if db.mergeInfo.hashMerged && fileId < db.mergeInfo.nonMergeFildId {
-			continue
-		}
-		//merge完的数据都被消除了事务的标志，merge之后写入的数据仍然保持有事务的id
-		var dataFile *data.DataFile
-		if fileId == db.activeFile.FileId {
-			//当前文件是活跃文件，就从活跃文件中获得
-			dataFile = db.activeFile
-		} else {
-			//当前文件是旧文件，就从旧文件中根据ID号码获得
-			dataFile = db.olderFile[fileId]
-		}
-		var offset uint64 = 0
-		//读取当前文件的数据，根据读取的数据来构造索引
-		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset) //根据offset读取一条log记录
-			if err != nil {
-				//文件读取完了
-				if err == io.EOF {
-					break
-				} else {
-					return err
-				}
-			}
-			//构造内存索引并保存
-			logRecordPos := &data.LogRecordPos{Fid: fileId, Offset: offset, Size: uint32(size)}
-
-			//解析key，拿到事务的ID
-			key, seqNo := parseLogRecordKey(logRecord.Key)
-			if seqNo == nonTransactionSeq {
-				//非事务提交,直接更新索引
-				updateIndex(key, logRecord.Type, logRecordPos)
-			} else {
-				//是事务提交
-				if logRecord.Type == data.LogRecordTxnFinished {
-					//事务完成，将对应的seq no的数据一次性进行更新,如果没有这个标志的话，内存索引就不会更新，实现了原子性质
-					for _, txnRecord := range transactionRecord[seqNo] {
-						updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
-					}
-					delete(transactionRecord, seqNo)
-				} else {
-					//还没有达到事务的结束,先将读取到的数据暂存起来
-					logRecord.Key = key //在内存中我们使用的是没有编码的key
-					transactionRecord[seqNo] = append(transactionRecord[seqNo], &data.TransactionRecord{
-						Pos:    logRecordPos,
-						Record: logRecord,
-					})
-
-				}
-
-			}
-			//更新当前的事务序列号
-			if seqNo > curSeqNo {
-				curSeqNo = seqNo
-			}
-
-			//递增offset，下一次从新的位置开始读取
-			offset += size
-		}
-		//如果当前为活跃文件(读到最后一个文件没有写满，我们需要拿到他的偏移量，继续写，直到把他写满)。就需要更新这个文件的WriteOff
-		if i == len(db.fileIds)-1 {
-			db.activeFile.WriteOff = offset
+	//B+树不会扫描数据文件来构建索引，需要单独获得活跃文件的写入位置，忽略预分配的空间中没有写入数据的部分
+	if db.options.IndexType == BPT && db.activeFile != nil {
+		writeOff, err := db.activeFile.ScanWriteOff()
+		if err != nil {
+			return err
 		}
-		//更新事务序列号
-		db.seqNo = curSeqNo
+		db.activeFile.WriteOff = writeOff
 	}
 	return nil
 }
@@ -703,10 +807,20 @@ func (db *DB) setIoManger(managerType fio.IOManagerType) error {
 	return nil
 }
 
+//setActiveFileWritable 构建索引之后将活跃文件切换为配置的可写的IO类型
+func (db *DB) setActiveFileWritable() error {
+	if db.activeFile == nil {
+		return nil
+	}
+	return db.activeFile.SetWritableIOManager(db.options.DirPath, db.options.DataFileIOType, int64(db.options.FileSize))
+}
+
 func (db *DB) loadIndex() error {
-	//从hint文件中加载索引
-	if err := db.loadIndexFromHintFile(); err != nil {
-		return err
+	//从hint文件中加载索引，checkpoint中已经包含了hint文件中的索引
+	if db.checkpoint == nil {
+		if err := db.loadIndexFromHintFile(); err != nil {
+			return err
+		}
 	}
 
 	//从数据文件中加载索引
@@ -759,18 +873,6 @@ func (db *DB) saveSeqNo() error {
 	return nil
 }
 
-//初始化索引
-func (db *DB) initIndex() {
-	// 添加5个索引节点
-	for i := 0; i < db.options.indexNum; i++ {
-		node := "index" + strconv.Itoa(i)
-		db.hashRing.Add(node)
-
-		db.index[node] = index.NewIndex(db.options.IndexType, db.options.DirPath, node, db.options.SyncWrite) //初始化内存索引
-	}
-
-}
-
 //VersionPut 在版本索引的key版本链中添加一个版本
 func (db *DB) VersionPut(key []byte, rev mvcc.Revision) {
 	db.versionIndex.Put(key, rev)
@@ -781,7 +883,34 @@ func (db *DB) VersionGet(key []byte, rev int64) (*mvcc.Revision, error) {
 	return db.versionIndex.Get(key, rev)
 }
 
+//versionDeleted 判断索引中的key对应的版本之后是否已经被删除了，已经删除的版本在merge的时候回收
+func (db *DB) versionDeleted(indexKey []byte) bool {
+	key, rev := parseKeyWithRevision(indexKey)
+	if rev == nil {
+		return false
+	}
+	return db.versionIndex.Deleted(key, mvcc.DecodeRevision(rev))
+}
+
 //VersionDelete 在当前的版本链表中删除一个版本
 func (db *DB) VersionDelete(key []byte, revision mvcc.Revision) (*mvcc.Revision, error) {
 	return db.versionIndex.Tombstone(key, revision)
 }
+
+//revisionSize 索引中的key末尾编码的版本号的长度
+const revisionSize = 16
+
+//keyWithRevision 将用户的key和版本号编码成索引中的key，返回一个新的切片，不会修改用户的key
+func keyWithRevision(key []byte, rev mvcc.Revision) []byte {
+	encKey := make([]byte, 0, len(key)+revisionSize)
+	encKey = append(encKey, key...)
+	return append(encKey, rev.Encode()...)
+}
+
+//parseKeyWithRevision 将索引中的key解析成用户的key和编码之后的版本号
+func parseKeyWithRevision(key []byte) ([]byte, []byte) {
+	if len(key) < revisionSize {
+		return key, nil
+	}
+	return key[:len(key)-revisionSize], key[len(key)-revisionSize:]
+}
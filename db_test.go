@@ -1,9 +1,15 @@
 package FlexDB
 
 import (
+	"FlexDB/data"
+	"FlexDB/fio"
+	"FlexDB/index"
 	"FlexDB/utils"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 )
 
@@ -55,6 +61,209 @@ func TestOpen3(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+//测试跳表
+func TestOpen4(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.IndexType = Skiplist
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.NotNil(t, db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	val, err := db.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(10), val)
+	assert.Equal(t, 100, len(db.ListKeys(DefaultIteratorOptions)))
+}
+
+//可写的数据文件使用DirectFio，跨越多个数据文件写入之后重启仍然可以读取
+func TestOpen_DirectIO(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.FileSize = 64 * 1024
+	opts.DataFileIOType = fio.DirectFio
+	opts.EnableWal = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Put([]byte("a"), []byte("v1")))
+	val, err := db.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+
+	opts.DataFileIOType = fio.MMapFio
+	_, err = Open(opts)
+	assert.Equal(t, ErrDataFileIOTypeInvalid, err)
+}
+
+//活跃文件使用可读写的mmap，崩溃时没有裁剪的预分配空间在重启的时候被截断
+func TestOpen_MMapRW(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.FileSize = 64 * 1024
+	opts.DataFileIOType = fio.MMapRWFio
+	opts.EnableWal = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	activeFid := db.activeFile.FileId
+	activeSize := db.activeFile.WriteOff
+	stat, err := os.Stat(data.GetDataFileName(DirPath, activeFid))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(opts.FileSize), stat.Size())
+	//切换之后的旧文件被裁剪到实际的大小
+	stat, err = os.Stat(data.GetDataFileName(DirPath, activeFid-1))
+	assert.Nil(t, err)
+	assert.True(t, stat.Size() < int64(opts.FileSize))
+	assert.Nil(t, db.Close())
+
+	//模拟崩溃的时候没有裁剪的活跃文件
+	assert.Nil(t, os.Truncate(data.GetDataFileName(DirPath, activeFid), int64(opts.FileSize)))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, activeSize, db.activeFile.WriteOff)
+	assert.Nil(t, db.Put([]byte("a"), []byte("v1")))
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	val, err := db.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+}
+
+//活跃文件预分配到FileSize，崩溃时没有裁剪的预分配空间在重启的时候被忽略
+func TestOpen_Preallocate(t *testing.T) {
+	for _, indexType := range []IndexType{Btree, BPT} {
+		opts := DefaultOperations
+		opts.DirPath = DirPath
+		opts.FileSize = 64 * 1024
+		opts.IndexType = indexType
+		opts.EnableWal = true
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+		}
+		activeFid := db.activeFile.FileId
+		activeSize := db.activeFile.WriteOff
+		stat, err := os.Stat(data.GetDataFileName(DirPath, activeFid))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(opts.FileSize), stat.Size())
+		assert.Nil(t, db.Sync())
+		assert.Nil(t, db.Close())
+		stat, err = os.Stat(data.GetDataFileName(DirPath, activeFid))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(activeSize), stat.Size())
+
+		//模拟崩溃的时候没有裁剪的活跃文件
+		assert.Nil(t, os.Truncate(data.GetDataFileName(DirPath, activeFid), int64(opts.FileSize)))
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, activeSize, db.activeFile.WriteOff)
+		assert.Nil(t, db.Put([]byte("a"), []byte("v1")))
+		assert.Nil(t, db.Close())
+
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 1000; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		val, err := db.Get([]byte("a"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v1"), val)
+		destroyDB(db)
+	}
+}
+
+//崩溃的时候没有关闭数据库，活跃文件仍然是预分配的大小，重启之后文件末尾的0不会被当成数据
+func TestOpen_PreallocateCrash(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.FileSize = 1024 * 1024
+	opts.EnableWal = true
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	assert.Nil(t, db.Sync())
+	activeFid, activeSize := db.activeFile.FileId, db.activeFile.WriteOff
+
+	//模拟崩溃，不关闭数据文件，只释放目录的锁
+	db.scheduler.stop()
+	assert.Nil(t, db.closeWal())
+	assert.Nil(t, db.fileLock.Unlock())
+	stat, err := os.Stat(data.GetDataFileName(DirPath, activeFid))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(opts.FileSize), stat.Size())
+
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, activeSize, db.activeFile.WriteOff)
+	assert.Equal(t, 100, len(db.ListKeys(DefaultIteratorOptions)))
+	assert.Nil(t, db.Put([]byte("a"), []byte("v1")))
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 101, len(db.ListKeys(DefaultIteratorOptions)))
+	val, err := db.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+}
+
+//数据目录的大小只计算活跃文件中已经写入的部分，较小的数据库也可以达到merge的比例
+func TestDB_Stat_Preallocate(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.FileSize = 64 * 1024 * 1024
+	opts.DataFileMergeRatio = 0.5
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(1024)))
+	}
+	stat := db.Stat()
+	assert.True(t, stat.DiskSize >= db.activeFile.WriteOff)
+	assert.True(t, stat.DiskSize < db.activeFile.WriteOff+64*1024)
+
+	for i := 0; i < 80; i++ {
+		_, err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Merge(true))
+	for i := 80; i < 100; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
+
 //测试Btree
 func TestDB_Put1(t *testing.T) {
 	opts := DefaultOperations
@@ -616,6 +825,38 @@ func TestDB_Stat(t *testing.T) {
 	assert.NotNil(t, db.Stat())
 }
 
+//Stat中的内存统计和每个索引实例的统计一致，前缀压缩之后占用的内存更少
+func TestDB_StatIndexMemory(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	var memory [2]int64
+	for i, prefixLen := range []int{0, 8} {
+		opts.IndexKeyPrefixLen = prefixLen
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for i := 0; i < 2000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(16)))
+		}
+		stat := db.Stat()
+		assert.NotNil(t, stat)
+		assert.Equal(t, opts.IndexNum, len(stat.ShardMemory))
+		var total int64
+		for _, shard := range db.ShardStats() {
+			assert.Equal(t, shard.Memory, stat.ShardMemory[shard.Name])
+			total += shard.Memory
+		}
+		assert.Equal(t, total, stat.IndexMemory)
+		memory[i] = stat.IndexMemory
+		destroyDB(db)
+	}
+	assert.True(t, memory[0] > 0)
+	assert.True(t, memory[1] < memory[0])
+
+	opts.IndexKeyPrefixLen = -1
+	_, err := Open(opts)
+	assert.Equal(t, ErrKeyPrefixLenInvalid, err)
+}
+
 func TestDB_BackUp(t *testing.T) {
 	opts := DefaultOperations
 	opts.DirPath = DirPath
@@ -655,3 +896,127 @@ func TestDB_BackUp(t *testing.T) {
 //	//}
 //
 //}
+
+var errInjected = errors.New("injected index fault")
+
+//faultIndexer 包装一个索引实例，开启故障之后所有的读写都返回错误，模拟B+树索引在磁盘写满时的故障
+type faultIndexer struct {
+	index.Indexer
+	fail int32
+}
+
+func (f *faultIndexer) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
+	if atomic.LoadInt32(&f.fail) == 1 {
+		return nil, errInjected
+	}
+	return f.Indexer.Put(key, pos)
+}
+
+func (f *faultIndexer) Get(key []byte) (*data.LogRecordPos, error) {
+	if atomic.LoadInt32(&f.fail) == 1 {
+		return nil, errInjected
+	}
+	return f.Indexer.Get(key)
+}
+
+func (f *faultIndexer) Delete(key []byte) (*data.LogRecordPos, bool, error) {
+	if atomic.LoadInt32(&f.fail) == 1 {
+		return nil, false, errInjected
+	}
+	return f.Indexer.Delete(key)
+}
+
+func (f *faultIndexer) Iterator(reverse bool) (index.Iterator, error) {
+	return f.RangeIterator(reverse, nil, nil)
+}
+
+func (f *faultIndexer) RangeIterator(reverse bool, lowerBound, upperBound []byte) (index.Iterator, error) {
+	if atomic.LoadInt32(&f.fail) == 1 {
+		return nil, errInjected
+	}
+	return f.Indexer.RangeIterator(reverse, lowerBound, upperBound)
+}
+
+//injectIndexFault 使用faultIndexer替换所有的索引实例
+func injectIndexFault(db *DB) []*faultIndexer {
+	shards := db.indexShards()
+	faulty := &indexShards{router: shards.router, index: make(map[string]index.Indexer, len(shards.index))}
+	var indexers []*faultIndexer
+	for node, idx := range shards.index {
+		f := &faultIndexer{Indexer: idx}
+		faulty.index[node] = f
+		indexers = append(indexers, f)
+	}
+	db.shards.Store(faulty)
+	return indexers
+}
+
+//索引读写失败的时候，Put，Get，Delete和迭代器返回带有底层错误的IndexError
+func TestDB_IndexFault(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.TimeCheckpoint = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.RandomValue(16)))
+	assert.Nil(t, db.Put(utils.GetTestKey(3), utils.RandomValue(16)))
+
+	indexers := injectIndexFault(db)
+	setFault := func(fail int32) {
+		for _, f := range indexers {
+			atomic.StoreInt32(&f.fail, fail)
+		}
+	}
+	setFault(1)
+	err = db.Put(utils.GetTestKey(2), utils.RandomValue(16))
+	assert.True(t, errors.Is(err, ErrIndexUpdateFailed))
+	assert.True(t, errors.Is(err, errInjected))
+	var indexErr *IndexError
+	assert.True(t, errors.As(err, &indexErr))
+	assert.Equal(t, errInjected, indexErr.Err)
+
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.True(t, errors.Is(err, ErrIndexReadFailed))
+	_, err = db.Delete(utils.GetTestKey(3))
+	assert.True(t, errors.Is(err, ErrIndexReadFailed))
+
+	iter := db.NewIterator(DefaultIteratorOptions)
+	assert.False(t, iter.Valid())
+	assert.True(t, errors.Is(iter.Err(), ErrIndexReadFailed))
+	iter.Close()
+	assert.True(t, errors.Is(db.Fold(func(key []byte, value []byte) bool { return true }, DefaultIteratorOptions), ErrIndexReadFailed))
+
+	//故障恢复之后，失败的写入对读不可见，之前的数据仍然可以读到
+	setFault(0)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.NewIterator(DefaultIteratorOptions).Err())
+}
+
+//B+树索引的文件无法打开的时候Open返回错误，底层的bbolt失败的时候写入返回错误，而不是panic
+func TestDB_BPTIndexFault(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.IndexType = BPT
+	//索引文件的位置被目录占用了，bbolt无法打开
+	assert.Nil(t, os.MkdirAll(filepath.Join(DirPath, "index0"), os.ModePerm))
+	_, err := Open(opts)
+	assert.NotNil(t, err)
+	assert.Nil(t, os.RemoveAll(DirPath))
+
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.RandomValue(16)))
+	//关闭底层的bbolt，模拟磁盘故障
+	for _, idx := range db.indexShards().index {
+		assert.Nil(t, idx.Close())
+	}
+	err = db.Put(utils.GetTestKey(2), utils.RandomValue(16))
+	assert.True(t, errors.Is(err, ErrIndexUpdateFailed))
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.True(t, errors.Is(err, ErrIndexReadFailed))
+}
@@ -5,6 +5,7 @@ import "errors"
 var (
 	ErrKeyIsEmpty            = errors.New("the key is empty")
 	ErrIndexUpdateFailed     = errors.New("failed to update index")
+	ErrIndexReadFailed       = errors.New("failed to read index")
 	ErrKeyNotFound           = errors.New("the key is not found in database")
 	ErrDataFileNotFound      = errors.New("data file is not found in database")
 	ErrDirIsInValid          = errors.New("DirPath is invalid")
@@ -16,4 +17,55 @@ var (
 	ErrMergeRatio            = errors.New("invalid merge ratio,must between 0 and 1")
 	ErrMergeRatioUnReached   = errors.New("the merge ratio do not reach the ratio")
 	ErrNoEnoughSpaceForMerge = errors.New("not enough space for merge")
+	ErrTaskInvalid           = errors.New("background task must have a name and a run function")
+	ErrTaskExists            = errors.New("background task already exists")
+	ErrTaskNotFound          = errors.New("background task is not found")
+	ErrSchedulerClosed       = errors.New("background scheduler is closed")
+	ErrStatUnavailable       = errors.New("failed to get the stat of database")
+	ErrInvalidCursor         = errors.New("invalid scan cursor")
+	ErrIndexNumInvalid       = errors.New("IndexNum is invalid, must be greater than 0")
+	ErrReshardUnsupported    = errors.New("reshard is unsupported by the B+ tree index")
+	ErrShardTypeInvalid      = errors.New("invalid shard type")
+	ErrNotRangeShard         = errors.New("the index is not range sharded")
+	ErrInvalidSplitKey       = errors.New("the split key is already the start of a shard")
+	ErrNoAdjacentShard       = errors.New("no adjacent shard to merge with")
+	ErrDataFileIOTypeInvalid = errors.New("DataFileIOType is invalid, must be StanderFIO, DirectFio or MMapRWFio")
+	ErrKeyPrefixLenInvalid   = errors.New("IndexKeyPrefixLen is invalid, must not be negative")
+	ErrWalCorrupted          = errors.New("the index wal is corrupted")
 )
+
+//IndexError 索引读写失败的时候返回的错误，B+树索引在磁盘写满等情况下会失败
+//可以通过errors.Is判断是ErrIndexUpdateFailed还是ErrIndexReadFailed，通过errors.Unwrap获得底层的错误
+type IndexError struct {
+	Op  error //ErrIndexUpdateFailed或者ErrIndexReadFailed
+	Err error //索引返回的底层错误
+}
+
+func (e *IndexError) Error() string {
+	return e.Op.Error() + ": " + e.Err.Error()
+}
+
+func (e *IndexError) Unwrap() error {
+	return e.Err
+}
+
+//Is 和Op相同的时候也认为是同一个错误
+func (e *IndexError) Is(target error) bool {
+	return target == e.Op
+}
+
+//indexUpdateError 包装更新索引时候的错误
+func indexUpdateError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &IndexError{Op: ErrIndexUpdateFailed, Err: err}
+}
+
+//indexReadError 包装读取索引时候的错误
+func indexReadError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &IndexError{Op: ErrIndexReadFailed, Err: err}
+}
@@ -0,0 +1,99 @@
+package FlexDB
+
+import "time"
+
+/*
+	引擎生命周期的事件通知
+	用户可以在Options中设置EventListener，在文件切换，merge，刷盘，启动恢复以及关闭的时候得到通知，用来记录日志或者告警
+	回调可能在持有db锁的时候被调用，所以回调中不能再调用db的方法，并且应该尽快返回
+*/
+
+//FileRotatedEvent 活跃文件写满之后切换到新的活跃文件
+type FileRotatedEvent struct {
+	DirPath     string //数据目录
+	OldFileId   uint32 //被封存的活跃文件id
+	OldFileSize uint64 //被封存的活跃文件大小
+	NewFileId   uint32 //新的活跃文件id
+}
+
+//MergeStartEvent 开始merge
+type MergeStartEvent struct {
+	DirPath         string //数据目录
+	MergeFileNum    int    //参与merge的数据文件数量
+	ReclaimableSize uint64 //可以回收的数据量
+	DiskSize        uint64 //数据目录所占磁盘空间的大小
+}
+
+//MergeFinishEvent merge结束
+type MergeFinishEvent struct {
+	DirPath        string        //数据目录
+	NonMergeFileId uint32        //没有参与merge的最小文件id
+	Duration       time.Duration //merge的耗时
+	Err            error         //merge失败的原因，成功则为空
+}
+
+//SyncEvent 活跃文件刷盘
+type SyncEvent struct {
+	DirPath  string        //数据目录
+	FileId   uint32        //刷盘的文件id
+	Duration time.Duration //刷盘的耗时
+	Err      error         //刷盘失败的原因，成功则为空
+}
+
+//RecoveryEvent 启动的时候加载数据文件并恢复索引
+type RecoveryEvent struct {
+	DirPath     string        //数据目录
+	DataFileNum int           //加载的数据文件数量
+	Duration    time.Duration //恢复的耗时
+	Err         error         //恢复失败的原因，成功则为空
+}
+
+//CloseEvent 关闭数据库
+type CloseEvent struct {
+	DirPath string //数据目录
+	Err     error  //关闭失败的原因，成功则为空
+}
+
+//EventListener 引擎生命周期事件的监听者
+type EventListener interface {
+	OnFileRotated(event FileRotatedEvent)
+	OnMergeStart(event MergeStartEvent)
+	OnMergeFinish(event MergeFinishEvent)
+	OnSync(event SyncEvent)
+	OnRecovery(event RecoveryEvent)
+	OnClose(event CloseEvent)
+}
+
+//NopEventListener 不做任何处理的监听者，用户可以嵌入它只实现关心的事件
+type NopEventListener struct{}
+
+func (NopEventListener) OnFileRotated(FileRotatedEvent) {}
+func (NopEventListener) OnMergeStart(MergeStartEvent)   {}
+func (NopEventListener) OnMergeFinish(MergeFinishEvent) {}
+func (NopEventListener) OnSync(SyncEvent)               {}
+func (NopEventListener) OnRecovery(RecoveryEvent)       {}
+func (NopEventListener) OnClose(CloseEvent)             {}
+
+//listener 获得当前db的监听者，没有设置的时候返回一个空的监听者
+func (db *DB) listener() EventListener {
+	if db.options.EventListener == nil {
+		return NopEventListener{}
+	}
+	return db.options.EventListener
+}
+
+//syncActiveFile 持久化活跃文件，并通知刷盘的耗时
+func (db *DB) syncActiveFile() error {
+	start := time.Now()
+	err := db.activeFile.Sync()
+	if err != nil {
+		db.options.Logger.Error("fail to sync active file", "dir", db.options.DirPath, "fid", db.activeFile.FileId, "err", err)
+	}
+	db.listener().OnSync(SyncEvent{
+		DirPath:  db.options.DirPath,
+		FileId:   db.activeFile.FileId,
+		Duration: time.Since(start),
+		Err:      err,
+	})
+	return err
+}
@@ -0,0 +1,116 @@
+package FlexDB
+
+import (
+	"FlexDB/utils"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+//recordListener 记录收到的所有事件
+type recordListener struct {
+	NopEventListener
+	mu          sync.Mutex
+	rotated     []FileRotatedEvent
+	mergeStart  []MergeStartEvent
+	mergeFinish []MergeFinishEvent
+	syncs       []SyncEvent
+	recoveries  []RecoveryEvent
+	closes      []CloseEvent
+}
+
+func (l *recordListener) OnFileRotated(event FileRotatedEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rotated = append(l.rotated, event)
+}
+
+func (l *recordListener) OnMergeStart(event MergeStartEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mergeStart = append(l.mergeStart, event)
+}
+
+func (l *recordListener) OnMergeFinish(event MergeFinishEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mergeFinish = append(l.mergeFinish, event)
+}
+
+func (l *recordListener) OnSync(event SyncEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.syncs = append(l.syncs, event)
+}
+
+func (l *recordListener) OnRecovery(event RecoveryEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recoveries = append(l.recoveries, event)
+}
+
+func (l *recordListener) OnClose(event CloseEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closes = append(l.closes, event)
+}
+
+func TestDB_EventListener(t *testing.T) {
+	listener := &recordListener{}
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.FileSize = 256 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.TimeCheckMerge = 0
+	opts.EventListener = listener
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(listener.recoveries))
+	assert.Nil(t, listener.recoveries[0].Err)
+	assert.Equal(t, 0, listener.recoveries[0].DataFileNum)
+
+	for i := 0; i < 5000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	//活跃文件写满之后切换文件
+	listener.mu.Lock()
+	assert.True(t, len(listener.rotated) > 0)
+	for i, event := range listener.rotated {
+		assert.Equal(t, uint32(i), event.OldFileId)
+		assert.Equal(t, uint32(i+1), event.NewFileId)
+		assert.True(t, event.OldFileSize > 0)
+	}
+	rotated := len(listener.rotated)
+	listener.mu.Unlock()
+
+	assert.Nil(t, db.Sync())
+	listener.mu.Lock()
+	assert.True(t, len(listener.syncs) > 0)
+	lastSync := listener.syncs[len(listener.syncs)-1]
+	assert.Equal(t, db.activeFile.FileId, lastSync.FileId)
+	assert.Nil(t, lastSync.Err)
+	listener.mu.Unlock()
+
+	assert.Nil(t, db.Merge(false))
+	listener.mu.Lock()
+	assert.Equal(t, 1, len(listener.mergeStart))
+	assert.Equal(t, rotated+1, listener.mergeStart[0].MergeFileNum)
+	assert.Equal(t, 1, len(listener.mergeFinish))
+	assert.Nil(t, listener.mergeFinish[0].Err)
+	assert.Equal(t, uint32(rotated+1), listener.mergeFinish[0].NonMergeFileId)
+	listener.mu.Unlock()
+
+	assert.Nil(t, db.Close())
+	assert.Equal(t, 1, len(listener.closes))
+	assert.Nil(t, listener.closes[0].Err)
+
+	//重启的时候记录恢复的事件
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(listener.recoveries))
+	assert.Nil(t, listener.recoveries[1].Err)
+	assert.True(t, listener.recoveries[1].DataFileNum > 0)
+	assert.Nil(t, db.Close())
+}
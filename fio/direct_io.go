@@ -0,0 +1,200 @@
+package fio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+//directIOAlignment O_DIRECT要求读写的内存地址，文件偏移和长度都按照这个大小对齐
+const directIOAlignment = 4096
+
+//directReadBufferSize 读取时复用的对齐缓冲区的大小，更大的读取单独分配缓冲区
+const directReadBufferSize = 16 * directIOAlignment
+
+//directReadBufferPool 读取时使用的对齐的缓冲区，避免每次读取都重新分配
+var directReadBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := alignedBuffer(directReadBufferSize)
+		return &buf
+	},
+}
+
+//DirectIO 使用O_DIRECT绕过内核的页缓存，通过pread/pwrite按照偏移读写文件，不依赖文件的读写位置
+//文件系统不支持O_DIRECT的时候退化为普通的pread/pwrite
+type DirectIO struct {
+	fd       *os.File
+	direct   bool  //是否成功使用O_DIRECT打开
+	capacity int64 //预分配的文件大小，为0表示不预分配
+	mu       sync.RWMutex
+	size     int64  //已经写入的数据的大小，下一次写入的位置，文件中这之后是最后一个块填充的0
+	tail     []byte //最后一个没有写满的对齐块中的数据，下一次写入的时候和新的数据一起重新写入这个块
+	buf      []byte //写入时使用的对齐的缓冲区
+}
+
+//NewDirectIOManager 初始化Direct IO对象，文件不存在的时候会创建
+func NewDirectIOManager(fileName string) (*DirectIO, error) {
+	return NewPreallocatedDirectIOManager(fileName, 0)
+}
+
+//NewPreallocatedDirectIOManager 初始化预分配capacity大小的Direct IO对象，文件中已有的数据都认为是有效的数据
+func NewPreallocatedDirectIOManager(fileName string, capacity int64) (*DirectIO, error) {
+	direct := directFlag != 0
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|directFlag, DataFilePerm)
+	if err != nil && direct && errors.Is(err, syscall.EINVAL) {
+		//tmpfs等文件系统不支持O_DIRECT
+		direct = false
+		fd, err = os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, DataFilePerm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	if stat.Size() < capacity {
+		if err := preallocate(fd, capacity); err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+	}
+	dio := &DirectIO{fd: fd, direct: direct, capacity: capacity, size: stat.Size()}
+	if direct {
+		//读取最后一个没有写满的块，追加写入的时候需要重新写入完整的块
+		tailLen := int(dio.size % directIOAlignment)
+		dio.tail = alignedBuffer(directIOAlignment)[:0]
+		if tailLen > 0 {
+			block := alignedBuffer(directIOAlignment)
+			n, err := fd.ReadAt(block, dio.size-int64(tailLen))
+			if err != nil && err != io.EOF {
+				_ = fd.Close()
+				return nil, err
+			}
+			if n < tailLen {
+				_ = fd.Close()
+				return nil, io.ErrUnexpectedEOF
+			}
+			dio.tail = append(dio.tail, block[:tailLen]...)
+		}
+	}
+	return dio, nil
+}
+
+//Read 从文件的给定位置读取对应的数据，使用O_DIRECT的时候读取覆盖这段数据的对齐的块再拷贝出来
+//最后一个块中填充的0不是写入的数据，只能读取到已经写入的数据为止
+func (dio *DirectIO) Read(b []byte, offset int64) (int, error) {
+	if !dio.direct {
+		return dio.fd.ReadAt(b, offset)
+	}
+	size, _ := dio.Size()
+	if offset >= size {
+		return 0, io.EOF
+	}
+	dst := b
+	if offset+int64(len(dst)) > size {
+		dst = dst[:size-offset]
+	}
+	start := offset &^ (directIOAlignment - 1)
+	end := alignUp(offset + int64(len(dst)))
+	var block []byte
+	if end-start <= directReadBufferSize {
+		bufp := directReadBufferPool.Get().(*[]byte)
+		defer directReadBufferPool.Put(bufp)
+		block = (*bufp)[:end-start]
+	} else {
+		block = alignedBuffer(int(end - start))
+	}
+	n, err := dio.fd.ReadAt(block, start)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if int64(n) <= offset-start {
+		return 0, io.EOF
+	}
+	copied := copy(dst, block[offset-start:n])
+	if copied < len(b) {
+		return copied, io.EOF
+	}
+	return copied, nil
+}
+
+//Write 将字节组追加写入到文件的末尾
+//使用O_DIRECT的时候将最后一个没有写满的块和新的数据一起按照对齐的块写入，块中剩余的部分填充0，关闭的时候再截断到实际的大小
+//注意最后一个块是原地重写的，设备不保证对齐块写入的原子性的时候，断电造成的部分写入可能破坏这个块中之前已经持久化的数据
+//启动的时候数据文件的crc校验会发现损坏的记录，这个块中损坏的位置之后的数据都会被丢弃
+func (dio *DirectIO) Write(b []byte) (int, error) {
+	dio.mu.Lock()
+	defer dio.mu.Unlock()
+	if !dio.direct {
+		n, err := dio.fd.WriteAt(b, dio.size)
+		dio.size += int64(n)
+		return n, err
+	}
+	start := dio.size - int64(len(dio.tail))
+	total := len(dio.tail) + len(b)
+	alignedLen := int(alignUp(int64(total)))
+	if cap(dio.buf) < alignedLen {
+		dio.buf = alignedBuffer(alignedLen)
+	}
+	buf := dio.buf[:alignedLen]
+	copy(buf, dio.tail)
+	copy(buf[len(dio.tail):], b)
+	for i := total; i < alignedLen; i++ {
+		buf[i] = 0
+	}
+	if _, err := dio.fd.WriteAt(buf, start); err != nil {
+		return 0, err
+	}
+	dio.size += int64(len(b))
+	dio.tail = append(dio.tail[:0], buf[total-total%directIOAlignment:total]...)
+	return len(b), nil
+}
+
+//Direct 是否成功使用O_DIRECT打开了文件，不支持O_DIRECT的文件系统上退化为普通的pread/pwrite
+func (dio *DirectIO) Direct() bool {
+	return dio.direct
+}
+
+//Sync 将数据持久化到磁盘中，O_DIRECT不经过页缓存，但是文件的大小等元数据仍然需要通过fdatasync持久化
+func (dio *DirectIO) Sync() error {
+	return fdatasync(dio.fd)
+}
+
+//Close 关闭文件，预分配的文件和最后一个块中填充的0会被裁剪掉，只保留实际写入的数据
+func (dio *DirectIO) Close() error {
+	if dio.capacity > 0 || dio.direct {
+		dio.mu.Lock()
+		defer dio.mu.Unlock()
+		if err := dio.fd.Truncate(dio.size); err != nil {
+			return err
+		}
+	}
+	return dio.fd.Close()
+}
+
+//Size 获得已经写入的数据的大小
+func (dio *DirectIO) Size() (int64, error) {
+	dio.mu.RLock()
+	defer dio.mu.RUnlock()
+	return dio.size, nil
+}
+
+//alignUp 将n向上对齐到directIOAlignment
+func alignUp(n int64) int64 {
+	return (n + directIOAlignment - 1) &^ (directIOAlignment - 1)
+}
+
+//alignedBuffer 分配起始地址按照directIOAlignment对齐的缓冲区
+func alignedBuffer(n int) []byte {
+	buf := make([]byte, n+directIOAlignment)
+	offset := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlignment - 1))
+	if offset != 0 {
+		offset = directIOAlignment - offset
+	}
+	return buf[offset : offset+n : offset+n]
+}
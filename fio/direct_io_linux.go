@@ -0,0 +1,6 @@
+package fio
+
+import "syscall"
+
+//directFlag 打开文件时绕过页缓存的标志位
+const directFlag = syscall.O_DIRECT
@@ -0,0 +1,6 @@
+//go:build !linux
+
+package fio
+
+//directFlag 其他平台不支持O_DIRECT，DirectIO退化为普通的pread/pwrite
+const directFlag = 0
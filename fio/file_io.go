@@ -2,11 +2,16 @@ package fio
 
 import (
 	"os"
+	"sync/atomic"
 )
 
 //标准系统文件IO
 type FileIO struct {
-	fd *os.File
+	size int64 //预分配的时候已经写入的数据的大小，放在第一个字段保证原子操作的时候8字节对齐
+	fd   *os.File
+	//预分配的文件大小，为0表示不预分配，通过O_APPEND追加写入
+	//预分配之后文件的实际大小大于写入的数据，需要单独记录逻辑上的文件末尾，通过pwrite写入
+	capacity int64
 }
 
 //初始化标准文件IO对象
@@ -28,6 +33,27 @@ func NewFileIOManager(fileName string) (*FileIO, error) {
 	return &FileIO{fd: fd}, nil
 }
 
+//NewPreallocatedFileIOManager 初始化预分配capacity大小的标准文件IO对象，追加写入的时候不需要修改文件的大小
+//文件中已有的数据都认为是有效的数据，之后的写入从文件末尾开始
+func NewPreallocatedFileIOManager(fileName string, capacity int64) (*FileIO, error) {
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	if stat.Size() < capacity {
+		if err := preallocate(fd, capacity); err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+	}
+	return &FileIO{fd: fd, capacity: capacity, size: stat.Size()}, nil
+}
+
 //Read 从文件的给定位置读取对应的数据,
 func (fio *FileIO) Read(b []byte, offset int64) (int, error) {
 	return fio.fd.ReadAt(b, offset)
@@ -36,20 +62,33 @@ func (fio *FileIO) Read(b []byte, offset int64) (int, error) {
 
 //Write 将字节组写入到文件中
 func (fio *FileIO) Write(b []byte) (int, error) {
-	return fio.fd.Write(b)
+	if fio.capacity == 0 {
+		return fio.fd.Write(b)
+	}
+	n, err := fio.fd.WriteAt(b, atomic.LoadInt64(&fio.size))
+	atomic.AddInt64(&fio.size, int64(n))
+	return n, err
 }
 
-//Sync 将临时存在内存的数据持久化到磁盘中
+//Sync 将临时存在内存的数据持久化到磁盘中，使用fdatasync，预分配之后追加写入不需要持久化文件的大小
 func (fio *FileIO) Sync() error {
-	return fio.fd.Sync()
+	return fdatasync(fio.fd)
 }
 
-//Close关闭文件
+//Close关闭文件，预分配的文件会被裁剪到实际写入的大小
 func (fio *FileIO) Close() error {
+	if fio.capacity > 0 {
+		if err := fio.fd.Truncate(atomic.LoadInt64(&fio.size)); err != nil {
+			return err
+		}
+	}
 	return fio.fd.Close()
 }
 
 func (fio *FileIO) Size() (int64, error) {
+	if fio.capacity > 0 {
+		return atomic.LoadInt64(&fio.size), nil
+	}
 	stat, err := fio.fd.Stat()
 	if err != nil {
 		return 0, err
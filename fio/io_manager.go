@@ -8,6 +8,10 @@ type IOManagerType = byte
 const (
 	StanderFIO IOManagerType = iota
 	MMapFio
+	//DirectFio 使用O_DIRECT和pread/pwrite读写，绕过页缓存
+	DirectFio
+	//MMapRWFio 可读写的mmap，预分配文件之后通过内存拷贝写入，读取最近写入的数据不需要系统调用
+	MMapRWFio
 )
 
 type IOManager interface {
@@ -27,11 +31,23 @@ type IOManager interface {
 
 // NewIOManager 初始化IOManger,目前只有一个FileIO
 func NewIOManager(filename string, typ IOManagerType) (IOManager, error) {
+	return NewIOManagerWithCapacity(filename, typ, 0)
+}
+
+//NewIOManagerWithCapacity 初始化IOManager，capacity是可写的IO类型预分配的文件大小，为0表示不预分配，只读的MMapFio会忽略
+func NewIOManagerWithCapacity(filename string, typ IOManagerType, capacity int64) (IOManager, error) {
 	switch typ {
 	case StanderFIO:
+		if capacity > 0 {
+			return NewPreallocatedFileIOManager(filename, capacity)
+		}
 		return NewFileIOManager(filename)
 	case MMapFio:
 		return NewMMapIOManager(filename)
+	case DirectFio:
+		return NewPreallocatedDirectIOManager(filename, capacity)
+	case MMapRWFio:
+		return NewMMapRWIOManager(filename, capacity)
 	default:
 		panic("unsupport iomanager type")
 	}
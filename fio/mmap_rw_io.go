@@ -0,0 +1,136 @@
+//go:build !windows
+
+package fio
+
+import (
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"sync"
+)
+
+//MMapRW 可读写的内存文件映射，文件预分配到固定的大小之后整体映射到内存中
+//写入直接拷贝到映射的内存中，读取最近写入的数据不需要系统调用，通过msync持久化，关闭的时候裁剪掉没有写入数据的部分
+type MMapRW struct {
+	fd   *os.File
+	mu   sync.RWMutex
+	data []byte //映射的内存，长度是预分配之后文件的大小
+	size int64  //已经写入的数据的大小，下一次写入的位置
+}
+
+//NewMMapRWIOManager 初始化可读写的mmap对象，文件会被预分配到capacity大小
+//文件中已有的数据都认为是有效的数据，之后的写入从文件末尾开始
+func NewMMapRWIOManager(fileName string, capacity int64) (IOManager, error) {
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	m := &MMapRW{fd: fd, size: stat.Size()}
+	if capacity < m.size {
+		capacity = m.size
+	}
+	if err := m.remap(capacity); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+//remap 将文件扩展到mapSize大小并重新映射，需要持有写锁
+func (m *MMapRW) remap(mapSize int64) error {
+	if m.data != nil {
+		if err := unix.Munmap(m.data); err != nil {
+			return err
+		}
+		m.data = nil
+	}
+	if mapSize == 0 {
+		return nil
+	}
+	stat, err := m.fd.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() < mapSize {
+		if err := preallocate(m.fd, mapSize); err != nil {
+			return err
+		}
+	}
+	data, err := unix.Mmap(int(m.fd.Fd()), 0, int(mapSize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	m.data = data
+	return nil
+}
+
+//Read 从映射的内存中读取对应的数据，不会读取到没有写入数据的部分
+func (m *MMapRW) Read(b []byte, offset int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if offset >= m.size {
+		return 0, io.EOF
+	}
+	n := copy(b, m.data[offset:m.size])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+//Write 将字节组拷贝到映射的内存中，超过预分配的大小的时候扩展文件并重新映射
+func (m *MMapRW) Write(b []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	end := m.size + int64(len(b))
+	if end > int64(len(m.data)) {
+		mapSize := int64(len(m.data)) * 2
+		if mapSize < end {
+			mapSize = end
+		}
+		if err := m.remap(mapSize); err != nil {
+			return 0, err
+		}
+	}
+	copy(m.data[m.size:end], b)
+	m.size = end
+	return len(b), nil
+}
+
+//Sync 通过msync将映射的内存中修改的数据持久化到磁盘中
+func (m *MMapRW) Sync() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.size == 0 {
+		return nil
+	}
+	return unix.Msync(m.data[:m.size], unix.MS_SYNC)
+}
+
+//Close 解除映射，并把文件裁剪到实际写入的大小
+func (m *MMapRW) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data != nil {
+		if err := unix.Munmap(m.data); err != nil {
+			return err
+		}
+		m.data = nil
+	}
+	if err := m.fd.Truncate(m.size); err != nil {
+		return err
+	}
+	return m.fd.Close()
+}
+
+//Size 获得已经写入的数据的大小
+func (m *MMapRW) Size() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.size, nil
+}
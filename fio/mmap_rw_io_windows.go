@@ -0,0 +1,8 @@
+package fio
+
+import "errors"
+
+//NewMMapRWIOManager windows上不支持可读写的mmap
+func NewMMapRWIOManager(fileName string, capacity int64) (IOManager, error) {
+	return nil, errors.New("writable mmap is not supported on windows")
+}
@@ -0,0 +1,20 @@
+package fio
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+//preallocate 通过fallocate为文件预分配size大小的空间，文件系统不支持的时候退化为ftruncate
+func preallocate(fd *os.File, size int64) error {
+	err := unix.Fallocate(int(fd.Fd()), 0, 0, size)
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		return fd.Truncate(size)
+	}
+	return err
+}
+
+//fdatasync 只持久化数据和读取数据需要的元数据，不持久化修改时间等元数据
+func fdatasync(fd *os.File) error {
+	return unix.Fdatasync(int(fd.Fd()))
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package fio
+
+import "os"
+
+//preallocate 其他平台通过ftruncate扩展文件的大小
+func preallocate(fd *os.File, size int64) error {
+	return fd.Truncate(size)
+}
+
+//fdatasync 其他平台退化为fsync
+func fdatasync(fd *os.File) error {
+	return fd.Sync()
+}
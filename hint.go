@@ -0,0 +1,130 @@
+package FlexDB
+
+import (
+	"FlexDB/data"
+	"io"
+	"os"
+	"strconv"
+)
+
+/*
+	每个活跃文件在封存（写满之后转化成旧文件）的时候，都会生成一个对应的hint文件(xxx.dhint)
+	hint文件中按照写入顺序记录了数据文件中每条记录的key(带有事务序列号和版本号),记录类型和位置信息,但是不包含value
+	启动的时候只需要读取hint文件就可以构建内存索引，而不需要扫描整个数据文件
+	hint文件的最后一条记录是LogRecordHintFinished类型，value中记录了对应数据文件的大小，用来检查hint文件是否完整
+*/
+
+//appendDataHint 将写入活跃文件的记录添加到活跃文件的hint缓冲中
+func (db *DB) appendDataHint(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
+	//B+树的索引本身就是持久化的，不需要hint文件
+	if db.options.IndexType == BPT || !db.activeHintValid {
+		return
+	}
+	db.activeHint = append(db.activeHint, data.EncodeDataHintRecord(key, typ, pos)...)
+}
+
+//resetDataHint 活跃文件发生变化的时候，清空hint缓冲
+//valid 表示后续写入的hint缓冲能否完整的描述当前的活跃文件
+func (db *DB) resetDataHint(valid bool) {
+	db.activeHint = nil
+	db.activeHintValid = valid
+}
+
+//writeDataHintFile 活跃文件封存的时候，将hint缓冲写入到对应的hint文件中
+func (db *DB) writeDataHintFile() error {
+	if db.activeFile == nil || !db.activeHintValid || db.options.IndexType == BPT {
+		return nil
+	}
+	fileName := data.GetDataHintFileName(db.options.DirPath, db.activeFile.FileId)
+	//之前可能残留有不完整的hint文件，需要先删除掉，避免追加写
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	hintFile, err := data.OpenDataHintFile(db.options.DirPath, db.activeFile.FileId)
+	if err != nil {
+		return err
+	}
+	//写入一条hint完成的记录，里面记录数据文件的大小
+	finRecord := &data.LogRecord{
+		Key:   []byte(strconv.FormatUint(uint64(db.activeFile.FileId), 10)),
+		Value: []byte(strconv.FormatUint(db.activeFile.WriteOff, 10)),
+		Type:  data.LogRecordHintFinished,
+	}
+	encFin, _ := data.EncodeLogRecord(finRecord)
+	if err := hintFile.Write(append(db.activeHint, encFin...)); err != nil {
+		_ = hintFile.Close()
+		return err
+	}
+	if err := hintFile.Sync(); err != nil {
+		_ = hintFile.Close()
+		return err
+	}
+	return hintFile.Close()
+}
+
+//readDataHintFile 读取数据文件对应的hint文件，只有当hint文件完整并且和数据文件匹配的时候才返回true
+//返回的记录中key是带有事务序列号的key，和数据文件中的记录一致
+func (db *DB) readDataHintFile(dataFile *data.DataFile) ([]*data.TransactionRecord, bool) {
+	fileName := data.GetDataHintFileName(db.options.DirPath, dataFile.FileId)
+	if _, err := os.Stat(fileName); err != nil {
+		return nil, false
+	}
+	dataSize, err := dataFile.IoManager.Size()
+	if err != nil {
+		return nil, false
+	}
+	hintFile, err := data.OpenDataHintFile(db.options.DirPath, dataFile.FileId)
+	if err != nil {
+		return nil, false
+	}
+	defer hintFile.Close()
+
+	var (
+		records  []*data.TransactionRecord
+		offset   uint64
+		finished bool
+	)
+	for {
+		logRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			//crc校验失败等情况，说明hint文件已经损坏
+			return nil, false
+		}
+		if finished {
+			//完成标志之后不应该还有数据
+			return nil, false
+		}
+		if logRecord.Type == data.LogRecordHintFinished {
+			//检查hint文件对应的数据文件大小是否和当前的数据文件一致
+			fileSize, err := strconv.ParseInt(string(logRecord.Value), 10, 64)
+			if err != nil || fileSize != dataSize {
+				return nil, false
+			}
+			finished = true
+		} else {
+			pos := data.DecodeLogRecordPos(logRecord.Value)
+			records = append(records, &data.TransactionRecord{
+				Record: &data.LogRecord{Key: logRecord.Key, Type: logRecord.Type},
+				Pos:    pos,
+			})
+		}
+		offset += size
+	}
+	if !finished {
+		//没有完成标志，说明hint文件没有写完
+		return nil, false
+	}
+	return records, true
+}
+
+//removeDataHintFile 删除数据文件对应的hint文件
+func removeDataHintFile(dirPath string, fileId uint32) error {
+	fileName := data.GetDataHintFileName(dirPath, fileId)
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
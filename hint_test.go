@@ -0,0 +1,102 @@
+package FlexDB
+
+import (
+	"FlexDB/data"
+	"FlexDB/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+//indexSize 获得所有索引中的key的数量
+func indexSize(db *DB) int {
+	var size int
+	for _, idx := range db.indexShards().index {
+		size += idx.Size()
+	}
+	return size
+}
+
+//活跃文件封存的时候生成hint文件，并且重启的时候可以从hint文件中加载索引
+func TestDB_DataHintFile(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.FileSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	for i := 0; i < 20000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 5000; i++ {
+		_, err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(db.olderFile) > 0)
+	//每一个封存的数据文件都需要有对应的hint文件
+	for fid := range db.olderFile {
+		_, err := os.Stat(data.GetDataHintFileName(opts.DirPath, fid))
+		assert.Nil(t, err)
+	}
+	//活跃文件还没有封存，不存在hint文件
+	_, err = os.Stat(data.GetDataHintFileName(opts.DirPath, db.activeFile.FileId))
+	assert.True(t, os.IsNotExist(err))
+	keyNum := indexSize(db)
+	reclaimSize := db.reclaimSize
+	assert.Nil(t, db.Close())
+
+	//重启之后从hint文件中加载索引
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, keyNum, indexSize(db))
+	assert.Equal(t, reclaimSize, db.reclaimSize)
+	for _, dataFile := range db.olderFile {
+		_, ok := db.readDataHintFile(dataFile)
+		assert.True(t, ok)
+	}
+	assert.Nil(t, db.Close())
+}
+
+//hint文件缺失或者损坏的时候，需要退化成扫描数据文件
+func TestDB_DataHintFileCorrupted(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.FileSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 20000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(db.olderFile) > 1)
+	keyNum := indexSize(db)
+	assert.Nil(t, db.Close())
+
+	//删除第一个数据文件的hint文件
+	assert.Nil(t, os.Remove(data.GetDataHintFileName(opts.DirPath, 0)))
+	//破坏第二个数据文件的hint文件中的数据
+	hintName := data.GetDataHintFileName(opts.DirPath, 1)
+	buf, err := os.ReadFile(hintName)
+	assert.Nil(t, err)
+	buf[len(buf)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(hintName, buf, 0644))
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, keyNum, indexSize(db))
+
+	//新的写入导致文件封存后，重新生成hint文件
+	for i := 20000; i < 30000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	keyNum = indexSize(db)
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, keyNum, indexSize(db))
+	assert.Nil(t, db.Close())
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"FlexDB"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 )
 
 var db *FlexDB.DB //DB实例
@@ -72,7 +74,7 @@ func handleDelete(writer http.ResponseWriter, request *http.Request) {
 
 	key := request.URL.Query().Get("key")
 
-	err := db.Delete([]byte(key))
+	_, err := db.Delete([]byte(key))
 	if err != nil && err != FlexDB.ErrKeyIsEmpty {
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
 		log.Printf("failed to get kv in db: %v\n", err)
@@ -89,11 +91,42 @@ func handleListKeys(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	keys := db.ListKeys()
+	//分页获取key，cursor是上一页返回的游标，第一页不需要传
+	limit := 1000
+	if l := request.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			http.Error(writer, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	var cursor []byte
+	if c := request.URL.Query().Get("cursor"); c != "" {
+		var err error
+		if cursor, err = base64.URLEncoding.DecodeString(c); err != nil {
+			http.Error(writer, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	options := FlexDB.DefaultIteratorOptions
+	options.KeysOnly = true
+	kvs, next, err := db.ScanPage(cursor, limit, options)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		log.Printf("failed to list keys in db: %v\n", err)
+		return
+	}
 	writer.Header().Set("Content-Type", "application/json")
-	var result []string
-	for _, k := range keys {
-		result = append(result, string(k))
+	result := struct {
+		Keys   []string `json:"keys"`
+		Cursor string   `json:"cursor,omitempty"` //为空表示已经是最后一页了
+	}{Keys: make([]string, 0, len(kvs))}
+	for _, kv := range kvs {
+		result.Keys = append(result.Keys, string(kv.Key))
+	}
+	if next != nil {
+		result.Cursor = base64.URLEncoding.EncodeToString(next)
 	}
 	_ = json.NewEncoder(writer).Encode(result)
 }
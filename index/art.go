@@ -8,11 +8,15 @@ import (
 	"sync"
 )
 
+//artEntryOverhead 每个key在ART中占用的内存的估算值，包括叶子节点，装箱之后的位置信息，以及内部节点中平均的指针开销
+const artEntryOverhead = 16 + 40 + data.PackedPosSize + 16
+
 // AdaptiveRadixTree 自适应基数树索引
 //主要封装https://github.com/plar/go-adaptive-radix-tree
 type AdaptiveRadixTree struct {
-	tree goart.Tree
-	lock *sync.RWMutex //使用读写锁保证并发安全，读取资源的时候可以多个线程并发访问，写的时候只有一个线程允许
+	tree   goart.Tree
+	lock   *sync.RWMutex //使用读写锁保证并发安全，读取资源的时候可以多个线程并发访问，写的时候只有一个线程允许
+	memory int64         //索引占用内存的估算值
 }
 
 // NewART 初始化自适应基数树索引
@@ -23,37 +27,44 @@ func NewART() *AdaptiveRadixTree {
 	}
 }
 
-func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
 	art.lock.Lock()
-	oldItem, _ := art.tree.Insert(key, pos) //这里的value是type Value interface{}，可以存储任何类型
+	oldItem, updated := art.tree.Insert(key, data.PackLogRecordPos(pos)) //这里的value是type Value interface{}，可以存储任何类型，保存紧凑编码的位置信息
+	if !updated {
+		//ART中的叶子节点会拷贝一份key
+		art.memory += artEntryOverhead + int64(len(key))
+	}
 	art.lock.Unlock()
 	if oldItem == nil {
-		return nil
+		return nil, nil
 	}
 
-	return oldItem.(*data.LogRecordPos)
+	return oldItem.(data.PackedPos).Unpack(), nil
 }
 
-func (art *AdaptiveRadixTree) Get(key []byte) *data.LogRecordPos {
+func (art *AdaptiveRadixTree) Get(key []byte) (*data.LogRecordPos, error) {
 	art.lock.RLock()
 	defer art.lock.RUnlock()
 	value, found := art.tree.Search(key)
 	if !found {
-		return nil
+		return nil, nil
 	}
-	return value.(*data.LogRecordPos) //我们需要强转为我们需要的类型
+	return value.(data.PackedPos).Unpack(), nil //我们需要强转为我们需要的类型
 }
 
-func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool) {
+func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool, error) {
 	art.lock.Lock()
 	//key存在并且删除成功，deleted=true
 	//key不存在则删除失败，deleted=false
 	value, deleted := art.tree.Delete(key)
+	if deleted {
+		art.memory -= artEntryOverhead + int64(len(key))
+	}
 	art.lock.Unlock()
 	if value == nil {
-		return nil, false
+		return nil, false, nil
 	}
-	return value.(*data.LogRecordPos), deleted
+	return value.(data.PackedPos).Unpack(), deleted, nil
 }
 
 func (art *AdaptiveRadixTree) Size() int {
@@ -63,13 +74,24 @@ func (art *AdaptiveRadixTree) Size() int {
 	return size
 }
 
-func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
+//MemoryUsage 索引占用内存的估算值
+func (art *AdaptiveRadixTree) MemoryUsage() int64 {
+	art.lock.RLock()
+	defer art.lock.RUnlock()
+	return art.memory
+}
+
+func (art *AdaptiveRadixTree) Iterator(reverse bool) (Iterator, error) {
+	return art.RangeIterator(reverse, nil, nil)
+}
+
+func (art *AdaptiveRadixTree) RangeIterator(reverse bool, lowerBound, upperBound []byte) (Iterator, error) {
 	if art.tree == nil {
-		return nil
+		return nil, nil
 	}
 	art.lock.RLock()
 	defer art.lock.RUnlock()
-	return newARTIterator(art.tree, reverse)
+	return newARTIterator(art.tree, reverse, lowerBound, upperBound), nil
 }
 
 // Close art不需要进行释放资源
@@ -84,27 +106,39 @@ type artIterator struct {
 	value     []*Item //存储全部的key位置索引信息
 }
 
-func newARTIterator(tree goart.Tree, reverse bool) *artIterator {
-	var idx int
-	//如果逆向的话，idx就从最后一个开始遍历
-	if reverse {
-		idx = tree.Size() - 1
+func newARTIterator(tree goart.Tree, reverse bool, lowerBound, upperBound []byte) *artIterator {
+	var values []*Item
+	if lowerBound == nil && upperBound == nil {
+		values = make([]*Item, 0, tree.Size())
 	}
-	values := make([]*Item, tree.Size())
 	saveValues := func(node goart.Node) bool {
-		item := &Item{
-			key: node.Key(),
-			pos: node.Value().(*data.LogRecordPos),
+		key := node.Key()
+		if lowerBound != nil && bytes.Compare(key, lowerBound) < 0 {
+			//还没有到达下边界，继续遍历
+			return true
 		}
-		values[idx] = item
-		if reverse {
-			idx--
-		} else {
-			idx++
+		if upperBound != nil && bytes.Compare(key, upperBound) >= 0 {
+			//ForEach是按照从小到大的顺序遍历的，超过上边界之后就可以停止了
+			return false
 		}
+		values = append(values, &Item{
+			key: key,
+			pos: node.Value().(data.PackedPos),
+		})
 		return true
 	}
-	tree.ForEach(saveValues) //将所有的key和value通过上面的回调函数来保存到values数组中
+	//ART不支持定位到下边界，只能遍历上下边界的公共前缀对应的子树，没有公共前缀的时候从最小的key开始遍历
+	if prefix := commonPrefix(lowerBound, upperBound); len(prefix) > 0 {
+		tree.ForEachPrefix(prefix, saveValues)
+	} else {
+		tree.ForEach(saveValues) //将范围内的key和value通过上面的回调函数来保存到values数组中
+	}
+	//如果逆向的话，就将数组翻转过来
+	if reverse {
+		for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+			values[i], values[j] = values[j], values[i]
+		}
+	}
 
 	return &artIterator{
 		currIndex: 0,
@@ -113,6 +147,18 @@ func newARTIterator(tree goart.Tree, reverse bool) *artIterator {
 	}
 }
 
+//commonPrefix 获得上下边界的公共前缀，范围内的key都以它为前缀，任何一个边界为空的时候没有公共前缀
+func commonPrefix(lowerBound, upperBound []byte) []byte {
+	if lowerBound == nil || upperBound == nil {
+		return nil
+	}
+	n := 0
+	for n < len(lowerBound) && n < len(upperBound) && lowerBound[n] == upperBound[n] {
+		n++
+	}
+	return lowerBound[:n]
+}
+
 //Rewind 重新回到迭代器的起点，即第一个位置
 func (ai *artIterator) Rewind() {
 	ai.currIndex = 0
@@ -124,7 +170,7 @@ func (ai *artIterator) Seek(key []byte) {
 	if ai.Valid() {
 		if ai.reverse {
 			ai.currIndex = start + sort.Search(len(ai.value)-start, func(i int) bool {
-				return bytes.Compare(ai.value[i].key, key) <= 0
+				return bytes.Compare(ai.value[i+start].key, key) <= 0
 			})
 		} else {
 			//指定比较的规则
@@ -152,7 +198,7 @@ func (ai *artIterator) Key() []byte {
 
 //Value 当前遍历位置的value数据
 func (ai *artIterator) Value() *data.LogRecordPos {
-	return ai.value[ai.currIndex].pos
+	return ai.value[ai.currIndex].pos.Unpack()
 
 }
 
@@ -8,16 +8,16 @@ import (
 
 func TestAdaptiveRadixTree_Put(t *testing.T) {
 	art := NewART()
-	res1 := art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 12})
+	res1, _ := art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 12})
 	assert.Nil(t, res1)
-	res2 := art.Put([]byte("key-2"), &data.LogRecordPos{Fid: 1, Offset: 12})
+	res2, _ := art.Put([]byte("key-2"), &data.LogRecordPos{Fid: 1, Offset: 12})
 	assert.Nil(t, res2)
-	res3 := art.Put([]byte("key-3"), &data.LogRecordPos{Fid: 1, Offset: 12})
+	res3, _ := art.Put([]byte("key-3"), &data.LogRecordPos{Fid: 1, Offset: 12})
 	assert.Nil(t, res3)
-	res4 := art.Put([]byte("key-3"), &data.LogRecordPos{Fid: 112, Offset: 12})
+	res4, _ := art.Put([]byte("key-3"), &data.LogRecordPos{Fid: 112, Offset: 12})
 	assert.Equal(t, uint32(1), res4.Fid)
 	assert.Equal(t, uint64(12), res4.Offset)
-	pos := art.Get([]byte("key-1"))
+	pos, _ := art.Get([]byte("key-1"))
 	assert.NotNil(t, pos)
 }
 
@@ -26,12 +26,12 @@ func TestAdaptiveRadixTree_Get(t *testing.T) {
 	art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 12})
 	art.Put([]byte("key-2"), &data.LogRecordPos{Fid: 1, Offset: 12})
 	art.Put([]byte("key-3"), &data.LogRecordPos{Fid: 1, Offset: 12})
-	pos1 := art.Get([]byte("key-1"))
+	pos1, _ := art.Get([]byte("key-1"))
 	assert.NotNil(t, pos1)
-	pos2 := art.Get([]byte("key-noexist"))
+	pos2, _ := art.Get([]byte("key-noexist"))
 	assert.Nil(t, pos2)
 	art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 111, Offset: 1223})
-	pos3 := art.Get([]byte("key-1"))
+	pos3, _ := art.Get([]byte("key-1"))
 	assert.NotNil(t, pos3)
 	assert.NotEqual(t, pos2, pos3)
 
@@ -40,17 +40,17 @@ func TestAdaptiveRadixTree_Get(t *testing.T) {
 func TestAdaptiveRadixTree_Delete(t *testing.T) {
 	art := NewART()
 	//删除一个不存在的key
-	res1, ok1 := art.Delete([]byte("not-exist"))
+	res1, ok1, _ := art.Delete([]byte("not-exist"))
 	assert.Nil(t, res1)
 	assert.False(t, ok1)
 
 	//删除一个存在的key
 	art.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 12})
-	res2, ok2 := art.Delete([]byte("key-1"))
+	res2, ok2, _ := art.Delete([]byte("key-1"))
 	assert.True(t, ok2)
 	assert.Equal(t, uint32(1), res2.Fid)
 	assert.Equal(t, uint64(12), res2.Offset)
-	pos := art.Get([]byte("key-1"))
+	pos, _ := art.Get([]byte("key-1"))
 	assert.Nil(t, pos)
 
 }
@@ -75,7 +75,7 @@ func TestAdaptiveRadixTree_Iterator(t *testing.T) {
 	art.Put([]byte("key-2"), &data.LogRecordPos{Fid: 1, Offset: 12})
 	art.Put([]byte("key-3"), &data.LogRecordPos{Fid: 1, Offset: 12})
 	art.Put([]byte("key-11"), &data.LogRecordPos{Fid: 1, Offset: 12})
-	iter := art.Iterator(false)
+	iter, _ := art.Iterator(false)
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		assert.NotNil(t, iter.Key())
 	}
@@ -86,3 +86,11 @@ func TestAdaptiveRadixTree_Iterator(t *testing.T) {
 	t.Log(string(iter.Key()))
 	assert.NotNil(t, iter.Key())
 }
+
+func TestAdaptiveRadixTree_RangeIterator(t *testing.T) {
+	testRangeIterator(t, NewART())
+}
+
+func TestAdaptiveRadixTree_MemoryUsage(t *testing.T) {
+	testMemoryUsage(t, NewART())
+}
@@ -2,77 +2,150 @@ package index
 
 import (
 	"FlexDB/data"
-	"bytes"
 	"github.com/google/btree"
 	"sort"
 	"sync"
+	"unsafe"
+)
+
+const (
+	//btreeItemOverhead 每个Item占用的内存，加上btree节点中保存这个Item的接口
+	btreeItemOverhead = int64(unsafe.Sizeof(Item{})) + 16
+	//keyPrefixOverhead 每个共享前缀占用的内存，加上前缀表中的一项
+	keyPrefixOverhead = int64(unsafe.Sizeof(keyPrefix{})) + 48
 )
 
 //BTree 索引，封装google的btree库,读操作是并发安全的，写操作并发不安全（加锁）
 type BTree struct {
-	tree *btree.BTree
-	lock *sync.RWMutex //使用读写锁保证并发安全，读取资源的时候可以多个线程并发访问，写的时候只有一个线程允许
+	tree      *btree.BTree
+	lock      *sync.RWMutex         //使用读写锁保证并发安全，读取资源的时候可以多个线程并发访问，写的时候只有一个线程允许
+	prefixLen int                   //key前缀压缩的长度，为0表示不压缩
+	prefixes  map[string]*keyPrefix //所有key共享的前缀
+	memory    int64                 //索引占用内存的估算值
 }
 
 //NewBtree 初始化BTree索引结构
 func NewBtree() *BTree {
-	return &BTree{
+	return NewBtreeWithKeyPrefix(0)
+}
+
+//NewBtreeWithKeyPrefix 初始化BTree索引结构，长度超过prefixLen的key会把前prefixLen个字节作为前缀和其他的key共享
+//适合大量key有相同前缀的场景，为0表示不压缩
+func NewBtreeWithKeyPrefix(prefixLen int) *BTree {
+	bt := &BTree{
 		//控制btree叶子节点的数量
-		tree: btree.New(32),
-		lock: new(sync.RWMutex),
+		tree:      btree.New(32),
+		lock:      new(sync.RWMutex),
+		prefixLen: prefixLen,
+	}
+	if prefixLen > 0 {
+		bt.prefixes = make(map[string]*keyPrefix)
+	}
+	return bt
+}
+
+//newItem 构造插入到btree中的Item，需要持有写锁
+func (bt *BTree) newItem(key []byte, pos *data.LogRecordPos) *Item {
+	it := &Item{key: key, pos: data.PackLogRecordPos(pos)}
+	if bt.prefixLen > 0 && len(key) > bt.prefixLen {
+		prefix, ok := bt.prefixes[string(key[:bt.prefixLen])]
+		if !ok {
+			prefix = &keyPrefix{value: append([]byte(nil), key[:bt.prefixLen]...)}
+			bt.prefixes[string(prefix.value)] = prefix
+			bt.memory += keyPrefixOverhead + 2*int64(bt.prefixLen)
+		}
+		prefix.refs++
+		it.prefix = prefix
+		//只保存剩下的部分，不再引用完整的key
+		it.key = append([]byte(nil), key[bt.prefixLen:]...)
+	}
+	bt.memory += btreeItemOverhead + int64(len(it.key))
+	return it
+}
+
+//releaseItem 从btree中移除Item之后释放它占用的前缀，需要持有写锁
+func (bt *BTree) releaseItem(it *Item) {
+	bt.memory -= btreeItemOverhead + int64(len(it.key))
+	if it.prefix == nil {
+		return
+	}
+	it.prefix.refs--
+	if it.prefix.refs == 0 {
+		delete(bt.prefixes, string(it.prefix.value))
+		bt.memory -= keyPrefixOverhead + 2*int64(len(it.prefix.value))
 	}
 }
 
 func (bt *BTree) Size() int {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
 	return bt.tree.Len()
 }
 
+//MemoryUsage 索引占用内存的估算值，包括Item，key和共享的前缀
+func (bt *BTree) MemoryUsage() int64 {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
+	return bt.memory
+}
+
 //Put 给BTRee实现这些接口，主要是调用BTree的一些功能和相关的方法
-func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
-	it := &Item{key: key, pos: pos} //构造数据进行插入，获得指针
+func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
 	bt.lock.Lock()
-
+	it := bt.newItem(key, pos) //构造数据进行插入，获得指针
 	oldItem := bt.tree.ReplaceOrInsert(it)
+	if oldItem != nil {
+		bt.releaseItem(oldItem.(*Item))
+	}
 	bt.lock.Unlock()
 	if oldItem == nil {
-		return nil
+		return nil, nil
 	}
-	return oldItem.(*Item).pos
+	return oldItem.(*Item).pos.Unpack(), nil
 }
 
-func (bt *BTree) Get(key []byte) *data.LogRecordPos {
+func (bt *BTree) Get(key []byte) (*data.LogRecordPos, error) {
 	it := &Item{key: key}
 	//获得的还是一个接口
-	//这个地方支持并发读取，所以不用上锁
+	//google的btree在有写操作的时候不能并发读取，所以需要加读锁
+	bt.lock.RLock()
 	btreeItem := bt.tree.Get(it)
+	bt.lock.RUnlock()
 	if btreeItem == nil {
-		return nil
+		return nil, nil
 	}
 	//如果查找的不为空，就转化成为我们自己设计的Item
-	return btreeItem.(*Item).pos
+	return btreeItem.(*Item).pos.Unpack(), nil
 }
 
-func (bt *BTree) Delete(key []byte) (*data.LogRecordPos, bool) {
+func (bt *BTree) Delete(key []byte) (*data.LogRecordPos, bool, error) {
 	it := &Item{key: key}
 	bt.lock.Lock()
 	//会获得删除前的元素，来检查要删除的元素原来是否存在
 	oldItem := bt.tree.Delete(it)
+	if oldItem != nil {
+		bt.releaseItem(oldItem.(*Item))
+	}
 	bt.lock.Unlock()
 	//oldItem存在，则删除成功，否则就删除失败
 	if oldItem == nil {
-		return nil, false
+		return nil, false, nil
 	}
-	return oldItem.(*Item).pos, true
+	return oldItem.(*Item).pos.Unpack(), true, nil
+
+}
 
+func (bt *BTree) Iterator(reverse bool) (Iterator, error) {
+	return bt.RangeIterator(reverse, nil, nil)
 }
 
-func (bt *BTree) Iterator(reverse bool) Iterator {
+func (bt *BTree) RangeIterator(reverse bool, lowerBound, upperBound []byte) (Iterator, error) {
 	if bt.tree == nil {
-		return nil
+		return nil, nil
 	}
 	bt.lock.RLock()
 	defer bt.lock.RUnlock()
-	return newBtreeIterator(bt.tree, reverse)
+	return newBtreeIterator(bt.tree, reverse, lowerBound, upperBound), nil
 }
 
 func (bt *BTree) Close() error {
@@ -86,20 +159,40 @@ type btreeIterator struct {
 	value     []*Item //key位置索引信息
 }
 
-func newBtreeIterator(tree *btree.BTree, reverse bool) *btreeIterator {
-	var idx int
-	values := make([]*Item, tree.Len())
+func newBtreeIterator(tree *btree.BTree, reverse bool, lowerBound, upperBound []byte) *btreeIterator {
+	var values []*Item
+	if lowerBound == nil && upperBound == nil {
+		values = make([]*Item, 0, tree.Len())
+	}
 	saveValues := func(it btree.Item) bool {
-		values[idx] = it.(*Item) //将it类型转化成*item类型
-		idx++
+		item := it.(*Item) //将it类型转化成*item类型
+		if (lowerBound != nil && item.compare(lowerBound) < 0) || (upperBound != nil && item.compare(upperBound) >= 0) {
+			//超出了边界，直接停止遍历
+			return false
+		}
+		values = append(values, item)
 		return true
 	}
 	if reverse {
-		//逆序存储value
-		tree.Descend(saveValues)
+		//逆序存储value,从上边界开始向下遍历
+		if upperBound != nil {
+			tree.DescendLessOrEqual(&Item{key: upperBound}, func(it btree.Item) bool {
+				//上边界本身是不包含的
+				if it.(*Item).compare(upperBound) == 0 {
+					return true
+				}
+				return saveValues(it)
+			})
+		} else {
+			tree.Descend(saveValues)
+		}
 	} else {
-		//顺序存储value
-		tree.Ascend(saveValues)
+		//顺序存储value,从下边界开始向上遍历
+		if lowerBound != nil {
+			tree.AscendGreaterOrEqual(&Item{key: lowerBound}, saveValues)
+		} else {
+			tree.Ascend(saveValues)
+		}
 	}
 	return &btreeIterator{
 		currIndex: 0,
@@ -119,12 +212,12 @@ func (bti *btreeIterator) Seek(key []byte) {
 	if bti.Valid() {
 		if bti.reverse {
 			bti.currIndex = start + sort.Search(len(bti.value)-start, func(i int) bool {
-				return bytes.Compare(bti.value[i+start].key, key) > 0
+				return bti.value[i+start].compare(key) <= 0
 			})
 		} else {
 			//指定比较的规则
 			bti.currIndex = start + sort.Search(len(bti.value)-start, func(i int) bool {
-				return bytes.Compare(bti.value[i+start].key, key) >= 0
+				return bti.value[i+start].compare(key) >= 0
 			})
 		}
 	}
@@ -142,12 +235,12 @@ func (bti *btreeIterator) Valid() bool {
 
 //Key 当前遍历位置的key数据
 func (bti *btreeIterator) Key() []byte {
-	return bti.value[bti.currIndex].key
+	return bti.value[bti.currIndex].fullKey()
 }
 
 //Value 当前遍历位置的value数据
 func (bti *btreeIterator) Value() *data.LogRecordPos {
-	return bti.value[bti.currIndex].pos
+	return bti.value[bti.currIndex].pos.Unpack()
 
 }
 
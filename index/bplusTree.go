@@ -2,6 +2,7 @@ package index
 
 import (
 	"FlexDB/data"
+	"FlexDB/logger"
 	"bytes"
 	"go.etcd.io/bbolt"
 	"path/filepath"
@@ -14,50 +15,58 @@ const bptreeIndexFileName = "bptree-index"
 var indexBucketName = []byte("index")
 
 type BPlusTree struct {
-	tree *bbolt.DB //内部封转了锁，可以实现并发访问
+	tree   *bbolt.DB     //内部封转了锁，可以实现并发访问
+	name   string        //索引实例的名字
+	logger logger.Logger //日志
 }
 
-func NewBPT(dirPath, indexNum string, syncWrite bool) *BPlusTree {
+//NewBPT 打开B+树索引，打开文件或者创建bucket失败的时候返回错误
+func NewBPT(dirPath, indexNum string, syncWrite bool, log logger.Logger) (*BPlusTree, error) {
+	log = logger.OrDefault(log)
 	//打开一个文件来存储这些数据,先保证这个目录是存在的
 	opts := bbolt.DefaultOptions
 	opts.NoSync = !syncWrite
 	bptree, err := bbolt.Open(filepath.Join(dirPath, indexNum), 0644, opts)
 	if err != nil {
-		return nil
+		log.Error("fail to open bptree index", "index", indexNum, "dir", dirPath, "err", err)
+		return nil, err
 	}
 	//创建一个bucket，就可以通过这个bucket实现事务的读写
 	if err := bptree.Update(func(tx *bbolt.Tx) error {
 		_, err = tx.CreateBucketIfNotExists(indexBucketName)
 		return err
 	}); err != nil {
-		panic("fail to create bucket in bptree")
+		log.Error("fail to create bucket in bptree", "index", indexNum, "err", err)
+		_ = bptree.Close()
+		return nil, err
 	}
 	return &BPlusTree{
-		tree: bptree,
-	}
+		tree:   bptree,
+		name:   indexNum,
+		logger: log,
+	}, nil
 }
 
 // Put 将位置索引存储在磁盘中
-func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
-	var oldValue []byte
+func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
+	var oldPos *data.LogRecordPos
 	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
 		//拿到我们前面定义的bucket，并将key and value进行编码存入磁盘
 		bucket := tx.Bucket(indexBucketName)
-		//先根据key获得之前的数据
-		oldValue = bucket.Get(key)
+		//先根据key获得之前的数据，bbolt返回的数据只在事务中有效，需要在事务中解码
+		if oldValue := bucket.Get(key); len(oldValue) != 0 {
+			oldPos = data.DecodeLogRecordPos(oldValue)
+		}
 		return bucket.Put(key, data.EncodeLogRecordPos(pos))
-
 	}); err != nil {
-		panic("fail to put value in bptree")
+		bpt.logger.Error("fail to put value in bptree", "index", bpt.name, "err", err)
+		return nil, err
 	}
-	if len(oldValue) == 0 {
-		return nil
-	}
-	return data.DecodeLogRecordPos(oldValue)
+	return oldPos, nil
 }
 
 //Get 根据Key获得相应的位置信息
-func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
+func (bpt *BPlusTree) Get(key []byte) (*data.LogRecordPos, error) {
 	var pos *data.LogRecordPos
 	//只读事务
 	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
@@ -68,39 +77,81 @@ func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
 		}
 		return nil
 	}); err != nil {
-		panic("fail to get value in bptree")
+		bpt.logger.Error("fail to get value in bptree", "index", bpt.name, "err", err)
+		return nil, err
 	}
-	return pos
+	return pos, nil
 
 }
 
 //Delete 根据key在位置数据
-func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
-	var oldVal []byte //获取旧的数据
+func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool, error) {
+	var oldPos *data.LogRecordPos //获取旧的数据
 	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
 		//先判断是否存在
-		if oldVal = bucket.Get(key); len(oldVal) != 0 {
+		if oldVal := bucket.Get(key); len(oldVal) != 0 {
+			oldPos = data.DecodeLogRecordPos(oldVal)
 			return bucket.Delete(key)
 		}
 		return nil
 	}); err != nil {
-		panic("fail to delete value in bptree")
+		bpt.logger.Error("fail to delete value in bptree", "index", bpt.name, "err", err)
+		return nil, false, err
 	}
-	if len(oldVal) == 0 {
-		//没有旧的数据，删除失败
-		return nil, false
+	//没有旧的数据的时候删除失败，得到了旧的数据，删除成功
+	return oldPos, oldPos != nil, nil
+}
+
+//ApplyBatch 在一个bbolt事务中执行一批操作，事务失败的时候所有的操作都不会生效
+func (bpt *BPlusTree) ApplyBatch(ops []BatchOp) ([]*data.LogRecordPos, error) {
+	oldPos := make([]*data.LogRecordPos, len(ops))
+	if len(ops) == 0 {
+		return oldPos, nil
 	}
-	//得到了旧的数据，删除成功
-	return data.DecodeLogRecordPos(oldVal), true
+	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(indexBucketName)
+		for i, op := range ops {
+			//bbolt返回的数据只在事务中有效，需要在事务中解码
+			if oldValue := bucket.Get(op.Key); len(oldValue) != 0 {
+				oldPos[i] = data.DecodeLogRecordPos(oldValue)
+			}
+			var err error
+			if op.Delete {
+				if oldPos[i] != nil {
+					err = bucket.Delete(op.Key)
+				}
+			} else {
+				err = bucket.Put(op.Key, data.EncodeLogRecordPos(op.Pos))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		bpt.logger.Error("fail to apply batch in bptree", "index", bpt.name, "ops", len(ops), "err", err)
+		return nil, err
+	}
+	return oldPos, nil
 }
 
 //Iterator 索引迭代器
-func (bpt *BPlusTree) Iterator(reverse bool) Iterator {
-	return newBptreeIterator(bpt.tree, reverse)
+func (bpt *BPlusTree) Iterator(reverse bool) (Iterator, error) {
+	return bpt.RangeIterator(reverse, nil, nil)
+}
+
+//RangeIterator 只遍历[lowerBound, upperBound)范围内的key的索引迭代器
+func (bpt *BPlusTree) RangeIterator(reverse bool, lowerBound, upperBound []byte) (Iterator, error) {
+	iter, err := newBptreeIterator(bpt.tree, reverse, lowerBound, upperBound)
+	if err != nil {
+		bpt.logger.Error("fail to begin a transaction in bptree", "index", bpt.name, "err", err)
+		return nil, err
+	}
+	return iter, nil
 }
 
-//Size 索引中保存的数据个数
+//Size 索引中保存的数据个数，读取失败的时候返回0
 func (bpt *BPlusTree) Size() int {
 	var size int
 	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
@@ -108,54 +159,93 @@ func (bpt *BPlusTree) Size() int {
 		size = bucket.Stats().KeyN
 		return nil
 	}); err != nil {
-		panic("fail to get size in bptree")
+		bpt.logger.Error("fail to get size in bptree", "index", bpt.name, "err", err)
+		return 0
 	}
 	return size
 }
 
+//MemoryUsage B+树索引存储在磁盘中，不占用额外的内存
+func (bpt *BPlusTree) MemoryUsage() int64 {
+	return 0
+}
+
 func (bpt *BPlusTree) Close() error {
 	return bpt.tree.Close()
 }
 
 type bptreeIterator struct {
-	tx      *bbolt.Tx
-	cursor  *bbolt.Cursor //游标，使用这个就可以进行迭代
-	reverse bool
-	currKey []byte
-	currVal []byte
+	tx         *bbolt.Tx
+	cursor     *bbolt.Cursor //游标，使用这个就可以进行迭代
+	reverse    bool
+	currKey    []byte
+	currVal    []byte
+	lowerBound []byte //遍历的下边界(包含)，为空表示不限制
+	upperBound []byte //遍历的上边界(不包含)，为空表示不限制
 }
 
-func newBptreeIterator(tree *bbolt.DB, reverse bool) *bptreeIterator {
+func newBptreeIterator(tree *bbolt.DB, reverse bool, lowerBound, upperBound []byte) (*bptreeIterator, error) {
 	//手动的打开一个事务
 	tx, err := tree.Begin(false)
 	if err != nil {
-		panic("fail to begin a transaction")
+		return nil, err
 	}
 	bpi := &bptreeIterator{
-		tx:      tx,
-		cursor:  tx.Bucket(indexBucketName).Cursor(),
-		reverse: reverse,
+		tx:         tx,
+		cursor:     tx.Bucket(indexBucketName).Cursor(),
+		reverse:    reverse,
+		lowerBound: lowerBound,
+		upperBound: upperBound,
 	}
 	bpi.Rewind() //先进行初始化
-	return bpi
+	return bpi, nil
 }
 
 //Rewind 重新回到迭代器的起点，即第一个位置
 func (bpi *bptreeIterator) Rewind() {
 	if bpi.reverse {
-		bpi.currKey, bpi.currVal = bpi.cursor.Last()
+		if bpi.upperBound == nil {
+			bpi.currKey, bpi.currVal = bpi.cursor.Last()
+			return
+		}
+		//找到第一个大于等于上边界的key，然后回退到比上边界小的key
+		bpi.currKey, bpi.currVal = bpi.cursor.Seek(bpi.upperBound)
+		if bpi.currKey == nil {
+			bpi.currKey, bpi.currVal = bpi.cursor.Last()
+		} else {
+			bpi.currKey, bpi.currVal = bpi.cursor.Prev()
+		}
 	} else {
-		bpi.currKey, bpi.currVal = bpi.cursor.First()
+		if bpi.lowerBound == nil {
+			bpi.currKey, bpi.currVal = bpi.cursor.First()
+			return
+		}
+		bpi.currKey, bpi.currVal = bpi.cursor.Seek(bpi.lowerBound)
 	}
 }
 
 //Seek 根据传入的Key查找到第一个大于等于的目标key，根据从这个key开始遍历
+//和其他索引一样，seek只会从当前的位置向后移动，反向遍历的时候找到第一个小于等于目标的key
 func (bpi *bptreeIterator) Seek(key []byte) {
-	for bpi.Valid() && bytes.Compare(bpi.currKey, key) <= 0 {
-		bpi.Next()
+	if !bpi.Valid() {
+		return
+	}
+	if bpi.reverse {
+		if bytes.Compare(bpi.currKey, key) <= 0 {
+			return
+		}
+		bpi.currKey, bpi.currVal = bpi.cursor.Seek(key)
+		if bpi.currKey == nil {
+			bpi.currKey, bpi.currVal = bpi.cursor.Last()
+		} else if bytes.Compare(bpi.currKey, key) > 0 {
+			bpi.currKey, bpi.currVal = bpi.cursor.Prev()
+		}
+	} else {
+		if bytes.Compare(bpi.currKey, key) >= 0 {
+			return
+		}
+		bpi.currKey, bpi.currVal = bpi.cursor.Seek(key)
 	}
-	//bpi.currKey, bpi.currVal = bpi.cursor.Seek(key)
-
 }
 
 //Next 跳转到下一个key
@@ -169,7 +259,7 @@ func (bpi *bptreeIterator) Next() {
 
 //Valid 是否有效，即时有已经遍历完了所有的Key，用来退出遍历
 func (bpi *bptreeIterator) Valid() bool {
-	return len(bpi.currKey) != 0
+	return len(bpi.currKey) != 0 && inRange(bpi.currKey, bpi.lowerBound, bpi.upperBound)
 }
 
 //Key 当前遍历位置的key数据
@@ -2,6 +2,7 @@ package index
 
 import (
 	"FlexDB/data"
+	"FlexDB/logger"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"path/filepath"
@@ -17,11 +18,12 @@ func TestBPlusTree_Put(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(DirPath)
 	}()
-	tree := NewBPT(path, "0", false)
-	res1 := tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 9999})
+	tree, err := NewBPT(path, "0", false, logger.Nop())
+	assert.Nil(t, err)
+	res1, _ := tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 9999})
 	assert.Nil(t, res1)
 	tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 123, Offset: 9999})
-	res2 := tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 99})
+	res2, _ := tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 99})
 	assert.Equal(t, uint32(123), res2.Fid)
 	assert.Equal(t, uint64(9999), res2.Offset)
 
@@ -33,16 +35,17 @@ func TestBPlusTree_Get(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(DirPath)
 	}()
-	tree := NewBPT(path, "0", false)
-	pos := tree.Get([]byte("not-exist"))
+	tree, err := NewBPT(path, "0", false, logger.Nop())
+	assert.Nil(t, err)
+	pos, _ := tree.Get([]byte("not-exist"))
 	assert.Nil(t, pos)
 	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 9999})
 	tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 1231, Offset: 9999})
 	tree.Put([]byte("acc"), &data.LogRecordPos{Fid: 1232, Offset: 9999})
-	pos1 := tree.Get([]byte("aac"))
+	pos1, _ := tree.Get([]byte("aac"))
 	assert.NotNil(t, pos1)
 	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 99992})
-	pos2 := tree.Get([]byte("aac"))
+	pos2, _ := tree.Get([]byte("aac"))
 	assert.NotNil(t, pos2)
 
 }
@@ -53,18 +56,19 @@ func TestBPlusTree_Delete(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(DirPath)
 	}()
-	tree := NewBPT(path, "0", false)
-	res1, ok1 := tree.Delete([]byte("no-exist"))
+	tree, err := NewBPT(path, "0", false, logger.Nop())
+	assert.Nil(t, err)
+	res1, ok1, _ := tree.Delete([]byte("no-exist"))
 	assert.False(t, ok1)
 	assert.Nil(t, res1)
 	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 9999})
 	tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 1231, Offset: 9999})
 	tree.Put([]byte("acc"), &data.LogRecordPos{Fid: 1232, Offset: 9999})
-	res2, ok2 := tree.Delete([]byte("aac"))
+	res2, ok2, _ := tree.Delete([]byte("aac"))
 	assert.True(t, ok2)
 	assert.Equal(t, uint32(123), res2.Fid)
 	assert.Equal(t, uint64(9999), res2.Offset)
-	assert.Nil(t, tree.Get([]byte("aac")))
+	assert.Nil(t, getPos(tree, []byte("aac")))
 }
 
 func TestBPlusTree_Size(t *testing.T) {
@@ -74,7 +78,9 @@ func TestBPlusTree_Size(t *testing.T) {
 		_ = os.RemoveAll(DirPath)
 	}()
 
-	tree := NewBPT(path, "0", false)
+	tree, err := NewBPT(path, "0", false, logger.Nop())
+
+	assert.Nil(t, err)
 	assert.Equal(t, 0, tree.Size())
 	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 9999})
 	tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 1231, Offset: 9999})
@@ -89,11 +95,12 @@ func TestBPlusTree_Iterator(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(DirPath)
 	}()
-	tree := NewBPT(path, "0", false)
+	tree, err := NewBPT(path, "0", false, logger.Nop())
+	assert.Nil(t, err)
 	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 123, Offset: 9999})
 	tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 123, Offset: 9999})
 	tree.Put([]byte("acc"), &data.LogRecordPos{Fid: 123, Offset: 9999})
-	iter := tree.Iterator(false)
+	iter, _ := tree.Iterator(false)
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		assert.NotNil(t, iter.Key())
 		assert.NotNil(t, iter.Value())
@@ -108,3 +115,79 @@ func TestBPlusTree_Iterator(t *testing.T) {
 	//assert.NotNil(t, iter.Key())
 	//assert.NotNil(t, iter.Value())
 }
+
+func TestBPlusTree_RangeIterator(t *testing.T) {
+	path := filepath.Join(DirPath, "bptree-range")
+	os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(DirPath)
+	}()
+	tree, err := NewBPT(path, "0", false, logger.Nop())
+	assert.Nil(t, err)
+	defer tree.Close()
+	testRangeIterator(t, tree)
+}
+
+func TestBPlusTree_ApplyBatch(t *testing.T) {
+	path := filepath.Join(DirPath, "bptree-batch")
+	os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(DirPath)
+	}()
+	tree, err := NewBPT(path, "0", false, logger.Nop())
+	assert.Nil(t, err)
+	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 1, Offset: 10})
+
+	oldPos, err := ApplyBatch(tree, []BatchOp{
+		{Key: []byte("aac"), Pos: &data.LogRecordPos{Fid: 2, Offset: 20}},
+		{Key: []byte("abc"), Pos: &data.LogRecordPos{Fid: 2, Offset: 30}},
+		{Key: []byte("abc"), Pos: &data.LogRecordPos{Fid: 2, Offset: 40}},
+		{Key: []byte("not-exist"), Delete: true},
+		{Key: []byte("aac"), Delete: true},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(oldPos))
+	assert.Equal(t, uint64(10), oldPos[0].Offset)
+	assert.Nil(t, oldPos[1])
+	assert.Equal(t, uint64(30), oldPos[2].Offset)
+	assert.Nil(t, oldPos[3])
+	assert.Equal(t, uint64(20), oldPos[4].Offset)
+	assert.Nil(t, getPos(tree, []byte("aac")))
+	assert.Equal(t, uint64(40), getPos(tree, []byte("abc")).Offset)
+	assert.Equal(t, 1, tree.Size())
+
+	//bbolt出错的时候返回错误，而不是panic
+	assert.Nil(t, tree.Close())
+	_, err = tree.ApplyBatch([]BatchOp{{Key: []byte("acc"), Pos: &data.LogRecordPos{Fid: 3}}})
+	assert.NotNil(t, err)
+}
+
+//打开失败和bbolt关闭之后的读写都返回错误，而不是panic
+func TestBPlusTree_Errors(t *testing.T) {
+	path := filepath.Join(DirPath, "bptree-errors")
+	os.MkdirAll(filepath.Join(path, "0"), os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(DirPath)
+	}()
+	//索引文件的位置是一个目录
+	_, err := NewBPT(path, "0", false, logger.Nop())
+	assert.NotNil(t, err)
+	_, err = NewIndex(BPT, path, "0", false, 0, logger.Nop())
+	assert.NotNil(t, err)
+	_, err = NewIndex(100, path, "1", false, 0, logger.Nop())
+	assert.Equal(t, ErrIndexTypeInvalid, err)
+
+	tree, err := NewBPT(path, "1", false, logger.Nop())
+	assert.Nil(t, err)
+	tree.Put([]byte("aac"), &data.LogRecordPos{Fid: 1, Offset: 10})
+	assert.Nil(t, tree.Close())
+	_, err = tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 1, Offset: 20})
+	assert.NotNil(t, err)
+	_, err = tree.Get([]byte("aac"))
+	assert.NotNil(t, err)
+	_, _, err = tree.Delete([]byte("aac"))
+	assert.NotNil(t, err)
+	_, err = tree.Iterator(false)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, tree.Size())
+}
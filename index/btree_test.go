@@ -2,6 +2,7 @@ package index
 
 import (
 	"FlexDB/data"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -9,13 +10,13 @@ import (
 func TestBTree_Put(t *testing.T) {
 	bt := NewBtree()
 	//插入一个边界数据
-	res := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	res, _ := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
 	//前面没有数据，所以旧的数据应该是空
 	assert.Nil(t, res)
 
-	res2 := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	res2, _ := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
 	assert.Nil(t, res2)
-	res3 := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3})
+	res3, _ := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3})
 	assert.NotNil(t, res3)
 	assert.Equal(t, uint32(1), res3.Fid)
 	assert.Equal(t, uint64(2), res3.Offset)
@@ -25,20 +26,20 @@ func TestBTree_Put(t *testing.T) {
 func TestBTree_Get(t *testing.T) {
 	bt := NewBtree()
 	//插入一个边界数据
-	res := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	res, _ := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
 	assert.Nil(t, res)
 	//测试key=nil获得相应的数据
-	pos1 := bt.Get(nil)
+	pos1, _ := bt.Get(nil)
 	assert.Equal(t, uint32(1), pos1.Fid)
 	assert.Equal(t, uint64(100), pos1.Offset)
 
 	//测试对一个key的重复使用获得的数据
-	res2 := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	res2, _ := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
 	assert.Nil(t, res2)
-	res3 := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3})
+	res3, _ := bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3})
 	assert.Equal(t, uint32(1), res3.Fid)
 	assert.Equal(t, uint64(2), res3.Offset)
-	pos2 := bt.Get([]byte("a"))
+	pos2, _ := bt.Get([]byte("a"))
 	assert.Equal(t, uint32(1), pos2.Fid)
 	assert.Equal(t, uint64(3), pos2.Offset)
 
@@ -46,16 +47,16 @@ func TestBTree_Get(t *testing.T) {
 
 func TestBTree_Delete(t *testing.T) {
 	bt := NewBtree()
-	res1 := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	res1, _ := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
 	assert.Nil(t, res1)
 	//删除一个nil对象
-	_, ok1 := bt.Delete(nil)
+	_, ok1, _ := bt.Delete(nil)
 	assert.True(t, ok1)
 
-	res3 := bt.Put([]byte("aaa"), &data.LogRecordPos{Fid: 22, Offset: 33})
+	res3, _ := bt.Put([]byte("aaa"), &data.LogRecordPos{Fid: 22, Offset: 33})
 	assert.Nil(t, res3)
 	//删除一个aaa对象
-	res4, ok2 := bt.Delete([]byte("aaa"))
+	res4, ok2, _ := bt.Delete([]byte("aaa"))
 	assert.True(t, ok2)
 	assert.Equal(t, uint32(22), res4.Fid)
 	assert.Equal(t, uint64(33), res4.Offset)
@@ -65,13 +66,13 @@ func TestBTree_Delete(t *testing.T) {
 func TestBTree_Iterator(t *testing.T) {
 	bt1 := NewBtree()
 	//1.BTree为空的情况
-	iter1 := bt1.Iterator(false)
+	iter1, _ := bt1.Iterator(false)
 	assert.Equal(t, false, iter1.Valid())
 	iter1.Close()
 
 	//2.BTree有数据的情况
 	bt1.Put([]byte("abcd"), &data.LogRecordPos{Fid: 1, Offset: 10})
-	iter2 := bt1.Iterator(false)
+	iter2, _ := bt1.Iterator(false)
 	assert.Equal(t, true, iter2.Valid())
 	assert.NotNil(t, iter2.Key())
 	assert.NotNil(t, iter2.Value())
@@ -84,14 +85,14 @@ func TestBTree_Iterator(t *testing.T) {
 	bt1.Put([]byte("asgh"), &data.LogRecordPos{Fid: 1, Offset: 10})
 	bt1.Put([]byte("fakh"), &data.LogRecordPos{Fid: 1, Offset: 10})
 	bt1.Put([]byte("mlas"), &data.LogRecordPos{Fid: 1, Offset: 10})
-	iter3 := bt1.Iterator(true)
+	iter3, _ := bt1.Iterator(true)
 	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
 		assert.NotNil(t, iter3.Key())
 	}
 	iter3.Close() //新开一个的话，前面的就要关掉
 
 	//4.测试 seek
-	iter4 := bt1.Iterator(false)
+	iter4, _ := bt1.Iterator(false)
 	for iter4.Seek([]byte("bb")); iter4.Valid(); iter4.Next() {
 		assert.NotNil(t, iter4.Key())
 	}
@@ -113,3 +114,146 @@ func TestBTree_Iterator(t *testing.T) {
 	iter4.Seek([]byte("bb"))
 	t.Log(string(iter4.Key()))
 }
+
+//collectKeys 获得迭代器中的所有key
+func collectKeys(iter Iterator) []string {
+	var keys []string
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	return keys
+}
+
+//getPos 获得key对应的位置信息，内存索引的读取不会出错
+func getPos(idx Indexer, key []byte) *data.LogRecordPos {
+	pos, _ := idx.Get(key)
+	return pos
+}
+
+//newIter 获得索引的正向或者反向迭代器，内存索引创建迭代器不会出错
+func newIter(idx Indexer, reverse bool) Iterator {
+	iter, _ := idx.Iterator(reverse)
+	return iter
+}
+
+//testRangeIterator 检查索引的范围迭代器只返回[lowerBound, upperBound)中的key
+func testRangeIterator(t *testing.T, idx Indexer) {
+	for _, key := range []string{"a", "b", "ba", "c", "d", "e"} {
+		idx.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: 10})
+	}
+	cases := []struct {
+		lower, upper []byte
+		expected     []string
+	}{
+		{nil, nil, []string{"a", "b", "ba", "c", "d", "e"}},
+		{[]byte("b"), []byte("d"), []string{"b", "ba", "c"}},
+		{[]byte("bb"), nil, []string{"c", "d", "e"}},
+		{nil, []byte("c"), []string{"a", "b", "ba"}},
+		{[]byte("x"), nil, nil},
+		{[]byte("c"), []byte("c"), nil},
+		{[]byte("ba"), []byte("bb"), []string{"ba"}},
+		{[]byte("b"), []byte("b\x00"), []string{"b"}},
+		{[]byte("b\x00"), []byte("bz"), []string{"ba"}},
+	}
+	for _, c := range cases {
+		iter, _ := idx.RangeIterator(false, c.lower, c.upper)
+		assert.Equal(t, c.expected, collectKeys(iter))
+		iter.Close()
+
+		//反向遍历得到的是逆序的结果
+		var reversed []string
+		for i := len(c.expected) - 1; i >= 0; i-- {
+			reversed = append(reversed, c.expected[i])
+		}
+		iter, _ = idx.RangeIterator(true, c.lower, c.upper)
+		assert.Equal(t, reversed, collectKeys(iter))
+		//Rewind之后仍然在范围内
+		iter.Rewind()
+		assert.Equal(t, reversed, collectKeys(iter))
+		iter.Close()
+	}
+	//反向遍历的时候seek到第一个小于等于目标的key
+	iter, _ := idx.RangeIterator(true, []byte("a"), []byte("e"))
+	iter.Seek([]byte("bz"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, "ba", string(iter.Key()))
+	iter.Close()
+}
+
+func TestBTree_RangeIterator(t *testing.T) {
+	testRangeIterator(t, NewBtree())
+}
+
+func TestBTree_KeyPrefix(t *testing.T) {
+	//压缩的key和没有压缩的key混合在一起的时候顺序仍然正确
+	testRangeIterator(t, NewBtreeWithKeyPrefix(1))
+
+	plain, compressed := NewBtree(), NewBtreeWithKeyPrefix(12)
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("user:profile:%06d", i))
+		plain.Put(key, &data.LogRecordPos{Fid: 1, Offset: uint64(i)})
+		oldPos, _ := compressed.Put(key, &data.LogRecordPos{Fid: 1, Offset: uint64(i)})
+		assert.Nil(t, oldPos)
+	}
+	assert.Equal(t, 1, len(compressed.prefixes))
+	assert.True(t, compressed.MemoryUsage() < plain.MemoryUsage())
+	assert.Equal(t, collectKeys(newIter(plain, false)), collectKeys(newIter(compressed, false)))
+
+	pos, _ := compressed.Get([]byte("user:profile:000123"))
+	assert.Equal(t, uint64(123), pos.Offset)
+	assert.Nil(t, getPos(compressed, []byte("user:profile:")))
+	oldPos, _ := compressed.Put([]byte("user:profile:000123"), &data.LogRecordPos{Fid: 2, Offset: 7})
+	assert.Equal(t, uint64(123), oldPos.Offset)
+
+	iter, _ := compressed.Iterator(false)
+	iter.Seek([]byte("user:profile:000500"))
+	assert.Equal(t, "user:profile:000500", string(iter.Key()))
+	assert.Equal(t, uint64(500), iter.Value().Offset)
+	iter.Close()
+
+	//删除所有的key之后共享的前缀也会被释放
+	for i := 0; i < 1000; i++ {
+		_, ok, _ := compressed.Delete([]byte(fmt.Sprintf("user:profile:%06d", i)))
+		assert.True(t, ok)
+	}
+	assert.Equal(t, 0, len(compressed.prefixes))
+	assert.Equal(t, int64(0), compressed.MemoryUsage())
+}
+
+//testMemoryUsage 检查索引的内存估算值随着写入和删除变化
+func testMemoryUsage(t *testing.T, idx Indexer) {
+	assert.Equal(t, int64(0), idx.MemoryUsage())
+	for i := 0; i < 100; i++ {
+		idx.Put([]byte(fmt.Sprintf("key-%03d", i)), &data.LogRecordPos{Fid: 1, Offset: uint64(i)})
+	}
+	memory := idx.MemoryUsage()
+	assert.True(t, memory > 100*int64(data.PackedPosSize))
+	//覆盖写不会增加内存
+	idx.Put([]byte("key-000"), &data.LogRecordPos{Fid: 2, Offset: 1})
+	assert.Equal(t, memory, idx.MemoryUsage())
+	for i := 0; i < 100; i++ {
+		idx.Delete([]byte(fmt.Sprintf("key-%03d", i)))
+	}
+	assert.Equal(t, int64(0), idx.MemoryUsage())
+}
+
+func TestBTree_MemoryUsage(t *testing.T) {
+	testMemoryUsage(t, NewBtree())
+}
+
+//不支持批量更新的索引逐个执行Put和Delete
+func TestBTree_ApplyBatch(t *testing.T) {
+	bt := NewBtree()
+	bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	oldPos, err := ApplyBatch(bt, []BatchOp{
+		{Key: []byte("a"), Pos: &data.LogRecordPos{Fid: 1, Offset: 2}},
+		{Key: []byte("b"), Pos: &data.LogRecordPos{Fid: 1, Offset: 3}},
+		{Key: []byte("a"), Delete: true},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), oldPos[0].Offset)
+	assert.Nil(t, oldPos[1])
+	assert.Equal(t, uint64(2), oldPos[2].Offset)
+	assert.Nil(t, getPos(bt, []byte("a")))
+	assert.Equal(t, 1, bt.Size())
+}
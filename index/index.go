@@ -2,28 +2,73 @@ package index
 
 import (
 	"FlexDB/data"
+	"FlexDB/logger"
 	"bytes"
+	"errors"
 	"github.com/google/btree"
 )
 
+//ErrIndexTypeInvalid 不支持的索引类型
+var ErrIndexTypeInvalid = errors.New("unsupported index type")
+
 //内存的索引key，就是用key+revision，在compact的时候把过期的索引去掉，在后台线程上进行周期性的过期数据的清理
 
 //Indexer 定义一个抽象索引接口(内存索引)
 //Get拿到索引的位置信息
+//B+树索引的读写需要访问磁盘，可能会失败，所有的读写操作都会把错误返回出去，内存索引总是返回空的错误
 type Indexer interface {
 	//Put 向索引中添加key对应的位置信息,并且将旧的数据返回出去
-	Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos
-	//Get 根据Key获得相应的位置信息
-	Get(key []byte) *data.LogRecordPos
-	//Delete 根据key删除位置数据，并且将旧的数据返回出去
-	Delete(key []byte) (*data.LogRecordPos, bool)
+	Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error)
+	//Get 根据Key获得相应的位置信息，key不存在的时候返回空
+	Get(key []byte) (*data.LogRecordPos, error)
+	//Delete 根据key删除位置数据，并且将旧的数据返回出去，key不存在的时候返回false
+	Delete(key []byte) (*data.LogRecordPos, bool, error)
 	//Iterator 索引迭代器
-	Iterator(reverse bool) Iterator
+	Iterator(reverse bool) (Iterator, error)
+	//RangeIterator 只遍历[lowerBound, upperBound)范围内的key的索引迭代器，边界为空表示不限制
+	RangeIterator(reverse bool, lowerBound, upperBound []byte) (Iterator, error)
 	//Size 索引中保存的数据个数
 	Size() int
+	//MemoryUsage 索引在内存中占用的字节数的估算值
+	MemoryUsage() int64
 	//Close 关闭索引,避免阻塞，以及释放资源
 	Close() error
 }
+
+//BatchOp 批量更新索引中的一个操作
+type BatchOp struct {
+	Key    []byte
+	Pos    *data.LogRecordPos //写入的位置信息，删除操作的时候不使用
+	Delete bool               //是否为删除操作
+}
+
+//BatchIndexer 支持批量更新的索引，一批操作在一次提交中完成
+//B+树索引每次Put和Delete都是一个bbolt事务，批量更新可以把一批操作放在同一个事务中，避免每个key提交一次事务
+type BatchIndexer interface {
+	//ApplyBatch 按照顺序执行一批操作，返回每个操作对应的旧的位置信息，不存在旧的数据的时候为空
+	ApplyBatch(ops []BatchOp) ([]*data.LogRecordPos, error)
+}
+
+//ApplyBatch 按照顺序更新索引，索引支持批量更新的时候一次完成，否则逐个执行Put和Delete，遇到错误的时候停止
+func ApplyBatch(idx Indexer, ops []BatchOp) ([]*data.LogRecordPos, error) {
+	if batchIdx, ok := idx.(BatchIndexer); ok {
+		return batchIdx.ApplyBatch(ops)
+	}
+	oldPos := make([]*data.LogRecordPos, len(ops))
+	for i, op := range ops {
+		var err error
+		if op.Delete {
+			oldPos[i], _, err = idx.Delete(op.Key)
+		} else {
+			oldPos[i], err = idx.Put(op.Key, op.Pos)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return oldPos, nil
+}
+
 type IndexType = int8
 
 const (
@@ -32,32 +77,119 @@ const (
 	//ART自适应基数树
 	ART
 	BPT
+	//Skiplist 并发跳表
+	Skiplist
 )
 
-//NewIndex 工厂函数，用来创建不同类新的索引
-func NewIndex(typ IndexType, dirPath, indexNum string, sync bool) Indexer {
+//NewIndex 工厂函数，用来创建不同类新的索引,keyPrefixLen是B树索引中key前缀压缩的长度，为0表示不压缩
+//B+树索引打开文件失败的时候返回错误
+func NewIndex(typ IndexType, dirPath, indexNum string, sync bool, keyPrefixLen int, log logger.Logger) (Indexer, error) {
 	switch typ {
 	case Btree:
-		return NewBtree()
+		return NewBtreeWithKeyPrefix(keyPrefixLen), nil
 	case ART:
-		return NewART()
+		return NewART(), nil
 	case BPT:
-		return NewBPT(dirPath, indexNum, sync)
+		bpt, err := NewBPT(dirPath, indexNum, sync, log)
+		if err != nil {
+			return nil, err
+		}
+		return bpt, nil
+	case Skiplist:
+		return NewSkiplist(), nil
 	default:
-		panic("unsupported index type")
+		return nil, ErrIndexTypeInvalid
 	}
 }
 
 //Item BTree中使用到了Item的抽象方法,所以这里需要实现一个接口来实现相应的方法,插入到btree的时候实际上就是插入这个数据结构
+//位置信息使用紧凑编码直接保存在Item中，开启前缀压缩的时候，相同前缀的key共享同一个前缀，Item中只保存剩下的部分
 type Item struct {
-	key []byte             //key
-	pos *data.LogRecordPos //对应的数据
+	prefix *keyPrefix     //key的前缀，为空表示没有进行前缀压缩
+	key    []byte         //key除去前缀之后的部分，没有前缀的时候就是完整的key
+	pos    data.PackedPos //对应的数据
 }
 
 //Less里面是btree的Item对象,该方法按照从小到大的顺序,=-1说明第一个key小于第二个key
 func (ai *Item) Less(bi btree.Item) bool {
 	//bi.(*Item)是将bi转化成为*Item类型，类型断言，就是将接口类型转化成为具体的类型
-	return bytes.Compare(ai.key, bi.(*Item).key) == -1
+	other := bi.(*Item)
+	if ai.prefix == other.prefix {
+		//共享同一个前缀的时候只需要比较剩下的部分
+		return bytes.Compare(ai.key, other.key) == -1
+	}
+	return compareParts(ai.prefix.bytes(), ai.key, other.prefix.bytes(), other.key) == -1
+}
+
+//compare 比较Item中的key和给定的key
+func (ai *Item) compare(key []byte) int {
+	return compareParts(ai.prefix.bytes(), ai.key, key, nil)
+}
+
+//fullKey 获得完整的key，没有进行前缀压缩的时候不需要拷贝
+func (ai *Item) fullKey() []byte {
+	if ai.prefix == nil {
+		return ai.key
+	}
+	key := make([]byte, 0, len(ai.prefix.value)+len(ai.key))
+	key = append(key, ai.prefix.value...)
+	return append(key, ai.key...)
+}
+
+//keyPrefix 前缀压缩的时候多个key共享的前缀
+type keyPrefix struct {
+	value []byte
+	refs  int //引用这个前缀的key的个数，为0的时候从前缀表中删除
+}
+
+func (p *keyPrefix) bytes() []byte {
+	if p == nil {
+		return nil
+	}
+	return p.value
+}
+
+//compareParts 比较a1+a2和b1+b2拼接之后的大小，不需要拼接
+func compareParts(a1, a2, b1, b2 []byte) int {
+	for {
+		if len(a1) == 0 {
+			a1, a2 = a2, nil
+		}
+		if len(b1) == 0 {
+			b1, b2 = b2, nil
+		}
+		if len(a1) == 0 || len(b1) == 0 {
+			break
+		}
+		n := len(a1)
+		if len(b1) < n {
+			n = len(b1)
+		}
+		if c := bytes.Compare(a1[:n], b1[:n]); c != 0 {
+			return c
+		}
+		a1, b1 = a1[n:], b1[n:]
+	}
+	//至少有一个已经比较完了
+	switch {
+	case len(a1) == 0 && len(b1) == 0:
+		return 0
+	case len(a1) == 0:
+		return -1
+	default:
+		return 1
+	}
+}
+
+//inRange 判断key是否在[lowerBound, upperBound)的范围内，边界为空表示不限制
+func inRange(key, lowerBound, upperBound []byte) bool {
+	if lowerBound != nil && bytes.Compare(key, lowerBound) < 0 {
+		return false
+	}
+	if upperBound != nil && bytes.Compare(key, upperBound) >= 0 {
+		return false
+	}
+	return true
 }
 
 type Iterator interface {
@@ -0,0 +1,363 @@
+package index
+
+import (
+	"FlexDB/data"
+	"bytes"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+/*
+	并发跳表索引，使用lazy skiplist的算法
+	读操作不加锁，沿着每一层的指针向后查找就可以了
+	写操作只锁住需要修改的前驱节点，不同位置的写操作可以并发进行
+	删除的时候先把节点标记为删除(逻辑删除)，然后再从每一层中摘除(物理删除)，插入的时候等所有层都链接好了才对读可见
+*/
+
+const (
+	skiplistMaxLevel = 16 //跳表的最大层数，每一层的概率为1/4，可以支持4^16个元素
+	skiplistP        = 4  //每个节点有1/skiplistP的概率拥有更高一层
+)
+
+//skiplistNodeOverhead 每个节点占用的内存，不包括key和每一层的后继指针
+const skiplistNodeOverhead = int64(unsafe.Sizeof(skiplistNode{})) + data.PackedPosSize
+
+//skiplistNode 跳表中的节点
+type skiplistNode struct {
+	key         []byte
+	pos         unsafe.Pointer   //*data.PackedPos，覆盖写的时候原子地替换
+	next        []unsafe.Pointer //*skiplistNode，每一层的后继节点
+	mu          sync.Mutex       //修改这个节点的后继节点或者位置信息的时候需要加锁
+	marked      int32            //是否已经被逻辑删除
+	fullyLinked int32            //是否已经在所有层中链接好了，链接好之后才对读可见
+	topLevel    int              //节点的层数
+}
+
+func newSkiplistNode(key []byte, pos *data.PackedPos, topLevel int) *skiplistNode {
+	return &skiplistNode{
+		key:      key,
+		pos:      unsafe.Pointer(pos),
+		next:     make([]unsafe.Pointer, topLevel),
+		topLevel: topLevel,
+	}
+}
+
+func (n *skiplistNode) loadNext(level int) *skiplistNode {
+	return (*skiplistNode)(atomic.LoadPointer(&n.next[level]))
+}
+
+func (n *skiplistNode) storeNext(level int, next *skiplistNode) {
+	atomic.StorePointer(&n.next[level], unsafe.Pointer(next))
+}
+
+func (n *skiplistNode) loadPos() *data.PackedPos {
+	return (*data.PackedPos)(atomic.LoadPointer(&n.pos))
+}
+
+//memoryUsage 节点占用内存的估算值
+func (n *skiplistNode) memoryUsage() int64 {
+	return skiplistNodeOverhead + int64(len(n.key)) + int64(n.topLevel)*int64(unsafe.Sizeof(unsafe.Pointer(nil)))
+}
+
+func (n *skiplistNode) isMarked() bool {
+	return atomic.LoadInt32(&n.marked) == 1
+}
+
+func (n *skiplistNode) isFullyLinked() bool {
+	return atomic.LoadInt32(&n.fullyLinked) == 1
+}
+
+//SkipList 跳表索引，读操作不加锁，写操作使用细粒度的锁，可以并发使用
+type SkipList struct {
+	head   *skiplistNode //头节点，不存储数据，比所有的key都小
+	size   int64         //跳表中的元素个数
+	memory int64         //跳表占用内存的估算值
+}
+
+//NewSkiplist 初始化跳表索引
+func NewSkiplist() *SkipList {
+	return &SkipList{
+		head: newSkiplistNode(nil, nil, skiplistMaxLevel),
+	}
+}
+
+//randomLevel 随机生成新节点的层数
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Intn(skiplistP) == 0 {
+		level++
+	}
+	return level
+}
+
+//find 查找key在每一层的前驱和后继节点，返回找到key的最高层，没有找到返回-1
+func (sl *SkipList) find(key []byte, preds, succs *[skiplistMaxLevel]*skiplistNode) int {
+	levelFound := -1
+	pred := sl.head
+	for level := skiplistMaxLevel - 1; level >= 0; level-- {
+		curr := pred.loadNext(level)
+		for curr != nil && bytes.Compare(curr.key, key) < 0 {
+			pred = curr
+			curr = pred.loadNext(level)
+		}
+		if levelFound == -1 && curr != nil && bytes.Equal(curr.key, key) {
+			levelFound = level
+		}
+		preds[level] = pred
+		succs[level] = curr
+	}
+	return levelFound
+}
+
+//lockPreds 锁住[0, topLevel)层中的前驱节点，并检查前驱节点的后继是否仍然是succ，返回是否检查通过以及锁住的最高层
+func lockPreds(preds, succs *[skiplistMaxLevel]*skiplistNode, topLevel int, checkSucc func(succ *skiplistNode) bool) (bool, int) {
+	highestLocked := -1
+	var prevPred *skiplistNode
+	valid := true
+	for level := 0; valid && level < topLevel; level++ {
+		pred, succ := preds[level], succs[level]
+		//同一个节点可能是多层的前驱，只需要加一次锁
+		if pred != prevPred {
+			pred.mu.Lock()
+			highestLocked = level
+			prevPred = pred
+		}
+		valid = !pred.isMarked() && pred.loadNext(level) == succ && checkSucc(succ)
+	}
+	return valid, highestLocked
+}
+
+//unlockPreds 释放lockPreds中加的锁
+func unlockPreds(preds *[skiplistMaxLevel]*skiplistNode, highestLocked int) {
+	var prevPred *skiplistNode
+	for level := 0; level <= highestLocked; level++ {
+		if preds[level] != prevPred {
+			preds[level].mu.Unlock()
+			prevPred = preds[level]
+		}
+	}
+}
+
+func (sl *SkipList) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
+	topLevel := randomLevel()
+	var preds, succs [skiplistMaxLevel]*skiplistNode
+	for {
+		if levelFound := sl.find(key, &preds, &succs); levelFound != -1 {
+			found := succs[levelFound]
+			if found.isMarked() {
+				//节点正在被删除，等删除完成之后重新插入
+				runtime.Gosched()
+				continue
+			}
+			//等待节点链接完成
+			for !found.isFullyLinked() {
+				runtime.Gosched()
+			}
+			found.mu.Lock()
+			if found.isMarked() {
+				found.mu.Unlock()
+				continue
+			}
+			packed := data.PackLogRecordPos(pos)
+			oldPos := (*data.PackedPos)(atomic.SwapPointer(&found.pos, unsafe.Pointer(&packed)))
+			found.mu.Unlock()
+			return oldPos.Unpack(), nil
+		}
+		//key不存在，锁住前驱节点之后插入新的节点
+		valid, highestLocked := lockPreds(&preds, &succs, topLevel, func(succ *skiplistNode) bool {
+			return succ == nil || !succ.isMarked()
+		})
+		if !valid {
+			//前驱节点被其他的写操作修改了，重新查找
+			unlockPreds(&preds, highestLocked)
+			continue
+		}
+		packed := data.PackLogRecordPos(pos)
+		node := newSkiplistNode(key, &packed, topLevel)
+		for level := 0; level < topLevel; level++ {
+			node.next[level] = unsafe.Pointer(succs[level])
+		}
+		for level := 0; level < topLevel; level++ {
+			preds[level].storeNext(level, node)
+		}
+		atomic.StoreInt32(&node.fullyLinked, 1)
+		unlockPreds(&preds, highestLocked)
+		atomic.AddInt64(&sl.size, 1)
+		atomic.AddInt64(&sl.memory, node.memoryUsage())
+		return nil, nil
+	}
+}
+
+func (sl *SkipList) Get(key []byte) (*data.LogRecordPos, error) {
+	pred := sl.head
+	for level := skiplistMaxLevel - 1; level >= 0; level-- {
+		curr := pred.loadNext(level)
+		for curr != nil && bytes.Compare(curr.key, key) < 0 {
+			pred = curr
+			curr = pred.loadNext(level)
+		}
+		if curr != nil && bytes.Equal(curr.key, key) {
+			//没有链接完成或者已经删除的节点对读不可见
+			if !curr.isFullyLinked() || curr.isMarked() {
+				return nil, nil
+			}
+			return curr.loadPos().Unpack(), nil
+		}
+	}
+	return nil, nil
+}
+
+func (sl *SkipList) Delete(key []byte) (*data.LogRecordPos, bool, error) {
+	var preds, succs [skiplistMaxLevel]*skiplistNode
+	var victim *skiplistNode
+	for {
+		levelFound := sl.find(key, &preds, &succs)
+		if victim == nil {
+			if levelFound == -1 {
+				return nil, false, nil
+			}
+			victim = succs[levelFound]
+			//只能删除链接完成的节点，并且要在节点的最高层找到它
+			if !victim.isFullyLinked() || victim.topLevel-1 != levelFound || victim.isMarked() {
+				return nil, false, nil
+			}
+			//先进行逻辑删除，标记之后其他的操作就看不到这个节点了
+			victim.mu.Lock()
+			if victim.isMarked() {
+				victim.mu.Unlock()
+				return nil, false, nil
+			}
+			atomic.StoreInt32(&victim.marked, 1)
+		}
+		//锁住前驱节点之后进行物理删除
+		valid, highestLocked := lockPreds(&preds, &succs, victim.topLevel, func(succ *skiplistNode) bool {
+			return succ == victim
+		})
+		if !valid {
+			unlockPreds(&preds, highestLocked)
+			continue
+		}
+		for level := victim.topLevel - 1; level >= 0; level-- {
+			preds[level].storeNext(level, victim.loadNext(level))
+		}
+		pos := victim.loadPos()
+		victim.mu.Unlock()
+		unlockPreds(&preds, highestLocked)
+		atomic.AddInt64(&sl.size, -1)
+		atomic.AddInt64(&sl.memory, -victim.memoryUsage())
+		return pos.Unpack(), true, nil
+	}
+}
+
+func (sl *SkipList) Size() int {
+	return int(atomic.LoadInt64(&sl.size))
+}
+
+//MemoryUsage 跳表占用内存的估算值
+func (sl *SkipList) MemoryUsage() int64 {
+	return atomic.LoadInt64(&sl.memory)
+}
+
+func (sl *SkipList) Iterator(reverse bool) (Iterator, error) {
+	return sl.RangeIterator(reverse, nil, nil)
+}
+
+func (sl *SkipList) RangeIterator(reverse bool, lowerBound, upperBound []byte) (Iterator, error) {
+	return newSkiplistIterator(sl, reverse, lowerBound, upperBound), nil
+}
+
+// Close 跳表不需要进行释放资源
+func (sl *SkipList) Close() error {
+	return nil
+}
+
+//定义一个跳表的索引迭代器
+type skiplistIterator struct {
+	currIndex int     //遍历到数组的哪一个下标
+	reverse   bool    //是否是一个反向的遍历
+	value     []*Item //存储范围内的key位置索引信息
+}
+
+func newSkiplistIterator(sl *SkipList, reverse bool, lowerBound, upperBound []byte) *skiplistIterator {
+	var values []*Item
+	//先找到第一个大于等于下边界的节点，然后沿着最底层向后遍历
+	pred := sl.head
+	if lowerBound != nil {
+		for level := skiplistMaxLevel - 1; level >= 0; level-- {
+			for curr := pred.loadNext(level); curr != nil && bytes.Compare(curr.key, lowerBound) < 0; curr = pred.loadNext(level) {
+				pred = curr
+			}
+		}
+	}
+	for curr := pred.loadNext(0); curr != nil; curr = curr.loadNext(0) {
+		if upperBound != nil && bytes.Compare(curr.key, upperBound) >= 0 {
+			//超过上边界之后就可以停止了
+			break
+		}
+		if !curr.isFullyLinked() || curr.isMarked() {
+			continue
+		}
+		values = append(values, &Item{key: curr.key, pos: *curr.loadPos()})
+	}
+	//如果逆向的话，就将数组翻转过来
+	if reverse {
+		for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+			values[i], values[j] = values[j], values[i]
+		}
+	}
+	return &skiplistIterator{
+		currIndex: 0,
+		reverse:   reverse,
+		value:     values,
+	}
+}
+
+//Rewind 重新回到迭代器的起点，即第一个位置
+func (si *skiplistIterator) Rewind() {
+	si.currIndex = 0
+}
+
+//Seek 根据传入的Key查找到第一个大于等于的目标key，根据从这个key开始遍历
+func (si *skiplistIterator) Seek(key []byte) {
+	start := si.currIndex
+	if si.Valid() {
+		if si.reverse {
+			si.currIndex = start + sort.Search(len(si.value)-start, func(i int) bool {
+				return bytes.Compare(si.value[i+start].key, key) <= 0
+			})
+		} else {
+			si.currIndex = start + sort.Search(len(si.value)-start, func(i int) bool {
+				return bytes.Compare(si.value[i+start].key, key) >= 0
+			})
+		}
+	}
+}
+
+//Next 跳转到下一个key
+func (si *skiplistIterator) Next() {
+	si.currIndex++
+}
+
+//Valid 是否有效，即时有已经遍历完了所有的Key，用来退出遍历
+func (si *skiplistIterator) Valid() bool {
+	return si.currIndex < len(si.value)
+}
+
+//Key 当前遍历位置的key数据
+func (si *skiplistIterator) Key() []byte {
+	return si.value[si.currIndex].key
+}
+
+//Value 当前遍历位置的value数据
+func (si *skiplistIterator) Value() *data.LogRecordPos {
+	return si.value[si.currIndex].pos.Unpack()
+}
+
+//Close 关闭迭代器，释放相应的资源
+func (si *skiplistIterator) Close() {
+	si.value = nil
+}
@@ -0,0 +1,208 @@
+package index
+
+import (
+	"FlexDB/data"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestSkipList_Put(t *testing.T) {
+	sl := NewSkiplist()
+	//插入一个边界数据
+	res, _ := sl.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	//前面没有数据，所以旧的数据应该是空
+	assert.Nil(t, res)
+
+	res2, _ := sl.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.Nil(t, res2)
+	res3, _ := sl.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3})
+	assert.NotNil(t, res3)
+	assert.Equal(t, uint32(1), res3.Fid)
+	assert.Equal(t, uint64(2), res3.Offset)
+	assert.Equal(t, 2, sl.Size())
+}
+
+func TestSkipList_Get(t *testing.T) {
+	sl := NewSkiplist()
+	assert.Nil(t, getPos(sl, []byte("not-exist")))
+	//插入一个边界数据
+	res, _ := sl.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.Nil(t, res)
+	//测试key=nil获得相应的数据
+	pos1, _ := sl.Get(nil)
+	assert.Equal(t, uint32(1), pos1.Fid)
+	assert.Equal(t, uint64(100), pos1.Offset)
+
+	//测试对一个key的重复使用获得的数据
+	res2, _ := sl.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.Nil(t, res2)
+	res3, _ := sl.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3})
+	assert.Equal(t, uint32(1), res3.Fid)
+	assert.Equal(t, uint64(2), res3.Offset)
+	pos2, _ := sl.Get([]byte("a"))
+	assert.Equal(t, uint32(1), pos2.Fid)
+	assert.Equal(t, uint64(3), pos2.Offset)
+}
+
+func TestSkipList_Delete(t *testing.T) {
+	sl := NewSkiplist()
+	res1, _ := sl.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.Nil(t, res1)
+	//删除一个nil对象
+	_, ok1, _ := sl.Delete(nil)
+	assert.True(t, ok1)
+
+	res3, _ := sl.Put([]byte("aaa"), &data.LogRecordPos{Fid: 22, Offset: 33})
+	assert.Nil(t, res3)
+	//删除一个aaa对象
+	res4, ok2, _ := sl.Delete([]byte("aaa"))
+	assert.True(t, ok2)
+	assert.Equal(t, uint32(22), res4.Fid)
+	assert.Equal(t, uint64(33), res4.Offset)
+	assert.Nil(t, getPos(sl, []byte("aaa")))
+
+	//删除一个不存在的对象
+	res5, ok3, _ := sl.Delete([]byte("aaa"))
+	assert.False(t, ok3)
+	assert.Nil(t, res5)
+	assert.Equal(t, 0, sl.Size())
+}
+
+func TestSkipList_Iterator(t *testing.T) {
+	sl := NewSkiplist()
+	//1.跳表为空的情况
+	iter1, _ := sl.Iterator(false)
+	assert.Equal(t, false, iter1.Valid())
+	iter1.Close()
+
+	//2.跳表有数据的情况
+	sl.Put([]byte("abcd"), &data.LogRecordPos{Fid: 1, Offset: 10})
+	iter2, _ := sl.Iterator(false)
+	assert.Equal(t, true, iter2.Valid())
+	assert.NotNil(t, iter2.Key())
+	assert.NotNil(t, iter2.Value())
+	iter2.Next()
+	assert.Equal(t, false, iter2.Valid())
+	iter2.Close()
+
+	//3.跳表有多条数据的情况
+	sl.Put([]byte("cccd"), &data.LogRecordPos{Fid: 1, Offset: 10})
+	sl.Put([]byte("asgh"), &data.LogRecordPos{Fid: 1, Offset: 10})
+	sl.Put([]byte("fakh"), &data.LogRecordPos{Fid: 1, Offset: 10})
+	sl.Put([]byte("mlas"), &data.LogRecordPos{Fid: 1, Offset: 10})
+	iter3, _ := sl.Iterator(true)
+	assert.Equal(t, []string{"mlas", "fakh", "cccd", "asgh", "abcd"}, collectKeys(iter3))
+	iter3.Close()
+
+	//4.测试 seek
+	iter4, _ := sl.Iterator(false)
+	iter4.Seek([]byte("bb"))
+	assert.Equal(t, "cccd", string(iter4.Key()))
+	iter4.Next()
+	iter4.Seek([]byte("bb"))
+	assert.Equal(t, "fakh", string(iter4.Key()))
+	iter4.Seek([]byte("zz"))
+	assert.False(t, iter4.Valid())
+	iter4.Close()
+}
+
+func TestSkipList_RangeIterator(t *testing.T) {
+	testRangeIterator(t, NewSkiplist())
+}
+
+//多个协程并发的写入和删除，最后的数据和串行执行的结果一致
+func TestSkipList_Concurrent(t *testing.T) {
+	sl := NewSkiplist()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := []byte(fmt.Sprintf("key-%d-%04d", g, i))
+				oldPos, _ := sl.Put(key, &data.LogRecordPos{Fid: uint32(g), Offset: uint64(i)})
+				assert.Nil(t, oldPos)
+				//同时读取其他协程写入的数据
+				sl.Get([]byte(fmt.Sprintf("key-%d-%04d", (g+1)%8, i)))
+				if i%2 == 0 {
+					pos, ok, _ := sl.Delete(key)
+					assert.True(t, ok)
+					assert.Equal(t, uint64(i), pos.Offset)
+				}
+			}
+		}(g)
+	}
+	//并发遍历，每次遍历的结果都是有序的
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			keys := collectKeys(newIter(sl, false))
+			for j := 1; j < len(keys); j++ {
+				assert.True(t, keys[j-1] < keys[j])
+			}
+		}
+	}()
+	wg.Wait()
+
+	assert.Equal(t, 8*500, sl.Size())
+	keys := collectKeys(newIter(sl, false))
+	assert.Equal(t, 8*500, len(keys))
+	for g := 0; g < 8; g++ {
+		for i := 0; i < 1000; i++ {
+			pos, _ := sl.Get([]byte(fmt.Sprintf("key-%d-%04d", g, i)))
+			if i%2 == 0 {
+				assert.Nil(t, pos)
+			} else {
+				assert.Equal(t, uint64(i), pos.Offset)
+			}
+		}
+	}
+}
+
+//benchmarkConcurrentGet 在有一个协程持续写入的情况下，并发读取索引
+func benchmarkConcurrentGet(b *testing.B, idx Indexer) {
+	const keyNum = 100000
+	for i := 0; i < keyNum; i++ {
+		idx.Put([]byte(fmt.Sprintf("key-%08d", i)), &data.LogRecordPos{Fid: 1, Offset: uint64(i)})
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			idx.Put([]byte(fmt.Sprintf("key-%08d", i%keyNum)), &data.LogRecordPos{Fid: 2, Offset: uint64(i)})
+		}
+	}()
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			idx.Get([]byte(fmt.Sprintf("key-%08d", r.Intn(keyNum))))
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+func BenchmarkSkipList_ConcurrentGet(b *testing.B) {
+	benchmarkConcurrentGet(b, NewSkiplist())
+}
+
+func BenchmarkBTree_ConcurrentGet(b *testing.B) {
+	benchmarkConcurrentGet(b, NewBtree())
+}
+
+func TestSkipList_MemoryUsage(t *testing.T) {
+	testMemoryUsage(t, NewSkiplist())
+}
@@ -0,0 +1,585 @@
+package FlexDB
+
+import (
+	"FlexDB/data"
+	"FlexDB/mvcc"
+	"FlexDB/wal"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+/*
+	索引wal
+	开启EnableWal之后，每次写入对内存索引和版本索引的修改都会写入到wal中，启动的时候重放wal，版本信息在重启之后仍然可见，内存索引也不需要重新扫描数据文件
+	wal按照generation保存在index-wal目录下以generation编号命名的子目录中，每个generation中是切换之后每次写入的修改，切换时候版本索引的快照保存在generation的snapshot目录中，快照写完之后是一条快照结束的记录
+	checkpoint的时候短暂的阻塞写操作，获得版本索引写时复制的快照并切换到一个新的generation，之后不阻塞写操作写入快照，checkpoint文件中记录这个generation，checkpoint写入完成之后删除之前的generation
+	启动的时候:
+	1.版本索引从最新的完整的generation中恢复，再重放之后的快照没有写完的generation中的修改，它们的快照在写完之前崩溃了，之前的generation仍然保留着
+	  之前的版本中快照写在generation的开头，切换之前就写完了，这样的generation快照没有写完的时候不会有其他的写入，直接删除
+	2.内存索引先加载checkpoint，再重放checkpoint记录的generation之后的索引修改，最后只扫描wal中没有记录的数据文件的尾部
+	merge之后数据文件中的位置发生了变化，checkpoint被删除，wal中的索引修改也就不会被重放，内存索引退化成从hint文件和数据文件中加载
+	B+树的索引本身就是持久化的，wal中只记录版本索引的修改
+*/
+
+const (
+	indexWalDirName    = "index-wal" //wal所在的目录
+	walSnapshotDirName = "snapshot"  //generation中保存版本索引快照的目录
+	walSnapshotBatch   = 1024        //写入版本索引快照的时候每条wal记录中最多的修改个数
+)
+
+type walEntryType = byte
+
+const (
+	walIndexPut         walEntryType = iota //内存索引中添加key的位置信息
+	walIndexDelete                          //内存索引中删除key，位置信息是删除记录的位置
+	walVersionPut                           //版本索引中添加一个版本
+	walVersionDelete                        //版本索引中添加一个墓碑
+	walSnapshotFinished                     //generation开头的版本索引快照写入完成
+)
+
+//walEntry wal记录中的一次修改
+type walEntry struct {
+	typ walEntryType
+	key []byte             //内存索引中的key或者用户的key
+	pos *data.LogRecordPos //内存索引修改的位置信息
+	rev mvcc.Revision      //版本索引修改的版本号
+}
+
+//walRecord 一条wal记录，一次写入中的所有修改放在同一条记录中
+type walRecord struct {
+	seqNo   uint64 //事务序列号
+	entries []walEntry
+}
+
+//encodeWalRecord 将一条wal记录进行编码
+//seqNo entryNum  type keySize key  posSize pos(内存索引的修改)或者revision(版本索引的修改)
+//变长    变长       1    变长     变长  变长     变长             16
+func encodeWalRecord(seqNo uint64, entries []walEntry) []byte {
+	size := binary.MaxVarintLen64 * 2
+	for _, entry := range entries {
+		size += 1 + binary.MaxVarintLen32*2 + len(entry.key) + binary.MaxVarintLen64*3 + binary.MaxVarintLen32 + revisionSize
+	}
+	buf := make([]byte, size)
+	var n = 0
+	n += binary.PutUvarint(buf[n:], seqNo)
+	n += binary.PutUvarint(buf[n:], uint64(len(entries)))
+	for _, entry := range entries {
+		buf[n] = entry.typ
+		n++
+		n += binary.PutUvarint(buf[n:], uint64(len(entry.key)))
+		n += copy(buf[n:], entry.key)
+		switch entry.typ {
+		case walIndexPut, walIndexDelete:
+			encPos := data.EncodeLogRecordPos(entry.pos)
+			n += binary.PutUvarint(buf[n:], uint64(len(encPos)))
+			n += copy(buf[n:], encPos)
+		case walVersionPut, walVersionDelete:
+			n += copy(buf[n:], entry.rev.Encode())
+		}
+	}
+	return buf[:n]
+}
+
+//decodeWalRecord 解码一条wal记录，记录不完整的时候返回ErrWalCorrupted
+func decodeWalRecord(buf []byte) (*walRecord, error) {
+	var offset = 0
+	readUvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(buf[offset:])
+		if n <= 0 {
+			return 0, ErrWalCorrupted
+		}
+		offset += n
+		return v, nil
+	}
+	readBytes := func(size uint64) ([]byte, error) {
+		if uint64(len(buf)-offset) < size {
+			return nil, ErrWalCorrupted
+		}
+		b := buf[offset : offset+int(size)]
+		offset += int(size)
+		return b, nil
+	}
+	seqNo, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	entryNum, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	record := &walRecord{seqNo: seqNo}
+	for i := uint64(0); i < entryNum; i++ {
+		typ, err := readBytes(1)
+		if err != nil {
+			return nil, err
+		}
+		entry := walEntry{typ: typ[0]}
+		keySize, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if entry.key, err = readBytes(keySize); err != nil {
+			return nil, err
+		}
+		switch entry.typ {
+		case walIndexPut, walIndexDelete:
+			posSize, err := readUvarint()
+			if err != nil {
+				return nil, err
+			}
+			encPos, err := readBytes(posSize)
+			if err != nil {
+				return nil, err
+			}
+			entry.pos = data.DecodeLogRecordPos(encPos)
+		case walVersionPut, walVersionDelete:
+			encRev, err := readBytes(revisionSize)
+			if err != nil {
+				return nil, err
+			}
+			entry.rev = mvcc.Revision{
+				Main: int64(binary.BigEndian.Uint64(encRev[:8])),
+				Sub:  int64(binary.BigEndian.Uint64(encRev[8:])),
+			}
+		case walSnapshotFinished:
+		default:
+			return nil, ErrWalCorrupted
+		}
+		record.entries = append(record.entries, entry)
+	}
+	return record, nil
+}
+
+//walGeneration 从磁盘中读取的一个generation
+type walGeneration struct {
+	gen      uint64
+	snapshot []walEntry  //切换到这个generation的时候版本索引的快照
+	complete bool        //版本索引的快照是否写入完成
+	separate bool        //快照是否单独保存在snapshot目录中，这样的generation在快照写完之前就会有其他的写入
+	records  []walRecord //快照之后每次写入的修改
+}
+
+//walGenerationDir 获得generation所在的目录
+func walGenerationDir(dirPath string, gen uint64) string {
+	return filepath.Join(dirPath, indexWalDirName, fmt.Sprintf("%09d", gen))
+}
+
+//walSnapshotDir 获得generation中保存版本索引快照的目录
+func walSnapshotDir(dirPath string, gen uint64) string {
+	return filepath.Join(walGenerationDir(dirPath, gen), walSnapshotDirName)
+}
+
+//listWalGenerations 获得目录中所有的generation编号，从小到大排序
+func listWalGenerations(dirPath string) ([]uint64, error) {
+	entries, err := os.ReadDir(filepath.Join(dirPath, indexWalDirName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var gens []uint64
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		gen, err := strconv.ParseUint(entry.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		gens = append(gens, gen)
+	}
+	sort.Slice(gens, func(i, j int) bool { return gens[i] < gens[j] })
+	return gens, nil
+}
+
+//openWalGeneration 打开一个generation的wal，目录不存在的时候会创建
+func (db *DB) openWalGeneration(gen uint64) (*wal.Wal, error) {
+	return db.openWal(walGenerationDir(db.options.DirPath, gen))
+}
+
+//openWal 打开目录中的wal，目录不存在的时候会创建
+func (db *DB) openWal(dirPath string) (*wal.Wal, error) {
+	walOpt := wal.DefaultWalOpt
+	walOpt.DirPath = dirPath
+	walOpt.Logger = db.options.Logger
+	//和数据文件一样，每次写入之后是否持久化
+	if db.options.SyncWrite {
+		walOpt.SyncPolicy = wal.SyncAlways
+	}
+	return wal.Open(walOpt)
+}
+
+//readWalGeneration 读取一个generation中的所有记录
+func (db *DB) readWalGeneration(gen uint64) (*walGeneration, error) {
+	generation := &walGeneration{gen: gen}
+	records, err := db.readWal(walGenerationDir(db.options.DirPath, gen))
+	if err != nil {
+		return nil, err
+	}
+	snapshotDir := walSnapshotDir(db.options.DirPath, gen)
+	if _, err := os.Stat(snapshotDir); err == nil {
+		generation.separate = true
+		generation.records = records
+		//快照单独保存的时候，generation中全部都是快照之后的修改
+		if records, err = db.readWal(snapshotDir); err != nil {
+			return nil, err
+		}
+	}
+	for i, record := range records {
+		for _, entry := range record.entries {
+			if entry.typ == walSnapshotFinished {
+				generation.complete = true
+			} else {
+				generation.snapshot = append(generation.snapshot, entry)
+			}
+		}
+		if generation.complete {
+			if !generation.separate {
+				generation.records = records[i+1:]
+			}
+			break
+		}
+	}
+	return generation, nil
+}
+
+//readWal 读取目录中的wal的所有记录，最后一条没有写完的记录会被忽略
+func (db *DB) readWal(dirPath string) ([]walRecord, error) {
+	w, err := db.openWal(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+	var records []walRecord
+	reader := w.NewReader(nil)
+	for {
+		encRecord, _, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		record, err := decodeWalRecord(encRecord)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *record)
+	}
+	return records, nil
+}
+
+//replayWal 启动的时候重放wal，恢复版本索引，并在checkpoint的基础上恢复内存索引，需要在加载checkpoint之后，扫描数据文件之前调用
+//重放之后打开最新的generation继续写入，没有完整的generation的时候创建一个新的generation
+func (db *DB) replayWal() error {
+	gens, err := listWalGenerations(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	var generations []*walGeneration
+	for _, gen := range gens {
+		generation, err := db.readWalGeneration(gen)
+		if err != nil {
+			return err
+		}
+		if !generation.complete && !generation.separate {
+			//之前的版本中切换generation的时候崩溃了，快照没有写完，这个generation中也不会有其他的写入
+			db.options.Logger.Warn("remove incomplete index wal generation", "dir", db.options.DirPath, "generation", gen)
+			if err := os.RemoveAll(walGenerationDir(db.options.DirPath, gen)); err != nil {
+				return err
+			}
+			continue
+		}
+		generations = append(generations, generation)
+	}
+	if len(generations) == 0 {
+		snapshot, err := db.rotateWal()
+		if err != nil {
+			return err
+		}
+		return db.writeWalSnapshot(db.walGen, snapshot)
+	}
+
+	//版本索引从最新的完整的generation的快照开始重放，之后的generation的快照没有写完，只重放其中的修改
+	//快照没有写完的generation之前的generation不会被删除，它们的修改连在一起就是全部的修改
+	var start int
+	for i, generation := range generations {
+		if generation.complete {
+			start = i
+		}
+	}
+	if generations[start].complete {
+		db.replayVersions(generations[start].snapshot)
+	}
+	for _, generation := range generations[start:] {
+		for _, record := range generation.records {
+			db.replayVersions(record.entries)
+		}
+	}
+	latest := generations[len(generations)-1]
+	if db.options.IndexType != BPT {
+		if err := db.replayWalIndex(generations); err != nil {
+			return err
+		}
+	}
+
+	w, err := db.openWalGeneration(latest.gen)
+	if err != nil {
+		return err
+	}
+	db.wal, db.walGen = w, latest.gen
+	return nil
+}
+
+//replayVersions 按照顺序重放版本索引的修改，同时恢复下一次使用的版本号
+func (db *DB) replayVersions(entries []walEntry) {
+	for _, entry := range entries {
+		switch entry.typ {
+		case walVersionPut:
+			db.versionIndex.Put(entry.key, entry.rev)
+		case walVersionDelete:
+			_, _ = db.versionIndex.Tombstone(entry.key, entry.rev)
+		default:
+			continue
+		}
+		if entry.rev.Main >= db.latestRevision {
+			db.latestRevision = entry.rev.Main + 1
+		}
+	}
+}
+
+//replayWalIndex 重放checkpoint之后的内存索引的修改，之后扫描数据文件的时候从wal记录到的位置开始
+//checkpoint不存在或者记录的generation已经被删除的时候，不重放索引的修改，从checkpoint的位置扫描数据文件
+func (db *DB) replayWalIndex(generations []*walGeneration) error {
+	if db.checkpoint == nil || db.checkpoint.walGen == 0 {
+		return nil
+	}
+	var start = -1
+	for i, generation := range generations {
+		if generation.gen == db.checkpoint.walGen {
+			start = i
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+	//wal覆盖到的数据文件的位置
+	end := *db.checkpoint
+	var (
+		ops     []*indexOp
+		lastPos *data.LogRecordPos //wal中记录的数据文件中最后一条记录的位置
+	)
+	for _, generation := range generations[start:] {
+		for _, record := range generation.records {
+			if record.seqNo > end.seqNo {
+				end.seqNo = record.seqNo
+			}
+			for _, entry := range record.entries {
+				if entry.typ != walIndexPut && entry.typ != walIndexDelete {
+					continue
+				}
+				typ := data.LogRecordNormal
+				if entry.typ == walIndexDelete {
+					typ = data.LogRecordDeleted
+				}
+				ops = append(ops, &indexOp{key: entry.key, typ: typ, pos: entry.pos})
+				offset := entry.pos.Offset + uint64(entry.pos.Size)
+				if entry.pos.Fid > end.fileId || (entry.pos.Fid == end.fileId && offset > end.offset) {
+					end.fileId, end.offset = entry.pos.Fid, offset
+					lastPos = entry.pos
+				}
+			}
+		}
+	}
+	//wal中最后的位置上没有完整的记录，说明数据文件没有持久化，仍然从checkpoint的位置扫描数据文件
+	//活跃文件是预分配的，崩溃之后文件的大小不是实际写入的位置，需要校验这条记录的crc
+	if lastPos != nil && !db.walPosPersisted(lastPos) {
+		db.options.Logger.Warn("ignore index wal beyond data files", "dir", db.options.DirPath, "fid", end.fileId, "offset", end.offset)
+		return nil
+	}
+	reclaimSize, err := db.applyShardOps(ops)
+	if err != nil {
+		return err
+	}
+	end.reclaimSize += reclaimSize
+	db.checkpoint = &end
+	db.options.Logger.Debug("replay index wal", "dir", db.options.DirPath, "ops", len(ops), "fid", end.fileId, "offset", end.offset)
+	return nil
+}
+
+//walPosPersisted 检查wal中记录的位置上的数据是否是一条完整的记录
+func (db *DB) walPosPersisted(pos *data.LogRecordPos) bool {
+	var dataFile *data.DataFile
+	if db.activeFile != nil && db.activeFile.FileId == pos.Fid {
+		dataFile = db.activeFile
+	} else {
+		dataFile = db.olderFile[pos.Fid]
+	}
+	if dataFile == nil {
+		return false
+	}
+	_, size, err := dataFile.ReadLogRecord(pos.Offset)
+	return err == nil && size == uint64(pos.Size)
+}
+
+//appendLogRecordWithWal 写入数据文件之后，在同一个临界区中将这次写入的修改写入到wal中
+//wal中索引修改的顺序和数据文件中的顺序一致，重放的时候wal记录到的位置之前的数据都已经在wal中了
+func (db *DB) appendLogRecordWithWal(logRecord *data.LogRecord, entries func(pos *data.LogRecordPos) []walEntry) (*data.LogRecordPos, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	pos, err := db.appendLogRecord(logRecord)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.writeWal(nonTransactionSeq, entries(pos)...); err != nil {
+		return nil, err
+	}
+	return pos, nil
+}
+
+//writeWal 将一次写入对索引和版本索引的修改写入到wal中，需要持有indexMu的读锁
+func (db *DB) writeWal(seqNo uint64, entries ...walEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	db.walMu.Lock()
+	defer db.walMu.Unlock()
+	if db.wal == nil {
+		return nil
+	}
+	_, err := db.wal.Write(encodeWalRecord(seqNo, entries))
+	return err
+}
+
+//rotateWal 切换到一个新的generation，并获得当前版本索引的快照，需要持有indexMu的写锁，保证快照之后的修改都写入到新的generation中
+//获得快照的代价和版本的数量无关，释放锁之后再通过writeWalSnapshot写入快照
+func (db *DB) rotateWal() (*mvcc.TreeIndex, error) {
+	gen := db.walGen + 1
+	//先创建快照的目录，启动的时候根据它判断这个generation在快照写完之前可能有其他的写入
+	if err := os.MkdirAll(walSnapshotDir(db.options.DirPath, gen), os.ModePerm); err != nil {
+		return nil, err
+	}
+	w, err := db.openWalGeneration(gen)
+	if err != nil {
+		_ = os.RemoveAll(walGenerationDir(db.options.DirPath, gen))
+		return nil, err
+	}
+	snapshot := db.versionIndex.Snapshot()
+
+	db.walMu.Lock()
+	defer db.walMu.Unlock()
+	if db.wal != nil {
+		if err := db.wal.Close(); err != nil {
+			db.options.Logger.Warn("fail to close index wal", "dir", db.options.DirPath, "generation", db.walGen, "err", err)
+		}
+	}
+	db.wal, db.walGen = w, gen
+	return snapshot, nil
+}
+
+//writeWalSnapshot 将切换到gen的时候版本索引的快照写入到generation的快照目录中，写完之后这个generation才是完整的
+//快照是写时复制的，写入的时候不需要持有锁，写操作可以继续写入到新的generation中
+//写入失败的时候generation仍然是不完整的，启动的时候会从之前完整的generation开始重放
+func (db *DB) writeWalSnapshot(gen uint64, snapshot *mvcc.TreeIndex) error {
+	w, err := db.openWal(walSnapshotDir(db.options.DirPath, gen))
+	if err != nil {
+		return err
+	}
+	var (
+		entries  []walEntry
+		writeErr error
+	)
+	flush := func() {
+		if writeErr == nil && len(entries) > 0 {
+			_, writeErr = w.Write(encodeWalRecord(nonTransactionSeq, entries))
+		}
+		entries = entries[:0]
+	}
+	snapshot.Ascend(func(key []byte, events []mvcc.Event) bool {
+		for _, event := range events {
+			typ := walVersionPut
+			if event.Tombstone {
+				typ = walVersionDelete
+			}
+			entries = append(entries, walEntry{typ: typ, key: key, rev: event.Rev})
+			if len(entries) >= walSnapshotBatch {
+				flush()
+			}
+		}
+		return writeErr == nil
+	})
+	entries = append(entries, walEntry{typ: walSnapshotFinished})
+	flush()
+	if writeErr == nil {
+		writeErr = w.Sync()
+	}
+	if err := w.Close(); writeErr == nil {
+		writeErr = err
+	}
+	return writeErr
+}
+
+//checkpointVersionWal B+树的索引不需要checkpoint，定期切换wal并删除之前的generation，新的generation的快照中包含了之前所有的版本信息
+func (db *DB) checkpointVersionWal() error {
+	if db.wal == nil {
+		return nil
+	}
+	db.indexMu.Lock()
+	snapshot, err := db.rotateWal()
+	gen := db.walGen
+	db.indexMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := db.writeWalSnapshot(gen, snapshot); err != nil {
+		return err
+	}
+	return db.truncateWal(gen)
+}
+
+//truncateWal 删除gen之前的所有generation，它们的修改都已经在checkpoint和gen的快照中了
+//这里没有使用Wal.TruncateBefore按照segment截断，每次checkpoint都会切换到一个新的generation，并写入切换时候所有版本信息的快照，
+//之前的generation中的记录已经全部被快照覆盖，可以整体删除，需要在gen的快照写完之后调用
+func (db *DB) truncateWal(gen uint64) error {
+	gens, err := listWalGenerations(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	for _, g := range gens {
+		if g >= gen {
+			break
+		}
+		if err := os.RemoveAll(walGenerationDir(db.options.DirPath, g)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//syncWal 持久化当前的wal
+func (db *DB) syncWal() error {
+	db.walMu.Lock()
+	defer db.walMu.Unlock()
+	if db.wal == nil {
+		return nil
+	}
+	return db.wal.Sync()
+}
+
+//closeWal 关闭当前的wal
+func (db *DB) closeWal() error {
+	db.walMu.Lock()
+	defer db.walMu.Unlock()
+	if db.wal == nil {
+		return nil
+	}
+	err := db.wal.Close()
+	db.wal = nil
+	return err
+}
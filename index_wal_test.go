@@ -0,0 +1,346 @@
+package FlexDB
+
+import (
+	"FlexDB/data"
+	"FlexDB/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+//重启之后历史版本仍然可以读取，删除的key仍然不可见
+func TestDB_IndexWal_Versions(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.EnableWal = true
+	opts.TimeCheckpoint = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put([]byte("a"), []byte("v1")))
+	rev1 := db.latestRevision
+	assert.Nil(t, db.Put([]byte("a"), []byte("v2")))
+	assert.Nil(t, db.Put([]byte("b"), []byte("v1")))
+	ok, err := db.Delete([]byte("b"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	wb := db.NewWriteBatch(DefaultWriteBatchOption, db.latestRevision)
+	assert.Nil(t, wb.Put([]byte("c"), []byte("v1"), db.latestRevision))
+	assert.Nil(t, wb.Commit())
+	latest := db.latestRevision
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	//版本号从wal中记录的最大版本号之后继续递增
+	assert.True(t, db.latestRevision >= latest)
+	val, err := db.GetVal([]byte("a"), rev1)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	val, err = db.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+	_, err = db.Get([]byte("b"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db.Get([]byte("c"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+
+	//重启之后的写入不会覆盖之前的版本
+	assert.Nil(t, db.Put([]byte("a"), []byte("v3")))
+	val, err = db.GetVal([]byte("a"), rev1)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	val, err = db.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v3"), val)
+}
+
+//checkpoint之后重放wal恢复的索引需要和重放全部数据得到的索引一致，checkpoint之后删除之前的generation
+func TestDB_IndexWal_Checkpoint(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.FileSize = 256 * 1024
+	opts.EnableWal = true
+	opts.TimeCheckpoint = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 3000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.checkpointIndex())
+	gens, err := listWalGenerations(DirPath)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{db.walGen}, gens)
+	assert.Equal(t, db.walGen, db.lastCheckpoint.walGen)
+
+	//checkpoint之后继续写入，包括覆盖写，删除和事务，跨越多个数据文件
+	for i := 2000; i < 6000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 500; i++ {
+		_, err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOption, db.latestRevision)
+	for i := 6000; i < 6500; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.RandomValue(64), int64(i)))
+	}
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Close())
+
+	//从checkpoint和wal恢复
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	fromWal := indexPositions(db)
+	reclaimFromWal := db.reclaimSize
+	seqNoFromWal := db.seqNo
+	assert.Nil(t, db.Close())
+
+	//删除checkpoint之后重放全部的数据
+	assert.Nil(t, os.Remove(filepath.Join(DirPath, data.IndexCheckpointFileName)))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, fromWal, indexPositions(db))
+	assert.Equal(t, reclaimFromWal, db.reclaimSize)
+	assert.Equal(t, seqNoFromWal, db.seqNo)
+	_, err = db.Get(utils.GetTestKey(100))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(utils.GetTestKey(6100))
+	assert.Nil(t, err)
+}
+
+//之前的版本中快照写在generation的开头，切换generation的时候崩溃留下的不完整的generation会被删除
+func TestDB_IndexWal_IncompleteGeneration(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.EnableWal = true
+	opts.TimeCheckpoint = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("a"), []byte("v1")))
+	gen := db.walGen
+	assert.Nil(t, db.Close())
+
+	//只写入了一部分快照的generation
+	w, err := db.openWalGeneration(gen + 1)
+	assert.Nil(t, err)
+	_, err = w.Write(encodeWalRecord(nonTransactionSeq, []walEntry{{typ: walVersionPut, key: []byte("a")}}))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, gen, db.walGen)
+	gens, err := listWalGenerations(DirPath)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{gen}, gens)
+	val, err := db.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+}
+
+//切换generation之后快照写完之前崩溃，之后的写入都在新的generation中，重启的时候从之前完整的generation开始重放
+func TestDB_IndexWal_IncompleteSnapshot(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.EnableWal = true
+	opts.TimeCheckpoint = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("a"), []byte("a1")))
+	assert.Nil(t, db.Put([]byte("c"), []byte("c1")))
+	gen := db.walGen
+
+	//切换generation之后没有写入快照
+	db.indexMu.Lock()
+	_, err = db.rotateWal()
+	db.indexMu.Unlock()
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("b"), []byte("b1")))
+	_, err = db.Delete([]byte("a"))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("c"), []byte("c2")))
+	assert.Nil(t, db.Close())
+
+	check := func() {
+		_, err := db.Get([]byte("a"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		val, err := db.Get([]byte("b"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("b1"), val)
+		val, err = db.Get([]byte("c"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("c2"), val)
+	}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, gen+1, db.walGen)
+	gens, err := listWalGenerations(DirPath)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{gen, gen + 1}, gens)
+	check()
+
+	//之后的checkpoint写完快照之后删除之前的generation
+	assert.Nil(t, db.checkpointIndex())
+	gens, err = listWalGenerations(DirPath)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{gen + 2}, gens)
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check()
+}
+
+//写入版本索引快照的时候不阻塞写操作，checkpoint期间并发的写入和删除在重启之后都可见
+func TestDB_IndexWal_CheckpointConcurrentWrites(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.EnableWal = true
+	opts.TimeCheckpoint = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("v1")))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			if i%2 == 0 {
+				_, err := db.Delete(utils.GetTestKey(i))
+				assert.Nil(t, err)
+			} else {
+				assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("v2")))
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, db.checkpointIndex())
+	}
+	wg.Wait()
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		if i%2 == 0 {
+			assert.Equal(t, ErrKeyNotFound, err)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("v2"), val)
+		}
+	}
+}
+
+//崩溃的时候wal已经持久化，但是预分配的活跃文件中对应的数据没有持久化，重放的时候忽略wal中超过数据文件的修改
+func TestDB_IndexWal_AheadOfData(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.FileSize = 1024 * 1024
+	opts.EnableWal = true
+	opts.TimeCheckpoint = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.checkpointIndex())
+	for i := 100; i < 200; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	fid, persisted := db.activeFile.FileId, db.activeFile.WriteOff
+	for i := 200; i < 300; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.Close())
+
+	//数据文件只持久化到persisted，之后是预分配的0
+	fileName := data.GetDataFileName(DirPath, fid)
+	assert.Nil(t, os.Truncate(fileName, int64(persisted)))
+	assert.Nil(t, os.Truncate(fileName, int64(opts.FileSize)))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, persisted, db.activeFile.WriteOff)
+	_, err = db.Get(utils.GetTestKey(150))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(250))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.Put([]byte("a"), []byte("v1")))
+	assert.Nil(t, db.Close())
+
+	//没有checkpoint的时候扫描全部的数据文件，之后写入的数据不会丢失
+	assert.Nil(t, os.Remove(filepath.Join(DirPath, data.IndexCheckpointFileName)))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	val, err := db.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	_, err = db.Get(utils.GetTestKey(150))
+	assert.Nil(t, err)
+}
+
+//旧版本的批量写入在数据文件中保存的是原始的key，没有追加版本号，重启的时候仍然可以正常打开，新格式的数据不受影响
+func TestDB_IndexWal_OldBatchFormat(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.EnableWal = true
+	opts.TimeCheckpoint = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	//按照旧的格式写入一个事务
+	oldSeqNo := atomic.AddUint64(&db.seqNo, 1)
+	db.mu.Lock()
+	_, err = db.appendLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeq([]byte("old"), oldSeqNo),
+		Value: []byte("v1"),
+		Type:  data.LogRecordNormal,
+	})
+	assert.Nil(t, err)
+	_, err = db.appendLogRecord(&data.LogRecord{
+		Key:  logRecordKeyWithSeq(txnFinKey, oldSeqNo),
+		Type: data.LogRecordTxnFinished,
+	})
+	assert.Nil(t, err)
+	db.mu.Unlock()
+
+	wb := db.NewWriteBatch(DefaultWriteBatchOption, db.latestRevision)
+	assert.Nil(t, wb.Put([]byte("new"), []byte("v2"), db.latestRevision))
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Put([]byte("put"), []byte("v3")))
+	assert.Nil(t, db.Close())
+
+	//从checkpoint和wal恢复，以及删除checkpoint之后重放全部的数据
+	for i := 0; i < 2; i++ {
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		assert.True(t, db.seqNo > oldSeqNo)
+		//旧格式的记录没有版本号，不会被当成某个版本的数据读取到
+		_, err = db.Get([]byte("old"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		val, err := db.Get([]byte("new"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v2"), val)
+		val, err = db.Get([]byte("put"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v3"), val)
+		assert.Nil(t, db.Close())
+		assert.Nil(t, os.RemoveAll(filepath.Join(DirPath, data.IndexCheckpointFileName)))
+	}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+}
@@ -3,70 +3,120 @@ package FlexDB
 import (
 	"FlexDB/data"
 	"FlexDB/index"
+	"FlexDB/mvcc"
 	"bytes"
 	"container/heap"
+	"math"
+	"sync/atomic"
 )
 
-var maxHeap bool //用来判断用户的迭代器是希望正序还是倒序，由此创建小堆或者大堆
-
 /*
 	由于我们原来的索引有多个，所以我们现在需要对多个索引数据进行有序迭代，这里我们使用最小堆来实现，每次取出迭代器中的第一个元素加入到堆顶中，因为堆顶的成功最小的元素，所以我们可以保证每次取出的元素都是最小的元素，这样就可以实现多个索引的有序迭代
-
+	索引中的key是用户的key+版本号，同一个用户key的多个版本在索引中一般是相邻的(可能分布在不同的索引实例中)
+	二进制的key中，以一个key为前缀的更长的key(例如k和k\x00)的版本可能和它的版本交错，取出一个key的版本的时候按照版本号的范围取出，交错的其他key重新放回到堆中
+	迭代器每次从堆顶取出同一个用户key的所有版本，根据versionIndex找到读版本号下可见的版本，只返回这一个版本，已经被删除的key会被跳过
+	这样迭代器返回的key和value就和Get得到的结果一致
+	迭代器创建的时候会获得每个索引的快照以及一个读版本号，之后的写入对迭代器不可见，多个迭代器之间没有共享的状态，可以并发使用
 */
 
 // Iterator 供用户使用的迭代器
 type Iterator struct {
 	options    IteratorOptions
 	db         *DB
-	iters      ItemHeap //最小堆，里面维护了多个索引的迭代器
+	iters      ItemHeap //堆，里面维护了多个索引的迭代器，正序遍历的时候是小堆，反序遍历的时候是大堆
 	indexIters map[string]index.Iterator
+	lowerBound []byte             //遍历的下边界(包含)，由LowerBound和Prefix共同决定
+	upperBound []byte             //遍历的上边界(不包含)，由UpperBound和Prefix共同决定
+	readRev    int64              //读版本号，只能看到在这个版本号之前写入的数据
+	maxRev     []byte             //读版本号下可见的最大的版本号编码之后的数据
+	lastKey    []byte             //正向遍历的时候上一个处理过的用户key，之后只会处理比它大的key
+	seekKey    []byte             //正向遍历的时候Seek的目标，之后只会处理不小于它的key
+	currKey    []byte             //当前遍历位置的用户key
+	currPos    *data.LogRecordPos //当前遍历位置的key可见版本的位置信息
+	err        error              //创建索引迭代器时出现的错误，出错的迭代器总是无效的
 }
 
 // Node 定义一个结构体，用来存储堆中的数据
 type Node struct {
-	key  []byte         //这个key的数据
-	iter index.Iterator //这个key所在的索引迭代器，当前迭代器中存储了这个索引中的所有元素
+	key  []byte             //这个key的数据
+	iter index.Iterator     //这个key所在的索引迭代器，当前迭代器中存储了这个索引中的所有元素，从堆中取出之后为空
+	pos  *data.LogRecordPos //从堆中取出之后保存的位置信息，取出的其他key的索引项重新放回到堆中的时候使用
 }
 
-type ItemHeap []*Node
+//ItemHeap 每个迭代器有自己的堆，排序的方向保存在堆中，不同方向的迭代器之间互不影响
+type ItemHeap struct {
+	nodes   []*Node
+	reverse bool //是否是大堆，反序遍历的时候使用大堆
+}
 
-func (h ItemHeap) Len() int {
-	return len(h)
+func (h *ItemHeap) Len() int {
+	return len(h.nodes)
 }
 
 // Less 根据用户指定的reverse与否来决定是大堆还是小堆
-func (h ItemHeap) Less(i, j int) bool {
-	if maxHeap {
+func (h *ItemHeap) Less(i, j int) bool {
+	if h.reverse {
 		//大堆
-		return bytes.Compare(h[i].key, h[j].key) >= 0
+		return bytes.Compare(h.nodes[i].key, h.nodes[j].key) >= 0
 	} else {
 		//小堆
-		return bytes.Compare(h[i].key, h[j].key) <= 0
+		return bytes.Compare(h.nodes[i].key, h.nodes[j].key) <= 0
 	}
 }
-func (h ItemHeap) Swap(i, j int) {
-	h[i], h[j] = h[j], h[i]
+func (h *ItemHeap) Swap(i, j int) {
+	h.nodes[i], h.nodes[j] = h.nodes[j], h.nodes[i]
 }
 func (h *ItemHeap) Push(item interface{}) {
-	*h = append(*h, item.(*Node))
+	h.nodes = append(h.nodes, item.(*Node))
 }
 func (h *ItemHeap) Pop() interface{} {
-	old := *h
+	old := h.nodes
 	n := len(old)    //获得元素的个数
 	item := old[n-1] //
 	old[n-1] = nil   //避免内存泄漏
-	*h = old[0 : n-1]
+	h.nodes = old[0 : n-1]
 	return item
 }
 
+//top 获得堆顶的元素
+func (h *ItemHeap) top() *Node {
+	return h.nodes[0]
+}
+
+//reset 清空堆中的元素
+func (h *ItemHeap) reset() {
+	h.nodes = h.nodes[:0]
+}
+
 // NewIterator 初始化迭代器
 func (db *DB) NewIterator(options IteratorOptions) *Iterator {
+	//没有指定读版本号的时候，读取最新的数据
+	//先确定读版本号再获得索引的快照，读版本号之前写入完成的数据一定在快照中
+	readRev := options.Revision
+	if readRev <= 0 {
+		readRev = atomic.LoadInt64(&db.latestRevision)
+	}
 	//更新迭代器
-	indexIters := make(map[string]index.Iterator, db.options.indexNum)
-	maxHeap = options.Reverse
-	for name, index := range db.index {
-		indexIter := index.Iterator(options.Reverse) //获得索引的迭代器
-		indexIter.Rewind()                           //将每个迭代器进行初始化
+	shards := db.indexShards()
+	//把前缀也转化成边界，和用户指定的边界一起下推到每个索引中，索引只需要返回范围内的数据
+	//范围分片的时候只需要遍历和边界有交集的索引实例，分片和索引一样按照带版本号的key划分
+	lowerBound, upperBound := options.bounds()
+	indexLower, indexUpper := options.indexBounds()
+	nodes := shards.router.routeRange(indexLower, indexUpper)
+	indexIters := make(map[string]index.Iterator, len(nodes))
+	var err error
+	for _, name := range nodes {
+		index := shards.index[name]
+		indexIter, iterErr := index.RangeIterator(options.Reverse, indexLower, indexUpper) //获得索引的迭代器
+		if iterErr != nil {
+			//关闭已经创建的索引迭代器，返回一个无效的迭代器
+			for _, indexIter := range indexIters {
+				indexIter.Close()
+			}
+			indexIters, err = nil, indexReadError(iterErr)
+			break
+		}
+		indexIter.Rewind() //将每个迭代器进行初始化
 		indexIters[name] = indexIter
 	}
 
@@ -74,9 +124,14 @@ func (db *DB) NewIterator(options IteratorOptions) *Iterator {
 		db:         db,
 		options:    options,
 		indexIters: indexIters,
+		lowerBound: lowerBound,
+		upperBound: upperBound,
+		readRev:    readRev,
+		maxRev:     (&mvcc.Revision{Main: readRev, Sub: math.MaxInt64}).Encode(),
+		iters:      ItemHeap{reverse: options.Reverse},
+		err:        err,
 	}
 	resiter.Rewind()
-	heap.Init(&resiter.iters)
 
 	return resiter
 
@@ -84,19 +139,34 @@ func (db *DB) NewIterator(options IteratorOptions) *Iterator {
 
 //Rewind 重新回到迭代器的起点，即第一个位置,清空迭代器中的元素，并且添加一些元素进去
 func (it *Iterator) Rewind() {
-	//先清空堆里面的元素
-	for it.Valid() {
-		heap.Pop(&it.iters)
-	}
 	//将每个迭代器都进行初始化，设置成首个元素,并且添加每个迭代器的首元素进入到堆中
 	for _, indexIter := range it.indexIters {
 		indexIter.Rewind() //将每个索引迭代器都回到起点位置
+	}
+	it.lastKey, it.seekKey = nil, nil
+	it.rebuildHeap(nil)
+	//找到第一个可见的key
+	it.skipToNext()
+}
+
+//rebuildHeap 清空堆，并将每个索引迭代器当前的元素重新加入到堆中
+//重新放回到堆中的索引项已经不在索引迭代器中了，只保留满足keep的部分，keep为空的时候全部丢弃
+func (it *Iterator) rebuildHeap(keep func(key []byte) bool) {
+	var stashed []*Node
+	if keep != nil {
+		for _, node := range it.iters.nodes {
+			if node.iter == nil && keep(node.key) {
+				stashed = append(stashed, node)
+			}
+		}
+	}
+	it.iters.reset()
+	for _, indexIter := range it.indexIters {
 		//添加节点到堆中
 		it.addNode(indexIter)
 	}
-	//将堆里面的数据清空
-	//如果有指定前缀，就需要直接跳转到指定位置，否则就没有操作
-	it.skipToNext()
+	it.iters.nodes = append(it.iters.nodes, stashed...)
+	heap.Init(&it.iters)
 }
 
 //addNode  向heap中添加数据
@@ -110,52 +180,35 @@ func (it *Iterator) addNode(indexIter index.Iterator) {
 	}
 }
 
-//adjustHeapBeforeSeek 在seek执行前删除干扰的元素
-func (it *Iterator) adjustHeapBeforeSeek(key []byte) {
-	for it.Valid() {
-		if it.options.Reverse {
-			//如果是从大到小，那么
-			if bytes.Compare(it.Key(), key) >= 0 {
-				//可以删除堆里面的元素了
-				heap.Pop(&it.iters)
-			} else {
-				break
-			}
-		} else {
-			//如果是从小到大，那么堆顶的，比key小的都可以删除
-			if bytes.Compare(it.Key(), key) <= 0 {
-				//可以删除堆里面的元素了
-				heap.Pop(&it.iters)
-			} else {
-				break
-			}
-		}
-	}
-}
-
 //Seek 根据传入的Key查找到第一个大于等于的目标key，根据从这个key开始遍历
+//反向遍历的时候查找到第一个小于等于目标的key，seek只会从当前的位置向后移动
 func (it *Iterator) Seek(key []byte) {
-	//需要将堆里面不符合小于key的都先删除掉
-	it.adjustHeapBeforeSeek(key)
-
-	for _, indexIter := range it.indexIters {
-		var valueBefore *data.LogRecordPos
-		if !indexIter.Valid() {
-			//如果之前不合理就直接跳过
-			continue
+	if it.Valid() {
+		cmp := bytes.Compare(it.currKey, key)
+		if (!it.options.Reverse && cmp >= 0) || (it.options.Reverse && cmp <= 0) {
+			//当前的位置已经满足要求了
+			return
 		}
-		//到这里的值，之前的一定都跳过
-		valueBefore = indexIter.Value()
-		indexIter.Seek(key) //每个元素都往后走一个位置，并且把这个元素添加进去,并且把比他小的全部
-		//在indexiter合理的情况之下fid不同可以直接加入，如果fid相同，那么offset不同也可以加入
-		if indexIter.Valid() && (valueBefore.Fid != indexIter.Value().Fid || valueBefore.Offset != indexIter.Value().Offset) {
-			//seek之前和seek之后的坐标不同才能插入这个元素
-			it.addNode(indexIter)
+	}
+	//索引中的key带有版本号，反向遍历的时候需要包含目标key的所有版本
+	target := key
+	if it.options.Reverse {
+		target = make([]byte, len(key)+revisionSize)
+		copy(target, key)
+		for i := len(key); i < len(target); i++ {
+			target[i] = 0xff
 		}
 	}
-
-	//找到的话，就要把前面的删除掉
-	//如果有指定前缀，就需要直接跳转到指定位置，否则就没有操作
+	for _, indexIter := range it.indexIters {
+		indexIter.Seek(target)
+	}
+	it.seekKey = append([]byte(nil), key...)
+	it.rebuildHeap(func(nodeKey []byte) bool {
+		if it.options.Reverse {
+			return bytes.Compare(nodeKey, target) <= 0
+		}
+		return bytes.Compare(nodeKey, target) >= 0
+	})
 	it.skipToNext()
 }
 
@@ -165,38 +218,66 @@ func (it *Iterator) Next() {
 	if !it.Valid() {
 		return
 	}
-	node := heap.Pop(&it.iters).(*Node) //把里面的元素删除掉
-	//b+树的这个有问题，插入了相同位置
-	node.iter.Next()
-	it.addNode(node.iter)
-
-	//	//如果有指定前缀，就需要直接跳转到指定位置，否则就没有操作
 	it.skipToNext()
 }
 
+//next 取出堆顶的元素，并将它所在的索引迭代器向后移动一个位置
+//返回的元素中保存了位置信息，不再和索引迭代器关联，可以重新放回到堆中
+func (it *Iterator) next() *Node {
+	node := heap.Pop(&it.iters).(*Node) //把里面的元素删除掉
+	if node.iter != nil {
+		node.pos = node.iter.Value()
+		//b+树的这个有问题，插入了相同位置
+		node.iter.Next()
+		it.addNode(node.iter)
+		node.iter = nil
+	}
+	return node
+}
+
 //Valid 是否有效，即时有已经遍历完了所有的Key，用来退出遍历
 func (it *Iterator) Valid() bool {
-	return len(it.iters) > 0 //最小堆里面存在元素即有效
+	return it.currKey != nil
+}
+
+//Err 创建迭代器的时候读取索引出现的错误，Valid返回false的时候可以通过它区分遍历结束和出错
+func (it *Iterator) Err() error {
+	return it.err
 }
 
-//Key 当前遍历位置的key数据
+//Key 当前遍历位置的key数据，是用户写入的原始key
 func (it *Iterator) Key() []byte {
-	return it.iters[0].key
+	return it.currKey
 }
 
-//Value 当前遍历位置的value数据
+//Value 当前遍历位置的value数据，KeysOnly的迭代器返回空
 func (it *Iterator) Value() []byte {
-	node := it.iters[0] //获得堆顶的节点
-	logRecordPos := node.iter.Value()
-	it.db.mu.RLock()
-	defer it.db.mu.RUnlock()
-	val, err := it.db.getValueByPos(logRecordPos)
+	val, err := it.value()
 	if err != nil {
 		return nil
 	}
 	return val
 }
 
+//value 当前遍历位置的value数据,读取失败的时候返回错误
+func (it *Iterator) value() ([]byte, error) {
+	if it.options.KeysOnly {
+		return nil, nil
+	}
+	it.db.mu.RLock()
+	defer it.db.mu.RUnlock()
+	return it.db.getValueByPos(it.currPos)
+}
+
+//ValueSize 当前遍历位置的value的大小，根据内存索引中的位置信息计算，不会读取数据文件
+func (it *Iterator) ValueSize() uint32 {
+	if it.currPos == nil {
+		return 0
+	}
+	//数据文件中的key是事务序列号+用户的key+版本号，事务序列号的长度记录在位置信息中
+	return it.currPos.ValueSize(len(it.currKey) + revisionSize)
+}
+
 //Close 关闭迭代器，释放相应的资源
 func (it *Iterator) Close() {
 	for _, indexIter := range it.indexIters {
@@ -205,19 +286,195 @@ func (it *Iterator) Close() {
 
 }
 
-//skipToNext 用于如果指定prefix的话，需要找到指定前缀的key
+//skipToNext 从堆中找到下一个符合要求的用户key，并且定位到它在读版本号下可见的版本
+//跳过不满足前缀和边界要求的key以及在读版本号下不可见(不存在或者已经删除)的key
+//遍历到了终点方向的边界之外，后面的key都不会满足要求，直接结束遍历
 func (it *Iterator) skipToNext() {
-	prefixLen := len(it.options.Prefix)
-	if prefixLen == 0 {
-		return
+	it.currKey, it.currPos = nil, nil
+	for it.iters.Len() > 0 {
+		key, visibleRev, versions := it.popVersions()
+		if it.pastEnd(key) {
+			//清空堆，迭代器变成无效
+			it.iters.reset()
+			return
+		}
+		//只保留可见的那一个版本
+		//可见的版本可能是迭代器创建之后才写入索引的，不在索引快照中，这时候使用快照中不超过它的最新版本
+		var currRev []byte
+		for _, node := range versions {
+			_, rev := parseKeyWithRevision(node.key)
+			if visibleRev != nil && bytes.Compare(rev, visibleRev) <= 0 && bytes.Compare(rev, currRev) > 0 {
+				currRev = rev
+				it.currPos = node.pos
+			}
+		}
+		if it.currPos != nil {
+			//拷贝一份，避免用户修改索引中的数据
+			it.currKey = append([]byte(nil), key...)
+			return
+		}
+	}
+}
+
+//popVersions 从堆中取出下一个用户key的版本，返回这个key，它在读版本号下可见的版本号，以及取出的版本的索引项
+//除了相邻的版本之外，正向遍历的时候取出所有不超过这个key的可见版本的索引项，保证可见的版本都被取出
+//反向遍历的时候取出所有不小于堆顶key的最小版本的索引项，这个范围包含了以堆顶key为前缀的更长的key的全部版本，它们更大，先返回其中最大的key
+//范围中其他key的索引项重新放回到堆中
+func (it *Iterator) popVersions() ([]byte, []byte, []*Node) {
+	key, _ := parseKeyWithRevision(it.iters.top().key)
+	var visibleRev, bound []byte
+	if it.options.Reverse {
+		bound = make([]byte, len(key)+revisionSize)
+		copy(bound, key)
+	} else {
+		key, visibleRev = it.lowestKey(it.iters.top().key, key)
+		it.lastKey = key
+		if visibleRev != nil {
+			bound = make([]byte, 0, len(key)+revisionSize)
+			bound = append(append(bound, key...), visibleRev...)
+		}
 	}
-	for len(it.iters) > 0 {
-		key := it.Key()
-		if prefixLen <= len(key) && bytes.Compare(it.options.Prefix, key[:prefixLen]) == 0 {
-			//前缀符合要求就可以跳出查找了
+	var nodes []*Node
+	for it.iters.Len() > 0 {
+		nodeKey, _ := parseKeyWithRevision(it.iters.top().key)
+		if !bytes.Equal(nodeKey, key) && (bound == nil || !it.inRevisionBound(it.iters.top().key, bound)) {
 			break
 		}
-		//前缀相同才可以
-		it.Next()
+		nodes = append(nodes, it.next())
+	}
+	if it.options.Reverse {
+		for _, node := range nodes {
+			if nodeKey, _ := parseKeyWithRevision(node.key); bytes.Compare(nodeKey, key) > 0 {
+				key = nodeKey
+			}
+		}
+		visibleRev = it.visibleRev(key)
+	}
+	versions := nodes[:0]
+	for _, node := range nodes {
+		if nodeKey, _ := parseKeyWithRevision(node.key); bytes.Equal(nodeKey, key) {
+			versions = append(versions, node)
+		} else {
+			heap.Push(&it.iters, node)
+		}
+	}
+	return key, visibleRev, versions
+}
+
+//lowestKey 正向遍历的时候，堆顶key的前缀(例如k\x00的前缀k)更小，但是它的版本可能排在堆顶之后，这时候需要先处理前缀
+//去掉前缀之后剩余的部分大于最大的可见版本号的时候，前缀的可见版本一定排在堆顶之前，不需要检查
+//返回需要处理的用户key以及它在读版本号下可见的版本号
+func (it *Iterator) lowestKey(top, key []byte) ([]byte, []byte) {
+	for i := 1; i < len(key); i++ {
+		prefix, rest := key[:i], key[i:]
+		n := len(rest)
+		if n > revisionSize {
+			n = revisionSize
+		}
+		if bytes.Compare(rest[:n], it.maxRev[:n]) > 0 || !it.unprocessed(prefix) {
+			continue
+		}
+		//前缀的可见版本在堆顶之后，说明它还没有被处理过
+		if rev := it.visibleRev(prefix); rev != nil && bytes.Compare(top, append(prefix[:i:i], rev...)) < 0 {
+			return prefix, rev
+		}
+	}
+	return key, it.visibleRev(key)
+}
+
+//unprocessed 判断正向遍历的时候key是否在上一个处理过的key和Seek的目标之后
+func (it *Iterator) unprocessed(key []byte) bool {
+	return (it.lastKey == nil || bytes.Compare(key, it.lastKey) > 0) && bytes.Compare(key, it.seekKey) >= 0
+}
+
+//inRevisionBound 判断索引中的key是否在取出版本的范围之内，正向遍历的时候不超过bound，反向遍历的时候不小于bound
+func (it *Iterator) inRevisionBound(key, bound []byte) bool {
+	if it.options.Reverse {
+		return bytes.Compare(key, bound) >= 0
+	}
+	return bytes.Compare(key, bound) <= 0
+}
+
+//visibleRev 获得用户key在读版本号下可见的版本号编码之后的数据，不满足前缀和边界要求或者不可见的时候返回空
+func (it *Iterator) visibleRev(key []byte) []byte {
+	if !it.inBound(key) || !bytes.HasPrefix(key, it.options.Prefix) {
+		return nil
+	}
+	if rev, err := it.db.VersionGet(key, it.readRev); err == nil && rev != nil {
+		return rev.Encode()
+	}
+	return nil
+}
+
+//inBound 判断key是否在[lowerBound, upperBound)的范围内
+func (it *Iterator) inBound(key []byte) bool {
+	if it.lowerBound != nil && bytes.Compare(key, it.lowerBound) < 0 {
+		return false
+	}
+	if it.upperBound != nil && bytes.Compare(key, it.upperBound) >= 0 {
+		return false
+	}
+	return true
+}
+
+//pastEnd 判断key是否已经超过了遍历方向上的终点边界
+func (it *Iterator) pastEnd(key []byte) bool {
+	if it.options.Reverse {
+		return it.lowerBound != nil && bytes.Compare(key, it.lowerBound) < 0
+	}
+	return it.upperBound != nil && bytes.Compare(key, it.upperBound) >= 0
+}
+
+//bounds 根据用户指定的边界和前缀计算实际遍历的范围[lowerBound, upperBound)
+func (options IteratorOptions) bounds() ([]byte, []byte) {
+	return options.withPrefix(options.LowerBound, options.UpperBound)
+}
+
+//indexBounds 计算下推到索引中的范围，索引中的key是用户key+版本号，这个范围比实际遍历的范围更大，迭代器中再按照用户key过滤
+//下边界的key的所有版本都不小于下边界，直接使用，上边界的前缀(例如ab\x00的前缀ab)加上版本号之后可能超过上边界，需要放宽
+func (options IteratorOptions) indexBounds() ([]byte, []byte) {
+	return options.withPrefix(options.LowerBound, indexUpperBound(options.UpperBound))
+}
+
+//withPrefix 将前缀对应的范围和边界取交集
+func (options IteratorOptions) withPrefix(lowerBound, upperBound []byte) ([]byte, []byte) {
+	if len(options.Prefix) == 0 {
+		return lowerBound, upperBound
+	}
+	//前缀对应的范围是[prefix, prefix的后继)
+	if lowerBound == nil || bytes.Compare(options.Prefix, lowerBound) > 0 {
+		lowerBound = options.Prefix
+	}
+	if prefixEnd := prefixSuccessor(options.Prefix); prefixEnd != nil && (upperBound == nil || bytes.Compare(prefixEnd, upperBound) < 0) {
+		upperBound = prefixEnd
+	}
+	return lowerBound, upperBound
+}
+
+//indexUpperBound 获得大于所有比upperBound小的用户key加上版本号之后的最小边界
+//只有upperBound的前缀加上版本号之后可能超过它，版本号的第一个字节(非负int64的最高字节)不超过0x7f
+//所以upperBound[:i]的所有版本都小于upperBound[:i]+0x80，取其中最大的一个，也就是第一个满足upperBound[i]<0x80的位置
+func indexUpperBound(upperBound []byte) []byte {
+	for i := 1; i < len(upperBound); i++ {
+		if upperBound[i] < 0x80 {
+			bound := make([]byte, i+1)
+			copy(bound, upperBound[:i])
+			bound[i] = 0x80
+			return bound
+		}
+	}
+	return upperBound
+}
+
+//prefixSuccessor 获得大于所有以prefix为前缀的key的最小key，如果不存在(prefix全是0xff)就返回空
+func prefixSuccessor(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
 	}
+	return nil
 }
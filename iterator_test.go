@@ -1,8 +1,12 @@
 package FlexDB
 
 import (
+	"FlexDB/mvcc"
 	"FlexDB/utils"
+	"bytes"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
 )
 
@@ -77,7 +81,7 @@ func TestDB_NewIterator_Multi_Values(t *testing.T) {
 	//重置之后，交替使用seek和next来迭代
 	t.Log("========3=========")
 	iter.Rewind()
-	assert.Equal(t, db.options.indexNum, iter.iters.Len())
+	assert.Equal(t, db.options.IndexNum, iter.iters.Len())
 
 	iter.Seek([]byte("s"))
 	assert.Equal(t, []byte("sfqde"), iter.Key())
@@ -113,3 +117,530 @@ func TestDB_NewIterator_Multi_Values(t *testing.T) {
 	}
 
 }
+
+func TestDB_NewIterator_Bounds(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for _, key := range []string{"a", "b", "ba", "bb", "c", "d", "e"} {
+		assert.Nil(t, db.Put([]byte(key), []byte("value-"+key)))
+	}
+
+	iterOpts := DefaultIteratorOptions
+	iterOpts.LowerBound = []byte("b")
+	iterOpts.UpperBound = []byte("d")
+	var keys []string
+	iter := db.NewIterator(iterOpts)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Close()
+	assert.Equal(t, []string{"b", "ba", "bb", "c"}, keys)
+
+	//反向遍历
+	iterOpts.Reverse = true
+	keys = nil
+	iter = db.NewIterator(iterOpts)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Close()
+	assert.Equal(t, []string{"c", "bb", "ba", "b"}, keys)
+
+	//前缀和边界一起使用
+	iterOpts = DefaultIteratorOptions
+	iterOpts.Prefix = []byte("b")
+	iterOpts.LowerBound = []byte("ba")
+	keys = nil
+	iter = db.NewIterator(iterOpts)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Close()
+	assert.Equal(t, []string{"ba", "bb"}, keys)
+}
+
+//边界是二进制的key，上边界以已有的key为前缀的时候，索引中这个key带版本号的编码可能超过上边界，仍然需要返回
+func TestDB_NewIterator_BinaryBounds(t *testing.T) {
+	for _, indexType := range []IndexType{Btree, ART, BPT, Skiplist} {
+		opts := DefaultOperations
+		opts.DirPath = DirPath
+		opts.IndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		for _, key := range []string{"a", "ab", "ab\x00", "ab\x00\x01", "ac"} {
+			assert.Nil(t, db.Put([]byte(key), []byte("value-"+key)))
+		}
+		scanKeys := func(lowerBound, upperBound []byte, reverse bool) []string {
+			iterOpts := DefaultIteratorOptions
+			iterOpts.LowerBound = lowerBound
+			iterOpts.UpperBound = upperBound
+			iterOpts.Reverse = reverse
+			iter := db.NewIterator(iterOpts)
+			defer iter.Close()
+			var keys []string
+			for ; iter.Valid(); iter.Next() {
+				keys = append(keys, string(iter.Key()))
+			}
+			return keys
+		}
+
+		//上边界不包含ab\x00，但是包含它的前缀ab
+		kvs, err := db.Scan(nil, []byte("ab\x00"), 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(kvs))
+		assert.Equal(t, "ab", string(kvs[1].Key))
+		assert.Equal(t, "value-ab", string(kvs[1].Value))
+		assert.Equal(t, []string{"ab", "a"}, scanKeys(nil, []byte("ab\x00"), true))
+		assert.Equal(t, []string{"a", "ab", "ab\x00"}, scanKeys(nil, []byte("ab\x00\x01"), false))
+
+		//下边界包含ab\x00，但是不包含它的前缀ab
+		assert.Equal(t, []string{"ab\x00", "ab\x00\x01", "ac"}, scanKeys([]byte("ab\x00"), nil, false))
+		assert.Equal(t, []string{"ac", "ab\x00\x01", "ab\x00"}, scanKeys([]byte("ab\x00"), nil, true))
+		assert.Equal(t, []string{"ab\x00"}, scanKeys([]byte("ab\x00"), []byte("ab\x00\x01"), false))
+		destroyDB(db)
+	}
+
+	//范围分片按照带版本号的key划分，ab的版本在从ab\x00开始的分片中，遍历的时候也需要访问这个分片
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.ShardType = RangeShard
+	opts.IndexNum = 1
+	opts.TimeRebalanceShard = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.SplitShard([]byte("ab\x00")))
+	assert.Nil(t, db.Put([]byte("a"), []byte("value-a")))
+	assert.Nil(t, db.Put([]byte("ab"), []byte("value-ab")))
+	kvs, err := db.Scan(nil, []byte("ab\x00"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(kvs))
+}
+
+func TestDB_Scan(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for _, key := range []string{"a", "b", "ba", "bb", "c", "d", "e"} {
+		assert.Nil(t, db.Put([]byte(key), []byte("value-"+key)))
+	}
+
+	kvs, err := db.Scan([]byte("b"), []byte("d"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(kvs))
+	for i, key := range []string{"b", "ba", "bb", "c"} {
+		assert.Equal(t, key, string(kvs[i].Key))
+		assert.Equal(t, []byte("value-"+key), kvs[i].Value)
+	}
+
+	//限制返回的数量
+	kvs, err = db.Scan([]byte("b"), nil, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(kvs))
+	assert.Equal(t, "ba", string(kvs[1].Key))
+
+	//不限制边界
+	kvs, err = db.Scan(nil, nil, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, len(kvs))
+
+	//范围内没有数据
+	kvs, err = db.Scan([]byte("x"), nil, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(kvs))
+}
+
+func TestDB_NewIterator_Versions(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put([]byte("a"), []byte("a-1")))
+	assert.Nil(t, db.Put([]byte("b"), []byte("b-1")))
+	assert.Nil(t, db.Put([]byte("c"), []byte("c-1")))
+	oldRev := db.latestRevision
+	assert.Nil(t, db.Put([]byte("a"), []byte("a-2")))
+	assert.Nil(t, db.Put([]byte("a"), []byte("a-3")))
+	ok, err := db.Delete([]byte("b"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	//同一个key只返回最新的版本，已经删除的key不会返回
+	var keys, values []string
+	iter := db.NewIterator(DefaultIteratorOptions)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+		values = append(values, string(iter.Value()))
+	}
+	iter.Close()
+	assert.Equal(t, []string{"a", "c"}, keys)
+	assert.Equal(t, []string{"a-3", "c-1"}, values)
+
+	//反向遍历
+	iterOpts := DefaultIteratorOptions
+	iterOpts.Reverse = true
+	keys = nil
+	iter = db.NewIterator(iterOpts)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Seek([]byte("a"))
+	assert.False(t, iter.Valid())
+	iter.Close()
+	assert.Equal(t, []string{"c", "a"}, keys)
+
+	//指定读版本号，读取之前的数据，和Get在这个版本号下的结果一致，之后被删除的key仍然可见
+	iterOpts = DefaultIteratorOptions
+	iterOpts.Revision = oldRev
+	keys, values = nil, nil
+	iter = db.NewIterator(iterOpts)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+		values = append(values, string(iter.Value()))
+	}
+	iter.Rewind()
+	iter.Seek([]byte("b"))
+	assert.Equal(t, []byte("b"), iter.Key())
+	iter.Close()
+	assert.Equal(t, []string{"a", "b", "c"}, keys)
+	assert.Equal(t, []string{"a-1", "b-1", "c-1"}, values)
+	val, err := db.GetVal([]byte("b"), oldRev)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b-1"), val)
+	_, err = db.Get([]byte("b"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	//ListKeys返回的是用户的key
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("c")}, db.ListKeys(DefaultIteratorOptions))
+}
+
+//正序和反序的迭代器并发使用，同时有数据写入，每个迭代器都只能看到创建时的数据
+func TestDB_NewIterator_Concurrent(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte("value")))
+	}
+
+	var wg sync.WaitGroup
+	//写入新的key，并且删除一部分旧的key
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 500; i < 1000; i++ {
+			assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte("value")))
+			if i%10 == 0 {
+				_, err := db.Delete([]byte(fmt.Sprintf("key-%04d", i-500)))
+				assert.Nil(t, err)
+			}
+		}
+	}()
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(reverse bool) {
+			defer wg.Done()
+			for round := 0; round < 5; round++ {
+				iterOpts := DefaultIteratorOptions
+				iterOpts.Reverse = reverse
+				iter := db.NewIterator(iterOpts)
+				var prev []byte
+				count := 0
+				for ; iter.Valid(); iter.Next() {
+					key := iter.Key()
+					if prev != nil {
+						//每个迭代器都按照自己的方向有序，并且不会返回重复的key
+						if reverse {
+							assert.True(t, bytes.Compare(prev, key) > 0)
+						} else {
+							assert.True(t, bytes.Compare(prev, key) < 0)
+						}
+					}
+					assert.Equal(t, []byte("value"), iter.Value())
+					prev = key
+					count++
+				}
+				iter.Close()
+				assert.True(t, count >= 450)
+			}
+		}(g%2 == 0)
+	}
+	wg.Wait()
+
+	//写入完成之后，正序和反序遍历的结果一致
+	forward := db.ListKeys(DefaultIteratorOptions)
+	iterOpts := DefaultIteratorOptions
+	iterOpts.Reverse = true
+	backward := db.ListKeys(iterOpts)
+	assert.Equal(t, 950, len(forward))
+	assert.Equal(t, len(forward), len(backward))
+	for i := range forward {
+		assert.Equal(t, forward[i], backward[len(backward)-1-i])
+	}
+}
+
+func TestDB_NewIterator_KeysOnly(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	sizes := map[string]int{"a": 0, "b": 10, "c": 127, "d": 128, "e": 20000}
+	for key, size := range sizes {
+		assert.Nil(t, db.Put([]byte(key), utils.RandomValue(size)))
+	}
+	//覆盖写之后的大小是最新的value的大小
+	assert.Nil(t, db.Put([]byte("b"), make([]byte, 300)))
+	sizes["b"] = 300
+
+	iterOpts := DefaultIteratorOptions
+	iterOpts.KeysOnly = true
+	iter := db.NewIterator(iterOpts)
+	count := 0
+	for ; iter.Valid(); iter.Next() {
+		assert.Nil(t, iter.Value())
+		assert.Equal(t, uint32(sizes[string(iter.Key())]), iter.ValueSize())
+		count++
+	}
+	iter.Close()
+	assert.Equal(t, len(sizes), count)
+
+	//普通的迭代器中ValueSize和Value的长度一致
+	iter = db.NewIterator(DefaultIteratorOptions)
+	for ; iter.Valid(); iter.Next() {
+		assert.Equal(t, uint32(len(iter.Value())), iter.ValueSize())
+	}
+	iter.Close()
+
+	//Fold只遍历key
+	err = db.Fold(func(key []byte, value []byte) bool {
+		assert.Nil(t, value)
+		return true
+	}, iterOpts)
+	assert.Nil(t, err)
+}
+
+//事务序列号超过127之后编码成多个字节，批量写入的key的ValueSize仍然正确，重启之后也一样
+func TestDB_NewIterator_ValueSizeBatch(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.EnableWal = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	sizes := make(map[string]int)
+	for i := 0; i < 200; i++ {
+		wb := db.NewWriteBatch(DefaultWriteBatchOption, db.latestRevision)
+		key := utils.GetTestKey(i)
+		sizes[string(key)] = i * 7
+		assert.Nil(t, wb.Put(key, make([]byte, i*7), db.latestRevision))
+		assert.Nil(t, wb.Commit())
+	}
+	assert.True(t, db.seqNo > 128)
+	checkSizes := func() {
+		iterOpts := DefaultIteratorOptions
+		iterOpts.KeysOnly = true
+		//批量写入使用的是当前的版本号，读取的时候需要在这个版本号之后
+		iterOpts.Revision = db.latestRevision + 1
+		iter := db.NewIterator(iterOpts)
+		count := 0
+		for ; iter.Valid(); iter.Next() {
+			assert.Equal(t, uint32(sizes[string(iter.Key())]), iter.ValueSize())
+			count++
+		}
+		iter.Close()
+		assert.Equal(t, len(sizes), count)
+	}
+	checkSizes()
+
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	checkSizes()
+}
+
+func TestDB_ScanPage(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		assert.Nil(t, db.Put([]byte(key), []byte("value-"+key)))
+	}
+
+	//分页遍历，每页3条数据
+	var keys []string
+	var cursor []byte
+	for page := 0; ; page++ {
+		kvs, next, err := db.ScanPage(cursor, 3, DefaultIteratorOptions)
+		assert.Nil(t, err)
+		for _, kv := range kvs {
+			keys = append(keys, string(kv.Key))
+			assert.Equal(t, "value-"+string(kv.Key), string(kv.Value))
+		}
+		if page == 0 {
+			//分页期间写入新的数据和覆盖旧的数据，对之后的分页不可见
+			assert.Nil(t, db.Put([]byte("key-00a"), []byte("new")))
+			assert.Nil(t, db.Put([]byte("key-99"), []byte("new")))
+			assert.Nil(t, db.Put([]byte("key-05"), []byte("new")))
+		}
+		if page == 1 {
+			//分页期间进行merge，数据的位置发生了变化，游标仍然有效
+			assert.Nil(t, db.Merge(true))
+		}
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, 10, len(keys))
+	for i, key := range keys {
+		assert.Equal(t, fmt.Sprintf("key-%02d", i), key)
+	}
+
+	//反向分页遍历
+	iterOpts := DefaultIteratorOptions
+	iterOpts.Reverse = true
+	iterOpts.KeysOnly = true
+	keys, cursor = nil, nil
+	for {
+		kvs, next, err := db.ScanPage(cursor, 4, iterOpts)
+		assert.Nil(t, err)
+		for _, kv := range kvs {
+			assert.Nil(t, kv.Value)
+			keys = append(keys, string(kv.Key))
+		}
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, 12, len(keys))
+	assert.Equal(t, "key-99", keys[0])
+	assert.Equal(t, "key-00", keys[len(keys)-1])
+
+	//数据正好是一页的时候，不会返回游标
+	kvs, next, err := db.ScanPage(nil, 12, DefaultIteratorOptions)
+	assert.Nil(t, err)
+	assert.Equal(t, 12, len(kvs))
+	assert.Nil(t, next)
+
+	//无效的游标
+	_, _, err = db.ScanPage([]byte{0x00}, 3, DefaultIteratorOptions)
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+//分页期间删除和覆盖还没有遍历到的key，之后的分页仍然读取到游标版本号时候的数据
+func TestDB_ScanPage_DeleteBetweenPages(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		assert.Nil(t, db.Put([]byte(key), []byte("value-"+key)))
+	}
+
+	kvs, cursor, err := db.ScanPage(nil, 3, DefaultIteratorOptions)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(kvs))
+	assert.NotNil(t, cursor)
+
+	ok, err := db.Delete([]byte("key-03"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Nil(t, db.Put([]byte("key-04"), []byte("new")))
+
+	kvs, cursor, err = db.ScanPage(cursor, 3, DefaultIteratorOptions)
+	assert.Nil(t, err)
+	assert.Nil(t, cursor)
+	assert.Equal(t, 3, len(kvs))
+	for i, kv := range kvs {
+		key := fmt.Sprintf("key-%02d", i+3)
+		assert.Equal(t, key, string(kv.Key))
+		assert.Equal(t, "value-"+key, string(kv.Value))
+	}
+
+	//新的分页可以看到删除和覆盖
+	kvs, _, err = db.ScanPage(nil, 10, DefaultIteratorOptions)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(kvs))
+	assert.Equal(t, "key-04", string(kvs[3].Key))
+	assert.Equal(t, "new", string(kvs[3].Value))
+}
+
+//二进制的key中，以一个key为前缀的更长的key的版本在索引中可能和它的版本交错，每个key仍然只返回一次，顺序和返回的版本都是正确的
+func TestDB_NewIterator_BinaryKeys(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put([]byte("k"), []byte("k-1")))
+	//去掉前缀k之后剩余的部分落在k的两个版本之间
+	mid := append([]byte("k"), (&mvcc.Revision{Main: db.latestRevision}).Encode()[:8]...)
+	assert.Nil(t, db.Put(mid, []byte("mid-1")))
+	assert.Nil(t, db.Put([]byte("k\x00"), []byte("k0-1")))
+	oldRev := db.latestRevision
+	assert.Nil(t, db.Put([]byte("k"), []byte("k-2")))
+	assert.Nil(t, db.Put([]byte("k\x00"), []byte("k0-2")))
+	assert.Nil(t, db.Put([]byte("k\x00\x00"), []byte("k00-1")))
+
+	scan := func(iterOpts IteratorOptions) ([]string, []string) {
+		var keys, values []string
+		iter := db.NewIterator(iterOpts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.Key()))
+			values = append(values, string(iter.Value()))
+		}
+		return keys, values
+	}
+	keys, values := scan(DefaultIteratorOptions)
+	assert.Equal(t, []string{"k", "k\x00", "k\x00\x00", string(mid)}, keys)
+	assert.Equal(t, []string{"k-2", "k0-2", "k00-1", "mid-1"}, values)
+
+	iterOpts := DefaultIteratorOptions
+	iterOpts.Reverse = true
+	keys, values = scan(iterOpts)
+	assert.Equal(t, []string{string(mid), "k\x00\x00", "k\x00", "k"}, keys)
+	assert.Equal(t, []string{"mid-1", "k00-1", "k0-2", "k-2"}, values)
+
+	//读取之前的版本
+	iterOpts = DefaultIteratorOptions
+	iterOpts.Revision = oldRev
+	keys, values = scan(iterOpts)
+	assert.Equal(t, []string{"k", "k\x00", string(mid)}, keys)
+	assert.Equal(t, []string{"k-1", "k0-1", "mid-1"}, values)
+	iterOpts.Reverse = true
+	keys, values = scan(iterOpts)
+	assert.Equal(t, []string{string(mid), "k\x00", "k"}, keys)
+	assert.Equal(t, []string{"mid-1", "k0-1", "k-1"}, values)
+
+	//Seek之后不会返回目标之前的key
+	iter := db.NewIterator(DefaultIteratorOptions)
+	iter.Seek([]byte("k\x00"))
+	assert.Equal(t, []byte("k\x00"), iter.Key())
+	iter.Next()
+	assert.Equal(t, []byte("k\x00\x00"), iter.Key())
+	iter.Next()
+	assert.Equal(t, mid, iter.Key())
+	iter.Next()
+	assert.False(t, iter.Valid())
+	iter.Close()
+}
@@ -0,0 +1,337 @@
+package FlexDB
+
+import (
+	"FlexDB/data"
+	"FlexDB/index"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	启动的时候并行的构建内存索引
+	1.多个goroutine并行的解码数据文件（或者hint文件），得到每个文件中的记录
+	2.一个goroutine按照文件id从小到大的顺序处理解码之后的记录，处理事务，并把需要更新的索引操作按照索引实例进行分发
+	3.每个索引实例都有一个goroutine按照顺序更新索引，保证同一个key的覆盖顺序和写入顺序一致
+	同一个时刻最多只有LoadConcurrency个文件被解码并缓存在内存中，避免占用过多的内存
+*/
+
+//loadRecord 从数据文件或者hint文件中解析出来的一条记录
+type loadRecord struct {
+	key   []byte             //去掉事务序列号之后的key
+	seqNo uint64             //事务序列号
+	typ   data.LogRecordType //记录的类型
+	pos   *data.LogRecordPos //记录的位置信息
+	node  string             //该key所在的索引实例
+}
+
+//loadFileResult 一个数据文件解码之后的结果
+type loadFileResult struct {
+	records  []*loadRecord
+	writeOff uint64 //活跃文件的写入位置
+	hint     []byte //活跃文件的hint缓冲
+	err      error
+}
+
+//indexOp 对某一个索引实例的一次更新
+type indexOp struct {
+	key []byte
+	typ data.LogRecordType
+	pos *data.LogRecordPos
+}
+
+//loadIndexFromDataFiles 从数据文件中读取数据构造索引
+//封存的数据文件如果存在完整的hint文件，就直接从hint文件中读取，否则需要扫描整个数据文件
+func (db *DB) loadIndexFromDataFiles() error {
+	//活跃文件会重新扫描，扫描的时候重新构造hint缓冲
+	db.resetDataHint(false)
+	//找到需要加载的文件
+	var dataFiles []*data.DataFile
+	for _, fid := range db.fileIds {
+		var fileId = uint32(fid)
+		//如果比最近未参与merge的文件id小，说明已经从hint文件中加载了索引
+		if db.mergeInfo.hashMerged && fileId < db.mergeInfo.nonMergeFildId {
+			continue
+		}
+		//checkpoint之前的文件已经在checkpoint中了
+		if db.checkpoint != nil && fileId < db.checkpoint.fileId {
+			continue
+		}
+		//merge完的数据都被消除了事务的标志，merge之后写入的数据仍然保持有事务的id
+		if fileId == db.activeFile.FileId {
+			//当前文件是活跃文件，就从活跃文件中获得
+			dataFiles = append(dataFiles, db.activeFile)
+		} else {
+			//当前文件是旧文件，就从旧文件中根据ID号码获得
+			dataFiles = append(dataFiles, db.olderFile[fileId])
+		}
+	}
+	//没有文件，说明当前是一个空的数据库
+	if len(dataFiles) == 0 {
+		return nil
+	}
+
+	concurrency := db.options.LoadConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		results = make([]chan *loadFileResult, len(dataFiles)) //每个文件的解码结果,按照文件的顺序进行处理
+		sem     = make(chan struct{}, concurrency)             //限制同时解码的文件数量
+		done    = make(chan struct{})                          //处理出错提前退出的时候通知解码的goroutine
+	)
+	defer close(done)
+	for i := range results {
+		results[i] = make(chan *loadFileResult, 1)
+	}
+	//按照顺序启动解码的goroutine
+	go func() {
+		for i, dataFile := range dataFiles {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			isActive := dataFile == db.activeFile
+			//checkpoint覆盖的文件只需要读取checkpoint位置之后的数据
+			var startOffset uint64
+			if db.checkpoint != nil && dataFile.FileId == db.checkpoint.fileId {
+				startOffset = db.checkpoint.offset
+			}
+			go func(dataFile *data.DataFile, result chan<- *loadFileResult) {
+				result <- db.decodeDataFile(dataFile, isActive, startOffset)
+			}(dataFile, results[i])
+		}
+	}()
+
+	//每个索引实例启动一个goroutine，按照顺序更新索引
+	var (
+		wg           sync.WaitGroup
+		shards       = db.indexShards()
+		shardOps     = make(map[string]chan []*indexOp, len(shards.index))
+		reclaimSizes = make(chan uint64, len(shards.index)) //每个索引实例更新过程中产生的无效数据大小
+		errOnce      sync.Once
+		applyErr     error //更新索引的时候出现的第一个错误
+	)
+	for node, idx := range shards.index {
+		ops := make(chan []*indexOp, concurrency)
+		shardOps[node] = ops
+		wg.Add(1)
+		go func(idx index.Indexer, ops <-chan []*indexOp) {
+			defer wg.Done()
+			var size uint64
+			for batch := range ops {
+				//出错之后继续读取channel，避免阻塞分发的goroutine
+				n, err := applyIndexOps(idx, batch)
+				if err != nil {
+					errOnce.Do(func() { applyErr = err })
+					continue
+				}
+				size += n
+			}
+			reclaimSizes <- size
+		}(idx, ops)
+	}
+	//等待所有的索引更新完成
+	waitShards := func() {
+		for _, ops := range shardOps {
+			close(ops)
+		}
+		wg.Wait()
+		close(reclaimSizes)
+	}
+
+	//暂存事务的数据,一个事务里面是有多个数据的
+	transactionRecord := make(map[uint64][]*loadRecord)
+	var curSeqNo = nonTransactionSeq
+	if db.checkpoint != nil {
+		curSeqNo = db.checkpoint.seqNo
+		db.reclaimSize += db.checkpoint.reclaimSize
+	}
+	for i := range dataFiles {
+		result := <-results[i]
+		<-sem //当前文件处理完成之后，允许解码下一个文件
+		if result.err != nil {
+			waitShards()
+			return result.err
+		}
+		//按照索引实例对当前文件中的操作进行分组
+		batches := make(map[string][]*indexOp)
+		addOp := func(record *loadRecord) {
+			batches[record.node] = append(batches[record.node], &indexOp{key: record.key, typ: record.typ, pos: record.pos})
+		}
+		for _, record := range result.records {
+			if record.seqNo == nonTransactionSeq {
+				//非事务提交,直接更新索引
+				addOp(record)
+			} else if record.typ == data.LogRecordTxnFinished {
+				//事务完成，将对应的seq no的数据一次性进行更新,如果没有这个标志的话，内存索引就不会更新，实现了原子性质
+				for _, txnRecord := range transactionRecord[record.seqNo] {
+					addOp(txnRecord)
+				}
+				delete(transactionRecord, record.seqNo)
+			} else {
+				//还没有达到事务的结束,先将读取到的数据暂存起来
+				transactionRecord[record.seqNo] = append(transactionRecord[record.seqNo], record)
+			}
+			//更新当前的事务序列号
+			if record.seqNo > curSeqNo {
+				curSeqNo = record.seqNo
+			}
+		}
+		for node, batch := range batches {
+			shardOps[node] <- batch
+		}
+		//如果当前为活跃文件(读到最后一个文件没有写满，我们需要拿到他的偏移量，继续写，直到把他写满)。就需要更新这个文件的WriteOff
+		if dataFiles[i] == db.activeFile {
+			db.activeFile.WriteOff = result.writeOff
+			db.activeHint = result.hint
+			//从checkpoint的位置开始读取的时候，hint缓冲中缺少前面的记录，这个文件就不再生成hint文件了
+			db.activeHintValid = db.checkpoint == nil || db.checkpoint.fileId != db.activeFile.FileId || db.checkpoint.offset == 0
+		}
+	}
+	waitShards()
+	if applyErr != nil {
+		return applyErr
+	}
+	for size := range reclaimSizes {
+		db.reclaimSize += size
+	}
+	//更新事务序列号
+	db.seqNo = curSeqNo
+	return nil
+}
+
+//decodeDataFile 解码一个数据文件中从startOffset开始的所有记录
+//封存的数据文件优先从hint文件中加载,hint文件不存在或者损坏的话，就退化成扫描整个数据文件
+func (db *DB) decodeDataFile(dataFile *data.DataFile, isActive bool, startOffset uint64) *loadFileResult {
+	result := &loadFileResult{}
+	addRecord := func(logKey []byte, typ data.LogRecordType, pos *data.LogRecordPos) error {
+		//解析key，拿到事务的ID
+		key, seqNo := parseLogRecordKey(logKey)
+		pos.SeqSize = logRecordSeqSize(logKey)
+		record := &loadRecord{key: key, seqNo: seqNo, typ: typ, pos: pos}
+		if typ != data.LogRecordTxnFinished {
+			node, err := db.indexShards().router.route(key) //获得对应实例
+			if err != nil {
+				return err
+			}
+			record.node = node
+		}
+		result.records = append(result.records, record)
+		return nil
+	}
+	if !isActive {
+		if hintRecords, ok := db.readDataHintFile(dataFile); ok {
+			for _, hintRecord := range hintRecords {
+				if hintRecord.Pos.Offset < startOffset {
+					continue
+				}
+				if err := addRecord(hintRecord.Record.Key, hintRecord.Record.Type, hintRecord.Pos); err != nil {
+					return &loadFileResult{err: err}
+				}
+			}
+			return result
+		}
+	}
+	var offset = startOffset
+	//读取当前文件的数据，根据读取的数据来构造索引
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset) //根据offset读取一条log记录
+		if err != nil {
+			//文件读取完了
+			if err == io.EOF {
+				break
+			}
+			return &loadFileResult{err: err}
+		}
+		//构造内存索引并保存
+		logRecordPos := &data.LogRecordPos{Fid: dataFile.FileId, Offset: offset, Size: uint32(size)}
+		if err := addRecord(logRecord.Key, logRecord.Type, logRecordPos); err != nil {
+			return &loadFileResult{err: err}
+		}
+		if isActive {
+			//活跃文件后续封存的时候也需要写入hint文件，所以这里重新构造hint缓冲
+			result.hint = append(result.hint, data.EncodeDataHintRecord(logRecord.Key, logRecord.Type, logRecordPos)...)
+		}
+		//递增offset，下一次从新的位置开始读取
+		offset += size
+	}
+	result.writeOff = offset
+	return result
+}
+
+//applyShardOps 按照索引实例分组之后并行的更新索引，同一个实例中的操作保持原来的顺序，返回产生的无效数据的大小
+func (db *DB) applyShardOps(ops []*indexOp) (uint64, error) {
+	shards := db.indexShards()
+	shardOps := make(map[string][]*indexOp, len(shards.index))
+	for _, op := range ops {
+		node, err := shards.router.route(op.key)
+		if err != nil {
+			return 0, err
+		}
+		shardOps[node] = append(shardOps[node], op)
+	}
+	var (
+		wg          sync.WaitGroup
+		errOnce     sync.Once
+		applyErr    error
+		reclaimSize uint64
+	)
+	for node, ops := range shardOps {
+		wg.Add(1)
+		go func(idx index.Indexer, ops []*indexOp) {
+			defer wg.Done()
+			size, err := applyIndexOps(idx, ops)
+			if err != nil {
+				errOnce.Do(func() { applyErr = err })
+				return
+			}
+			atomic.AddUint64(&reclaimSize, size)
+		}(shards.index[node], ops)
+	}
+	wg.Wait()
+	if applyErr != nil {
+		return 0, applyErr
+	}
+	return reclaimSize, nil
+}
+
+//applyIndexOps 按照顺序批量更新一个索引实例，返回产生的无效数据的大小
+//删除操作不会移除索引中被删除的版本，之前的读版本号仍然可以读取到，被删除的版本和删除记录都是无效数据，在merge的时候回收
+func applyIndexOps(idx index.Indexer, ops []*indexOp) (uint64, error) {
+	batch := make([]index.BatchOp, 0, len(ops))
+	var (
+		reclaimSize uint64
+		deletes     []*indexOp
+	)
+	for _, op := range ops {
+		if op.typ == data.LogRecordDeleted {
+			reclaimSize += uint64(op.pos.Size)
+			deletes = append(deletes, op)
+			continue
+		}
+		batch = append(batch, index.BatchOp{Key: op.key, Pos: op.pos})
+	}
+	oldPos, err := index.ApplyBatch(idx, batch)
+	if err != nil {
+		return 0, err
+	}
+	//如果构建索引的时候，这个key之前已经被存在了，那么这个key之前的数据就是无效的，可以进行清理
+	for _, pos := range oldPos {
+		if pos != nil {
+			reclaimSize += uint64(pos.Size)
+		}
+	}
+	//版本号不会重复，删除的版本一定在这次更新之前或者这次更新的写入中
+	for _, op := range deletes {
+		pos, err := idx.Get(op.key)
+		if err != nil {
+			return 0, err
+		}
+		if pos != nil {
+			reclaimSize += uint64(pos.Size)
+		}
+	}
+	return reclaimSize, nil
+}
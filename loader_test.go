@@ -0,0 +1,101 @@
+package FlexDB
+
+import (
+	"FlexDB/data"
+	"FlexDB/utils"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//indexSnapshot 获得所有索引中的key和位置信息
+func indexSnapshot(db *DB) map[string]data.LogRecordPos {
+	res := make(map[string]data.LogRecordPos)
+	for _, idx := range db.indexShards().index {
+		iter, _ := idx.Iterator(false)
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			res[string(iter.Key())] = *iter.Value()
+		}
+		iter.Close()
+	}
+	return res
+}
+
+//indexPos 获得key的最新版本在索引中的位置
+func indexPos(t *testing.T, db *DB, key []byte) *data.LogRecordPos {
+	rev, err := db.VersionGet(key, math.MaxInt64)
+	assert.Nil(t, err)
+	indexKey := keyWithRevision(key, *rev)
+	idx, err := db.indexShards().get(indexKey)
+	assert.Nil(t, err)
+	pos, err := idx.Get(indexKey)
+	assert.Nil(t, err)
+	assert.NotNil(t, pos)
+	return pos
+}
+
+//removeIndexFiles 删除hint文件和索引的checkpoint，重新打开的时候只能从数据文件中构建索引
+func removeIndexFiles(t *testing.T) {
+	hintFiles, err := filepath.Glob(filepath.Join(DirPath, "*"+data.DataHintFileSuffix))
+	assert.Nil(t, err)
+	for _, hintFile := range hintFiles {
+		assert.Nil(t, os.Remove(hintFile))
+	}
+	assert.Nil(t, removeIndexCheckpoint(DirPath))
+}
+
+//并行构建索引的结果需要和串行构建的结果一致
+func TestDB_ParallelLoadIndex(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.FileSize = 256 * 1024
+	opts.LoadConcurrency = 1
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 10000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 2000; i++ {
+		_, err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	//事务中的数据可能会跨越多个数据文件
+	wbOpts := DefaultWriteBatchOption
+	wb := db.NewWriteBatch(wbOpts, db.latestRevision)
+	for i := 10000; i < 15000; i++ {
+		err := wb.Put(utils.GetTestKey(i), utils.RandomValue(64), int64(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, wb.Commit())
+	assert.True(t, len(db.olderFile) > 4)
+	//事务中的数据分布在多个数据文件中，加载的时候事务暂存的数据需要跨文件传递
+	fids := make(map[uint32]struct{})
+	for i := 10000; i < 15000; i++ {
+		fids[indexPos(t, db, utils.GetTestKey(i)).Fid] = struct{}{}
+	}
+	assert.True(t, len(fids) > 1)
+	assert.Nil(t, db.Close())
+
+	//串行构建索引
+	removeIndexFiles(t)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	expected := indexSnapshot(db)
+	expectedReclaim := db.reclaimSize
+	expectedSeqNo := db.seqNo
+	assert.Nil(t, db.Close())
+
+	//并行构建索引
+	removeIndexFiles(t)
+	opts.LoadConcurrency = 8
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, indexSnapshot(db))
+	assert.Equal(t, expectedReclaim, db.reclaimSize)
+	assert.Equal(t, expectedSeqNo, db.seqNo)
+	assert.Nil(t, db.Close())
+}
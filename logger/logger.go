@@ -0,0 +1,141 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	可插拔的日志接口
+	Logger的方法签名和log/slog中的*slog.Logger一致，所以可以直接传入slog.Default()等实例，将日志接入到用户自己的结构化日志系统中
+	args是key/value交替的上下文信息，例如 logger.Info("merge finish", "dir", dirPath, "duration", cost)
+*/
+
+//Logger 日志接口
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+//Level 日志的级别
+type Level int8
+
+const (
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+	}
+}
+
+//stdLogger 基于标准库log的默认实现，输出 level msg key=value 格式的日志
+type stdLogger struct {
+	level Level
+	out   *log.Logger
+}
+
+//New 创建一个输出到out的日志实例，低于level的日志会被丢弃
+func New(out io.Writer, level Level) Logger {
+	return &stdLogger{level: level, out: log.New(out, "", log.LstdFlags)}
+}
+
+func (l *stdLogger) Debug(msg string, args ...any) { l.log(LevelDebug, msg, args) }
+func (l *stdLogger) Info(msg string, args ...any)  { l.log(LevelInfo, msg, args) }
+func (l *stdLogger) Warn(msg string, args ...any)  { l.log(LevelWarn, msg, args) }
+func (l *stdLogger) Error(msg string, args ...any) { l.log(LevelError, msg, args) }
+
+func (l *stdLogger) log(level Level, msg string, args []any) {
+	if level < l.level {
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString(level.String())
+	sb.WriteByte(' ')
+	sb.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		sb.WriteByte(' ')
+		if i+1 == len(args) {
+			//只有value没有key，和slog的处理方式一致
+			sb.WriteString("!BADKEY=")
+			sb.WriteString(formatValue(args[i]))
+			break
+		}
+		sb.WriteString(fmt.Sprint(args[i]))
+		sb.WriteByte('=')
+		sb.WriteString(formatValue(args[i+1]))
+	}
+	_ = l.out.Output(3, sb.String())
+}
+
+//formatValue 格式化value，包含空格等字符的时候需要加上引号
+func formatValue(v any) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+//nopLogger 丢弃所有的日志
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+//Nop 返回一个丢弃所有日志的实例
+func Nop() Logger {
+	return nopLogger{}
+}
+
+var (
+	defaultLogger Logger = New(os.Stderr, LevelInfo)
+	defaultMu            = new(sync.RWMutex)
+)
+
+//Default 返回默认的日志实例，输出INFO及以上级别的日志到标准错误
+func Default() Logger {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultLogger
+}
+
+//SetDefault 设置默认的日志实例，没有配置日志的组件都会使用该实例
+func SetDefault(l Logger) {
+	if l == nil {
+		l = Nop()
+	}
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultLogger = l
+}
+
+//OrDefault 为空的时候返回默认的日志实例
+func OrDefault(l Logger) Logger {
+	if l == nil {
+		return Default()
+	}
+	return l
+}
@@ -0,0 +1,43 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStdLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := New(buf, LevelInfo)
+
+	//低于日志级别的日志被丢弃
+	l.Debug("debug message", "fid", 1)
+	assert.Equal(t, 0, buf.Len())
+
+	l.Info("merge finish", "fid", uint32(3), "duration", time.Second, "dir", "/tmp/flex db")
+	line := buf.String()
+	assert.True(t, strings.Contains(line, "INFO merge finish fid=3 duration=1s dir=\"/tmp/flex db\""))
+	buf.Reset()
+
+	l.Error("sync failed", "err", errors.New("disk full"), "dangling")
+	line = buf.String()
+	assert.True(t, strings.Contains(line, "ERROR sync failed err=\"disk full\" !BADKEY=dangling"))
+}
+
+func TestDefault(t *testing.T) {
+	old := Default()
+	defer SetDefault(old)
+
+	buf := new(bytes.Buffer)
+	SetDefault(New(buf, LevelDebug))
+	OrDefault(nil).Debug("from default")
+	assert.True(t, strings.Contains(buf.String(), "DEBUG from default"))
+
+	nop := Nop()
+	assert.Equal(t, nop, OrDefault(nop))
+	SetDefault(nil)
+	assert.Equal(t, Nop(), Default())
+}
@@ -3,15 +3,17 @@ package FlexDB
 import (
 	"FlexDB/data"
 	"FlexDB/fio"
+	"FlexDB/index"
 	"FlexDB/utils"
 	"FlexDB/wal"
 	"io"
-	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -29,15 +31,16 @@ type MergeInfo struct {
 //Merge 清理无效数据，生成hint文件
 //if reLoad is true ,db will reload file and index
 func (db *DB) Merge(reLoad bool) error {
-	log.Println("FlexDB merge start")
+	start := time.Now()
+	db.options.Logger.Info("merge start", "dir", db.options.DirPath, "reload", reLoad)
 
 	//执行merge操作
 	if err := db.doMerge(); err != nil {
+		db.options.Logger.Warn("merge failed", "dir", db.options.DirPath, "err", err)
 		return err
 	}
 	if !reLoad {
-		log.Println("FlexDB merge finish")
-
+		db.options.Logger.Info("merge finish", "dir", db.options.DirPath, "duration", time.Since(start))
 		return nil
 	}
 	db.mu.Lock()
@@ -61,15 +64,15 @@ func (db *DB) Merge(reLoad bool) error {
 	if err := db.loadIndex(); err != nil {
 		return err
 	}
-	if err := db.setIoManger(fio.StanderFIO); err != nil {
+	if err := db.setActiveFileWritable(); err != nil {
 		return err
 	}
-
+	db.options.Logger.Info("merge finish", "dir", db.options.DirPath, "files", len(db.fileIds), "duration", time.Since(start))
 	return nil
 }
 
 //执行merge操作
-func (db *DB) doMerge() error {
+func (db *DB) doMerge() (err error) {
 	//如果数据库为空，直接返回
 	if db.activeFile == nil {
 		return nil
@@ -81,12 +84,12 @@ func (db *DB) doMerge() error {
 		return ErrMergeIsProgress
 	}
 	//查看可以merge的数据量是否达到了阈值
-	totalSize, err := utils.DirSize(db.options.DirPath)
+	totalSize, err := db.dirSize()
 	if err != nil {
 		db.mu.Unlock()
 		return err
 	}
-	if float32(db.reclaimSize)/float32(totalSize) < db.options.DataFileMergeRatio {
+	if float32(atomic.LoadUint64(&db.reclaimSize))/float32(totalSize) < db.options.DataFileMergeRatio {
 		db.mu.Unlock()
 		return ErrMergeRatioUnReached
 	}
@@ -96,20 +99,33 @@ func (db *DB) doMerge() error {
 		db.mu.Unlock()
 		return err
 	}
-	if totalSize-db.reclaimSize >= availableDiskSize {
+	if totalSize-atomic.LoadUint64(&db.reclaimSize) >= availableDiskSize {
 		db.mu.Unlock()
 		return ErrNoEnoughSpaceForMerge
 	}
 	//设置merge过程的标识
 
 	db.mergeInfo.isMerging = true
+	db.listener().OnMergeStart(MergeStartEvent{
+		DirPath:         db.options.DirPath,
+		MergeFileNum:    len(db.olderFile) + 1,
+		ReclaimableSize: atomic.LoadUint64(&db.reclaimSize),
+		DiskSize:        totalSize,
+	})
+	mergeStart := time.Now()
 	defer func() {
 		//该过程退出的时候，进行资源清理，结束merge标识
 		db.mergeInfo.isMerging = false
+		db.listener().OnMergeFinish(MergeFinishEvent{
+			DirPath:        db.options.DirPath,
+			NonMergeFileId: db.mergeInfo.nonMergeFildId,
+			Duration:       time.Since(mergeStart),
+			Err:            err,
+		})
 	}()
 
 	//持久化当前活跃文件
-	if err := db.activeFile.Sync(); err != nil {
+	if err := db.syncActiveFile(); err != nil {
 		db.mu.Unlock()
 		return err
 	}
@@ -150,6 +166,10 @@ func (db *DB) doMerge() error {
 	mergeOption.DirPath = mergePath
 	//不需要每次都进行sync，可以在写完进行统一的统一的sync，避免太慢
 	mergeOption.SyncWrite = false
+	//临时实例的事件不需要通知给用户
+	mergeOption.EventListener = nil
+	//merge目录中的文件会被移动到数据目录中，临时实例不需要wal
+	mergeOption.EnableWal = false
 	mergeDB, err := Open(mergeOption) //新打开一个db来进行处理
 	defer mergeDB.Close()
 	if err != nil {
@@ -164,6 +184,7 @@ func (db *DB) doMerge() error {
 	walOpt := wal.DefaultWalOpt
 	walOpt.DirPath = mergePath
 	walOpt.FileSuffix = ".hint"
+	walOpt.Logger = db.options.Logger
 	hintFile, err := wal.Open(walOpt) //使用wal来管理hint文件
 
 	if err != nil {
@@ -184,15 +205,24 @@ func (db *DB) doMerge() error {
 			}
 			//解析拿到实际的key,这里我们就不需要使用到事务，因为每一条数据都是有效的了,被重写的
 			realKey, _ := parseLogRecordKey(logRecord.Key)
-			node, err := db.hashRing.Get(string(realKey)) //获得对应实例
+			idx, err := db.indexShards().get(realKey) //获得对应实例
 			if err != nil {
 				return err
 			}
-			logRecordPos := db.index[node].Get(realKey)
+			logRecordPos, err := idx.Get(realKey)
+			if err != nil {
+				return indexReadError(err)
+			}
 			//和内存中的索引位置进行比较，如果有效就进行重写
-			if logRecordPos != nil &&
-				logRecordPos.Fid == dataFile.FileId &&
-				logRecordPos.Offset == offset {
+			valid := logRecordPos != nil && logRecordPos.Fid == dataFile.FileId && logRecordPos.Offset == offset
+			//索引中保留的已经被删除的版本在这里回收，不再重写到merge文件中
+			if valid && db.versionDeleted(realKey) {
+				if _, _, err := idx.Delete(realKey); err != nil {
+					return indexUpdateError(err)
+				}
+				valid = false
+			}
+			if valid {
 				//内存中的数据都是真实有效的，所以如果和内存中的数据相同就没有问题
 				//重写，清除事务的标记
 				logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeq)
@@ -294,6 +324,11 @@ func (db *DB) loadMergeFiles() error {
 	if !db.mergeInfo.hashMerged {
 		return nil
 	}
+	//merge之后数据文件发生了变化，checkpoint中的位置信息失效了
+	if err := removeIndexCheckpoint(db.options.DirPath); err != nil {
+		return err
+	}
+	db.lastCheckpoint = nil
 	//merge发生并完成了,从fin文件中获得最近没有参与merge的id
 	db.mergeInfo.nonMergeFildId, err = db.getMergedInfo(mergePath)
 	if err != nil {
@@ -314,6 +349,10 @@ func (db *DB) loadMergeFiles() error {
 				return err
 			}
 		}
+		//旧数据文件对应的hint文件也失效了，merge目录中如果有对应的hint文件，会在后面移动过来
+		if err := removeDataHintFile(db.options.DirPath, fileId); err != nil {
+			return err
+		}
 		if _, err := os.Stat(fileMergeName); err == nil {
 			//该文件存在,就需要进行删除
 			db.mergeInfo.maxFileID = fileId
@@ -363,6 +402,7 @@ func (db *DB) loadIndexFromHintFile() error {
 	walOpt := wal.DefaultWalOpt
 	walOpt.DirPath = db.options.DirPath
 	walOpt.FileSuffix = ".hint"
+	walOpt.Logger = db.options.Logger
 	hintFile, err := wal.Open(walOpt) //使用wal来管理hint文件
 
 	if err != nil {
@@ -378,6 +418,9 @@ func (db *DB) loadIndexFromHintFile() error {
 			return err
 		}
 	}
+	//按照索引实例对hint中的数据进行分组，每个索引实例批量更新
+	shards := db.indexShards()
+	shardOps := make(map[string][]index.BatchOp, len(shards.index))
 	//var i=0
 	for _, encData := range encDatas {
 		//i++
@@ -385,10 +428,10 @@ func (db *DB) loadIndexFromHintFile() error {
 		header, headerSize := data.DecodeLogRecordHeader(encData)
 		if header == nil {
 			//头部为空，没有读取到，就说明这个文件为空，或者已经读取完了
-			return nil
+			break
 		}
 		if header.Crc == 0 && header.KeySize == 0 && header.ValueSize == 0 {
-			return nil
+			break
 		}
 		//取出key和value的长度
 		keySize, valueSize := header.KeySize, header.ValueSize
@@ -404,12 +447,17 @@ func (db *DB) loadIndexFromHintFile() error {
 			logRecord.Value = kvBuf[keySize:]
 		}
 		hintPos := data.DecodeLogRecordPos(logRecord.Value) //获得hint中的索引信息
-		node, err := db.hashRing.Get(string(logRecord.Key)) //获得对应实例
+		node, err := shards.router.route(logRecord.Key)     //获得对应实例
 		if err != nil {
 			return err
 		}
-		//根据位置信息来构建索引
-		db.index[node].Put(logRecord.Key, hintPos)
+		shardOps[node] = append(shardOps[node], index.BatchOp{Key: logRecord.Key, Pos: hintPos})
+	}
+	//根据位置信息来构建索引
+	for node, ops := range shardOps {
+		if _, err := index.ApplyBatch(shards.index[node], ops); err != nil {
+			return err
+		}
 	}
 	//将hint文件关闭
 	if err := hintFile.Close(); err != nil {
@@ -204,11 +204,14 @@ func TestDB_Merge6(t *testing.T) {
 		_, err := db.Delete(utils.GetTestKey(i))
 		assert.Nil(t, err)
 	}
+	//删除的时候索引中保留了被删除的版本，merge的时候回收
+	assert.Equal(t, 50000, len(indexPositions(db)))
 	err = db.Merge(true)
 	assert.Nil(t, err)
 	keys := db.ListKeys(DefaultIteratorOptions)
 	//Merge的时候删除了数据
 	assert.Equal(t, 0, len(keys))
+	assert.Equal(t, 0, len(indexPositions(db)))
 
 }
 
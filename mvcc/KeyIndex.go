@@ -6,6 +6,7 @@ type KeyIndex struct {
 	key         []byte       //原始的key
 	modified    Revision     //最新修改的revision信息
 	generations []generation //当前key的generation信息
+	snapshot    uint64       //最后一次修改的时候treeIndex的快照编号，之后获得了新的快照的时候需要拷贝一份再修改
 }
 
 var (
@@ -108,7 +109,42 @@ func (KI *KeyIndex) doCompact(atRev int64) (genIdx int, revIdx int) {
 	return 0, 0
 }
 
+//deleted 判断rev是否在一个已经被删除的generation中，也就是说之后添加了墓碑
+func (KI *KeyIndex) deleted(rev Revision) bool {
+	//最后一个generation是活跃的，没有墓碑
+	for i := 0; i < len(KI.generations)-1; i++ {
+		for _, r := range KI.generations[i].revs {
+			if r == rev {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//clone 拷贝一份keyIndex，修改拷贝不会影响快照中的keyIndex
+func (KI *KeyIndex) clone() *KeyIndex {
+	generations := make([]generation, len(KI.generations))
+	for i, g := range KI.generations {
+		generations[i] = generation{created: g.created, revs: append([]Revision(nil), g.revs...)}
+	}
+	return &KeyIndex{key: KI.key, modified: KI.modified, generations: generations}
+}
+
 //IsEmpty 如果当前的generation是空的
 func (KI *KeyIndex) IsEmpty() bool {
 	return len(KI.generations) == 1 && KI.generations[0].IsEmpty()
 }
+
+//events 获得重放之后可以恢复出当前keyIndex的所有修改
+//除了最后一个generation之外，每个generation的最后一个revision都是删除时添加的墓碑
+func (KI *KeyIndex) events() []Event {
+	var events []Event
+	lastg := len(KI.generations) - 1
+	for i, g := range KI.generations {
+		for j, rev := range g.revs {
+			events = append(events, Event{Rev: rev, Tombstone: i != lastg && j == len(g.revs)-1})
+		}
+	}
+	return events
+}
@@ -69,6 +69,21 @@ func TestTreeIndex1(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+//删除之前的版本被标记为已删除，重新写入之后的版本不受影响
+func TestTreeIndexDeleted(t *testing.T) {
+	ti := NewTreeIndex()
+	ti.Put([]byte("foo"), Revision{1, 0})
+	ti.Put([]byte("foo"), Revision{2, 0})
+	assert.False(t, ti.Deleted([]byte("foo"), Revision{2, 0}))
+	_, err := ti.Tombstone([]byte("foo"), Revision{3, 0})
+	assert.Nil(t, err)
+	ti.Put([]byte("foo"), Revision{4, 0})
+	assert.True(t, ti.Deleted([]byte("foo"), Revision{1, 0}))
+	assert.True(t, ti.Deleted([]byte("foo"), Revision{2, 0}))
+	assert.False(t, ti.Deleted([]byte("foo"), Revision{4, 0}))
+	assert.False(t, ti.Deleted([]byte("bar"), Revision{1, 0}))
+}
+
 //进行正常的测试
 func TestTreeIndex2(t *testing.T) {
 	ti := NewTreeIndex() //创建一个treeIndex对像
@@ -77,3 +92,73 @@ func TestTreeIndex2(t *testing.T) {
 	assert.Nil(t, rev)
 	assert.Equal(t, ErrRevisionNotFound, err)
 }
+
+//按照Ascend得到的修改重放之后，版本索引和原来的一致
+func TestTreeIndexAscend(t *testing.T) {
+	ti := NewTreeIndex()
+	ti.Put([]byte("a"), Revision{1, 0})
+	ti.Put([]byte("a"), Revision{2, 0})
+	_, err := ti.Tombstone([]byte("a"), Revision{3, 0})
+	assert.Nil(t, err)
+	ti.Put([]byte("a"), Revision{4, 0})
+	ti.Put([]byte("b"), Revision{5, 0})
+
+	replayed := NewTreeIndex()
+	var keys []string
+	ti.Ascend(func(key []byte, events []Event) bool {
+		keys = append(keys, string(key))
+		for _, e := range events {
+			if e.Tombstone {
+				_, err := replayed.Tombstone(key, e.Rev)
+				assert.Nil(t, err)
+			} else {
+				replayed.Put(key, e.Rev)
+			}
+		}
+		return true
+	})
+	assert.Equal(t, []string{"a", "b"}, keys)
+	for _, key := range []string{"a", "b"} {
+		for rev := int64(1); rev <= 6; rev++ {
+			expected, _ := ti.Get([]byte(key), rev)
+			actual, _ := replayed.Get([]byte(key), rev)
+			assert.Equal(t, expected, actual)
+		}
+	}
+}
+
+//获得快照之后的修改对快照不可见，快照之后的修改也不受快照的影响
+func TestTreeIndexSnapshot(t *testing.T) {
+	ti := NewTreeIndex()
+	ti.Put([]byte("a"), Revision{1, 0})
+	ti.Put([]byte("b"), Revision{2, 0})
+	snapshot := ti.Snapshot()
+
+	ti.Put([]byte("a"), Revision{3, 0})
+	_, err := ti.Tombstone([]byte("b"), Revision{4, 0})
+	assert.Nil(t, err)
+	ti.Put([]byte("c"), Revision{5, 0})
+
+	var keys []string
+	snapshot.Ascend(func(key []byte, events []Event) bool {
+		keys = append(keys, string(key))
+		assert.Equal(t, 1, len(events))
+		return true
+	})
+	assert.Equal(t, []string{"a", "b"}, keys)
+	rev, _ := snapshot.Get([]byte("a"), 6)
+	assert.Equal(t, &Revision{1, 0}, rev)
+	assert.False(t, snapshot.Deleted([]byte("b"), Revision{2, 0}))
+
+	rev, _ = ti.Get([]byte("a"), 6)
+	assert.Equal(t, &Revision{3, 0}, rev)
+	assert.True(t, ti.Deleted([]byte("b"), Revision{2, 0}))
+
+	//再次获得快照之后，之前拷贝过的keyIndex也需要重新拷贝
+	second := ti.Snapshot()
+	ti.Put([]byte("a"), Revision{6, 0})
+	rev, _ = second.Get([]byte("a"), 7)
+	assert.Equal(t, &Revision{3, 0}, rev)
+	rev, _ = ti.Get([]byte("a"), 7)
+	assert.Equal(t, &Revision{6, 0}, rev)
+}
@@ -61,3 +61,23 @@ func (bt *BTree) Put(key []byte, ki *KeyIndex) *KeyIndex {
 	}
 	return oldItem.(*ItemM).ki
 }
+
+//Clone 获得btree写时复制的拷贝，之后两个btree的修改互不影响
+func (bt *BTree) Clone() *BTree {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	return &BTree{
+		tree: bt.tree.Clone(),
+		lock: new(sync.RWMutex),
+	}
+}
+
+//Ascend 按照key从小到大的顺序遍历所有的KeyIndex，fn返回false的时候停止遍历
+func (bt *BTree) Ascend(fn func(key []byte, ki *KeyIndex) bool) {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
+	bt.tree.Ascend(func(item btree.Item) bool {
+		it := item.(*ItemM)
+		return fn(it.key, it.ki)
+	})
+}
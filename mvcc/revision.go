@@ -17,3 +17,11 @@ func (r *Revision) Encode() []byte {
 	binary.BigEndian.PutUint64(buf[8:], uint64(r.Sub))
 	return buf
 }
+
+//DecodeRevision 从16个字节的数组中解码出Revision
+func DecodeRevision(buf []byte) Revision {
+	return Revision{
+		Main: int64(binary.BigEndian.Uint64(buf[0:])),
+		Sub:  int64(binary.BigEndian.Uint64(buf[8:])),
+	}
+}
@@ -6,8 +6,9 @@ import (
 
 //TreeIndex 使用btree来存储，index中的key存储的是就是key,value里面存储的就是一个keyIndex对象
 type TreeIndex struct {
-	tree *BTree //这里直接使用btree
-	lock sync.RWMutex
+	tree     *BTree //这里直接使用btree
+	lock     sync.RWMutex
+	snapshot uint64 //获得快照的次数，keyIndex在获得快照之后第一次修改的时候拷贝一份，快照中的keyIndex保持不变
 }
 
 //NewTreeIndex 初始化一个treeIndex
@@ -33,10 +34,10 @@ func (ti *TreeIndex) Get(key []byte, rev int64) (*Revision, error) {
 func (ti *TreeIndex) Put(key []byte, rev Revision) {
 	ti.lock.Lock()
 	defer ti.lock.Unlock()
-	ki := ti.tree.Get(key) //先从btree中的得到他对应的keyIndex对象
+	ki := ti.mutable(key) //先从btree中的得到他对应的keyIndex对象
 	if ki == nil {
 		//说明当前是第一次进来,给这个ki进行初始化一下
-		ki = &KeyIndex{key: key}
+		ki = &KeyIndex{key: key, snapshot: ti.snapshot}
 	}
 	//这个地方说明他成功得到了，就可以直接进行插入了
 	ki.put(rev.Main, rev.Sub)
@@ -48,7 +49,7 @@ func (ti *TreeIndex) Put(key []byte, rev Revision) {
 func (ti *TreeIndex) Tombstone(key []byte, rev Revision) (*Revision, error) {
 	ti.lock.Lock()
 	defer ti.lock.Unlock()
-	ki := ti.tree.Get(key)
+	ki := ti.mutable(key)
 	if ki == nil {
 		return nil, ErrRevisionNotFound
 	}
@@ -60,6 +61,52 @@ func (ti *TreeIndex) Tombstone(key []byte, rev Revision) (*Revision, error) {
 	return oldRev, nil
 }
 
+//mutable 获得key对应的可以修改的keyIndex，获得快照之后第一次修改的时候拷贝一份，修改完之后需要重新放回到btree中
+func (ti *TreeIndex) mutable(key []byte) *KeyIndex {
+	ki := ti.tree.Get(key)
+	if ki != nil && ki.snapshot != ti.snapshot {
+		ki = ki.clone()
+		ki.snapshot = ti.snapshot
+	}
+	return ki
+}
+
+//Snapshot 获得当前版本索引的只读快照，之后的修改对快照不可见
+//btree和keyIndex都是写时复制的，获得快照的代价和版本的数量无关
+func (ti *TreeIndex) Snapshot() *TreeIndex {
+	ti.lock.Lock()
+	defer ti.lock.Unlock()
+	ti.snapshot++
+	return &TreeIndex{tree: ti.tree.Clone(), snapshot: ti.snapshot}
+}
+
+//Deleted 判断key的rev版本之后是否已经被删除了，版本索引中没有这个key的时候返回false
+func (ti *TreeIndex) Deleted(key []byte, rev Revision) bool {
+	ti.lock.RLock()
+	defer ti.lock.RUnlock()
+	ki := ti.tree.Get(key)
+	if ki == nil {
+		return false
+	}
+	return ki.deleted(rev)
+}
+
+//Event 版本索引中的一次修改，按照顺序重放一个key的所有Event就可以恢复出这个key的版本信息
+type Event struct {
+	Rev       Revision
+	Tombstone bool //是否是删除的时候添加的墓碑，重放的时候调用Tombstone，否则调用Put
+}
+
+//Ascend 按照key从小到大的顺序遍历版本索引，获得每个key的所有修改，fn返回false的时候停止遍历
+//遍历期间持有读锁，fn中不能修改版本索引
+func (ti *TreeIndex) Ascend(fn func(key []byte, events []Event) bool) {
+	ti.lock.RLock()
+	defer ti.lock.RUnlock()
+	ti.tree.Ascend(func(key []byte, ki *KeyIndex) bool {
+		return fn(key, ki.events())
+	})
+}
+
 ////
 //func (ti *TreeIndex) Compact(atRev int64) []Revision {
 //	//
@@ -1,17 +1,37 @@
 package FlexDB
 
+import (
+	"FlexDB/fio"
+	"FlexDB/logger"
+	"runtime"
+)
+
 type Options struct {
 	DirPath     string    //数据库数据目录
-	FileSize    uint64    //活跃文件的阈值
+	FileSize    uint64    //活跃文件的阈值，活跃文件会预分配到这个大小
 	SyncWrite   bool      //是否在每次写都进行持久化
 	IndexType   IndexType //索引类型
 	BytePerSync uint64    //累积写了多少字节后进行持久化
-	indexNum    int       //索引的个数
-	//TODO 添加后台线程来处理
-	TimeSync           uint    //每隔多少秒就进行一次持久化
-	MMapAtStartup      bool    //在启动的时候使用使用mmap来加载
-	DataFileMergeRatio float32 //数据文件的无效数据达到多少的数据文件多少比例进行merge的阈值
-	TimeGetStat        uint    //过多长时间获得db的状态
+	IndexNum    int       //索引实例的个数，B+树索引每次打开的时候需要保持一致
+	ShardType   ShardType //key分配到各个索引实例的方式，B+树索引每次打开的时候需要保持一致
+	//B树索引中key前缀压缩的长度，长度超过这个值的key会把这么多字节的前缀和其他的key共享，适合大量key有相同前缀的场景，为0表示不压缩
+	IndexKeyPrefixLen int
+	//是否将索引和版本信息的修改写入到wal中，开启之后重启的时候可以恢复历史版本，并且只需要扫描wal没有覆盖的数据文件
+	EnableWal bool
+	//可写的数据文件使用的IO类型，可以选择StanderFIO，DirectFio或者MMapRWFio
+	//DirectFio绕过页缓存，适合数据量远大于内存的场景，追加写入的时候会原地重写最后一个没有写满的块，断电的时候可能损坏这个块中已经持久化的数据，MMapRWFio将活跃文件预分配到FileSize之后映射到内存中，读取最近写入的数据不需要系统调用
+	DataFileIOType fio.IOManagerType
+	//后台任务的配置
+	TimeSync           uint          //每隔多少秒就进行一次持久化
+	MMapAtStartup      bool          //在启动的时候使用使用mmap来加载
+	DataFileMergeRatio float32       //数据文件的无效数据达到多少的数据文件多少比例进行merge的阈值
+	TimeGetStat        uint          //过多长时间获得db的状态
+	TimeCheckMerge     uint          //每隔多少秒检查一次是否需要进行merge
+	TimeCheckpoint     uint          //每隔多少秒将内存索引写入到checkpoint文件中，启动的时候只需要重放checkpoint之后的数据，为0表示不定期写入
+	TimeRebalanceShard uint          //范围分片的时候每隔多少秒检查一次分片中的数据是否均衡，为0表示不定期检查
+	LoadConcurrency    int           //启动的时候并行解码数据文件构建索引的goroutine数量
+	EventListener      EventListener //引擎生命周期事件的监听者，为空的时候不进行通知
+	Logger             logger.Logger //日志，兼容log/slog，为空的时候使用默认的日志
 }
 
 type IndexType = int8
@@ -19,10 +39,21 @@ type IndexType = int8
 const (
 	//Btree 索引
 	Btree IndexType = iota
-	//ART 自适应基数树索引
+	//ART 自适应基数树索引，带边界的遍历只能跳过边界公共前缀之外的子树，只有下边界的时候仍然需要从最小的key开始查找
 	ART
 	// BPT Bplus Tree 索引
 	BPT
+	//Skiplist 跳表索引，读操作不加锁，适合读多写少的并发场景
+	Skiplist
+)
+
+type ShardType = int8
+
+const (
+	//HashShard 通过一致性哈希将key分配到各个索引实例中，写入分布均匀，但是遍历需要归并所有的索引实例
+	HashShard ShardType = iota
+	//RangeShard 按照key的范围划分索引实例，前缀和范围遍历只需要访问相关的索引实例，热点范围可以分裂和合并
+	RangeShard
 )
 
 var DefaultOperations = Options{
@@ -30,12 +61,20 @@ var DefaultOperations = Options{
 	FileSize:           256 * 1024 * 1024, //256MB
 	SyncWrite:          false,
 	IndexType:          Btree,
-	indexNum:           5,
+	IndexNum:           5,
+	ShardType:          HashShard,
+	IndexKeyPrefixLen:  0,
+	EnableWal:          false,
+	DataFileIOType:     fio.StanderFIO,
 	BytePerSync:        0,
 	TimeSync:           2, //2s触发一次刷盘操作
 	MMapAtStartup:      true,
 	DataFileMergeRatio: 0.5,
 	TimeGetStat:        1,
+	TimeCheckMerge:     10,
+	TimeCheckpoint:     60,
+	TimeRebalanceShard: 10,
+	LoadConcurrency:    runtime.NumCPU(),
 }
 
 //IteratorOptions 索引迭代器的配置项
@@ -44,11 +83,23 @@ type IteratorOptions struct {
 	Prefix []byte
 	//是否为反向遍历
 	Reverse bool
+	//遍历的下边界，只遍历大于等于LowerBound的key，默认为空表示不限制
+	LowerBound []byte
+	//遍历的上边界，只遍历小于UpperBound的key，默认为空表示不限制
+	UpperBound []byte
+	//读版本号，只能看到在这个版本号之前写入的数据，默认为0表示读取最新的数据
+	Revision int64
+	//只遍历key，Value返回空，不会读取数据文件，适合只需要key或者统计数量和大小的遍历
+	KeysOnly bool
 }
 
 var DefaultIteratorOptions = IteratorOptions{
-	Prefix:  nil,
-	Reverse: false,
+	Prefix:     nil,
+	Reverse:    false,
+	LowerBound: nil,
+	UpperBound: nil,
+	Revision:   0,
+	KeysOnly:   false,
 }
 
 type WriteBatchOptions struct {
@@ -0,0 +1,323 @@
+package FlexDB
+
+import (
+	"FlexDB/index"
+	"bytes"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+	范围分片
+	每个索引实例负责一段连续的key范围[start, 下一个分片的start)，第一个分片没有下界，最后一个分片没有上界
+	前缀遍历和范围遍历只需要访问和边界有交集的索引实例，不需要归并所有的索引实例
+	初始的时候按照key的前两个字节均匀的划分范围，写入集中的热点范围可以通过SplitShard分裂成两个分片，冷的相邻分片可以通过MergeShard合并
+	后台任务定期调用RebalanceShards，分裂数据最多的分片，同时合并数据最少的相邻分片，分片的个数保持不变
+	分裂和合并只会拷贝涉及到的分片，其他分片的索引实例在新旧的分片之间共享
+*/
+
+const (
+	maxInitialRangeShards = 1 << 16 //初始的边界使用两个字节，最多划分出这么多个分片
+	minSplitShardKeyNum   = 1024    //分片中的数据少于这个值的时候不会被自动分裂
+)
+
+//rangeRouter 按照key的范围分配索引实例
+type rangeRouter struct {
+	starts [][]byte //每个索引实例负责的范围的起始key，从小到大排序，第一个为空表示没有下界
+	names  []string //和starts一一对应的索引实例的名字
+	nextId int      //下一个新建的索引实例的编号，保证名字不重复
+}
+
+//newRangeRouter 按照key的前两个字节均匀的划分出num个范围
+func newRangeRouter(num int) *rangeRouter {
+	router := &rangeRouter{
+		starts: make([][]byte, num),
+		names:  make([]string, num),
+		nextId: num,
+	}
+	for i := 0; i < num; i++ {
+		if i > 0 {
+			start := i * maxInitialRangeShards / num
+			router.starts[i] = []byte{byte(start >> 8), byte(start)}
+		}
+		router.names[i] = "index" + strconv.Itoa(i)
+	}
+	return router
+}
+
+//find 获得key所在的分片的下标
+func (router *rangeRouter) find(key []byte) int {
+	return sort.Search(len(router.starts), func(i int) bool {
+		return bytes.Compare(router.starts[i], key) > 0
+	}) - 1
+}
+
+func (router *rangeRouter) route(key []byte) (string, error) {
+	return router.names[router.find(key)], nil
+}
+
+//routeRange 从lowerBound所在的分片开始，到起始key小于upperBound的最后一个分片为止
+func (router *rangeRouter) routeRange(lowerBound, upperBound []byte) []string {
+	first, last := 0, len(router.names)-1
+	if lowerBound != nil {
+		first = router.find(lowerBound)
+	}
+	if upperBound != nil {
+		last = sort.Search(len(router.starts), func(i int) bool {
+			return i > 0 && bytes.Compare(router.starts[i], upperBound) >= 0
+		}) - 1
+	}
+	if last < first {
+		return nil
+	}
+	return router.names[first : last+1]
+}
+
+func (router *rangeRouter) nodes() []string {
+	return router.names
+}
+
+//bounds 获得第i个分片负责的范围
+func (router *rangeRouter) bounds(i int) ([]byte, []byte) {
+	if i+1 < len(router.starts) {
+		return router.starts[i], router.starts[i+1]
+	}
+	return router.starts[i], nil
+}
+
+//newName 获得一个新的索引实例的名字
+func (router *rangeRouter) newName() string {
+	name := "index" + strconv.Itoa(router.nextId)
+	router.nextId++
+	return name
+}
+
+//clone 拷贝一份路由，分裂和合并的时候在拷贝上修改，不影响正在使用旧路由的读操作
+func (router *rangeRouter) clone() *rangeRouter {
+	return &rangeRouter{
+		starts: append([][]byte(nil), router.starts...),
+		names:  append([]string(nil), router.names...),
+		nextId: router.nextId,
+	}
+}
+
+//SplitShard 将key所在的范围分片从key的位置分裂成两个分片，key属于后一个分片
+//期间会阻塞写操作，读操作仍然可以读取旧的分片
+func (db *DB) SplitShard(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if db.options.IndexType == BPT {
+		return ErrReshardUnsupported
+	}
+	db.indexMu.Lock()
+	defer db.indexMu.Unlock()
+	return db.splitShard(key)
+}
+
+//MergeShard 将key所在的范围分片和它后面的一个分片合并成一个分片
+//期间会阻塞写操作，读操作仍然可以读取旧的分片
+func (db *DB) MergeShard(key []byte) error {
+	if db.options.IndexType == BPT {
+		return ErrReshardUnsupported
+	}
+	db.indexMu.Lock()
+	defer db.indexMu.Unlock()
+	router, ok := db.indexShards().router.(*rangeRouter)
+	if !ok {
+		return ErrNotRangeShard
+	}
+	return db.mergeShard(router.find(key))
+}
+
+//RebalanceShards 将数据最多的范围分片从中间分裂成两个，同时合并数据最少的两个相邻分片，分片的个数保持不变
+//只有数据最多的分片超过平均值的两倍的时候才会进行调整，返回是否进行了调整
+//除了分裂出来的两个分片之外没有可以合并的相邻分片的时候，分片的个数会增加一个
+func (db *DB) RebalanceShards() (bool, error) {
+	if db.options.IndexType == BPT {
+		return false, ErrReshardUnsupported
+	}
+	db.indexMu.Lock()
+	defer db.indexMu.Unlock()
+	shards := db.indexShards()
+	router, ok := shards.router.(*rangeRouter)
+	if !ok {
+		return false, ErrNotRangeShard
+	}
+	//找到数据最多的分片
+	var hot, total int
+	sizes := make([]int, len(router.names))
+	for i, node := range router.names {
+		sizes[i] = shards.index[node].Size()
+		total += sizes[i]
+		if sizes[i] > sizes[hot] {
+			hot = i
+		}
+	}
+	if sizes[hot] < minSplitShardKeyNum || sizes[hot]*len(sizes) <= 2*total {
+		return false, nil
+	}
+	splitKey, err := medianKey(shards.index[router.names[hot]], router.starts[hot])
+	if err != nil {
+		return false, err
+	}
+	if splitKey == nil {
+		return false, nil
+	}
+	if err := db.splitShard(splitKey); err != nil {
+		return false, err
+	}
+
+	//分裂之后hot和hot+1是分裂出来的两个分片，合并其他数据最少的相邻分片
+	//分裂出来的两个分片都不参与合并，避免刚分裂出来的一半又和相邻的分片合并到一起
+	shards = db.indexShards()
+	router = shards.router.(*rangeRouter)
+	cold := -1
+	var coldSize int
+	for i := 0; i+1 < len(router.names); i++ {
+		if i >= hot-1 && i <= hot+1 {
+			continue
+		}
+		size := shards.index[router.names[i]].Size() + shards.index[router.names[i+1]].Size()
+		if cold < 0 || size < coldSize {
+			cold, coldSize = i, size
+		}
+	}
+	if cold >= 0 {
+		if err := db.mergeShard(cold); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+//medianKey 获得索引实例中位于中间的数据对应的用户key，作为分裂的位置，同一个key的多个版本会在同一个分片中
+func medianKey(idx index.Indexer, start []byte) ([]byte, error) {
+	iter, err := idx.Iterator(false)
+	if err != nil {
+		return nil, indexReadError(err)
+	}
+	defer iter.Close()
+	for i := idx.Size() / 2; i > 0 && iter.Valid(); i-- {
+		iter.Next()
+	}
+	if !iter.Valid() {
+		return nil, nil
+	}
+	key := iter.Key()
+	if userKey, _ := parseKeyWithRevision(key); bytes.Compare(userKey, start) > 0 {
+		key = userKey
+	}
+	if bytes.Compare(key, start) <= 0 {
+		return nil, nil
+	}
+	return append([]byte(nil), key...), nil
+}
+
+//splitShard 分裂key所在的分片，需要持有indexMu的写锁
+func (db *DB) splitShard(key []byte) error {
+	start := time.Now()
+	oldShards := db.indexShards()
+	router, ok := oldShards.router.(*rangeRouter)
+	if !ok {
+		return ErrNotRangeShard
+	}
+	i := router.find(key)
+	if bytes.Equal(router.starts[i], key) {
+		//key已经是分片的起始位置了
+		return ErrInvalidSplitKey
+	}
+	oldNode := router.names[i]
+	newRouter := router.clone()
+	leftNode, rightNode := newRouter.newName(), newRouter.newName()
+	newRouter.starts = append(newRouter.starts[:i+1], append([][]byte{append([]byte(nil), key...)}, newRouter.starts[i+1:]...)...)
+	newRouter.names = append(newRouter.names[:i], append([]string{leftNode, rightNode}, newRouter.names[i+1:]...)...)
+
+	left, err := newIndexer(db.options, leftNode)
+	if err != nil {
+		return err
+	}
+	right, err := newIndexer(db.options, rightNode)
+	if err != nil {
+		return err
+	}
+	iter, err := oldShards.index[oldNode].Iterator(false)
+	if err != nil {
+		return indexReadError(err)
+	}
+	for ; iter.Valid(); iter.Next() {
+		target := right
+		if bytes.Compare(iter.Key(), key) < 0 {
+			target = left
+		}
+		if _, err := target.Put(iter.Key(), iter.Value()); err != nil {
+			iter.Close()
+			return indexUpdateError(err)
+		}
+	}
+	iter.Close()
+
+	db.replaceShards(oldShards, newRouter, []string{oldNode}, map[string]index.Indexer{leftNode: left, rightNode: right})
+	db.options.Logger.Info("index shard split", "dir", db.options.DirPath, "shard", oldNode, "key", string(key), "left", left.Size(), "right", right.Size(), "duration", time.Since(start))
+	return nil
+}
+
+//mergeShard 将第i个分片和第i+1个分片合并，需要持有indexMu的写锁
+func (db *DB) mergeShard(i int) error {
+	start := time.Now()
+	oldShards := db.indexShards()
+	router := oldShards.router.(*rangeRouter)
+	if i+1 >= len(router.names) {
+		return ErrNoAdjacentShard
+	}
+	leftNode, rightNode := router.names[i], router.names[i+1]
+	newRouter := router.clone()
+	node := newRouter.newName()
+	newRouter.starts = append(newRouter.starts[:i+1], newRouter.starts[i+2:]...)
+	newRouter.names = append(newRouter.names[:i], append([]string{node}, newRouter.names[i+2:]...)...)
+
+	merged, err := newIndexer(db.options, node)
+	if err != nil {
+		return err
+	}
+	for _, oldNode := range []string{leftNode, rightNode} {
+		iter, err := oldShards.index[oldNode].Iterator(false)
+		if err != nil {
+			return indexReadError(err)
+		}
+		for ; iter.Valid(); iter.Next() {
+			if _, err := merged.Put(iter.Key(), iter.Value()); err != nil {
+				iter.Close()
+				return indexUpdateError(err)
+			}
+		}
+		iter.Close()
+	}
+
+	db.replaceShards(oldShards, newRouter, []string{leftNode, rightNode}, map[string]index.Indexer{node: merged})
+	db.options.Logger.Info("index shard merge", "dir", db.options.DirPath, "left", leftNode, "right", rightNode, "shard", node, "keys", merged.Size(), "duration", time.Since(start))
+	return nil
+}
+
+//replaceShards 使用新的路由替换当前的分片，没有变化的索引实例在新旧分片之间共享
+func (db *DB) replaceShards(oldShards *indexShards, router shardRouter, removed []string, added map[string]index.Indexer) {
+	newShards := &indexShards{
+		router: router,
+		index:  make(map[string]index.Indexer, len(oldShards.index)-len(removed)+len(added)),
+	}
+	for node, idx := range oldShards.index {
+		newShards.index[node] = idx
+	}
+	for _, node := range removed {
+		delete(newShards.index, node)
+	}
+	for node, idx := range added {
+		newShards.index[node] = idx
+	}
+	db.shards.Store(newShards)
+	//正在进行的读操作可能还持有旧的索引实例，内存索引的关闭不会释放其中的数据，不影响这些读操作
+	for _, node := range removed {
+		_ = oldShards.index[node].Close()
+	}
+}
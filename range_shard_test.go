@@ -0,0 +1,189 @@
+package FlexDB
+
+import (
+	"FlexDB/utils"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRangeRouter(t *testing.T) {
+	router := newRangeRouter(4)
+	assert.Equal(t, [][]byte{nil, {0x40, 0}, {0x80, 0}, {0xc0, 0}}, router.starts)
+
+	node, err := router.route([]byte{0})
+	assert.Nil(t, err)
+	assert.Equal(t, "index0", node)
+	node, _ = router.route([]byte{0x40, 0})
+	assert.Equal(t, "index1", node)
+	node, _ = router.route([]byte{0xff})
+	assert.Equal(t, "index3", node)
+
+	assert.Equal(t, router.names, router.routeRange(nil, nil))
+	assert.Equal(t, []string{"index1"}, router.routeRange([]byte{0x41}, []byte{0x42}))
+	assert.Equal(t, []string{"index1"}, router.routeRange([]byte{0x41}, []byte{0x80, 0}))
+	assert.Equal(t, []string{"index1", "index2"}, router.routeRange([]byte{0x41}, []byte{0x80, 1}))
+	assert.Equal(t, []string{"index0"}, router.routeRange(nil, []byte{0x01}))
+	assert.Equal(t, []string{"index3"}, router.routeRange([]byte{0xc1}, nil))
+}
+
+func TestDB_RangeShard(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.ShardType = RangeShard
+	opts.IndexNum = 4
+	opts.TimeRebalanceShard = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 3000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(16)))
+	}
+	assert.Nil(t, db.Put([]byte("a-key"), []byte("a")))
+	assert.Nil(t, db.Put([]byte("z-key"), []byte("z")))
+
+	//所有的测试key都在同一个分片中
+	stats := db.ShardStats()
+	assert.Equal(t, 4, len(stats))
+	assert.Equal(t, 3002, stats[1].KeyNum)
+
+	//前缀遍历只需要访问一个分片
+	iter := db.NewIterator(IteratorOptions{Prefix: []byte("TestKey-")})
+	assert.Equal(t, 1, len(iter.indexIters))
+	var count int
+	for ; iter.Valid(); iter.Next() {
+		count++
+	}
+	iter.Close()
+	assert.Equal(t, 3000, count)
+
+	//分裂热点分片
+	assert.Nil(t, db.SplitShard(utils.GetTestKey(1000)))
+	assert.Equal(t, ErrInvalidSplitKey, db.SplitShard(utils.GetTestKey(1000)))
+	stats = db.ShardStats()
+	assert.Equal(t, 5, len(stats))
+	assert.Equal(t, utils.GetTestKey(1000), stats[2].LowerBound)
+	assert.Equal(t, utils.GetTestKey(1000), stats[1].UpperBound)
+	assert.Equal(t, 1000, stats[1].KeyNum)
+	assert.Equal(t, 2002, stats[2].KeyNum)
+
+	iter = db.NewIterator(IteratorOptions{LowerBound: utils.GetTestKey(1500), UpperBound: utils.GetTestKey(1600)})
+	assert.Equal(t, 1, len(iter.indexIters))
+	iter.Close()
+	iter = db.NewIterator(IteratorOptions{LowerBound: utils.GetTestKey(500), UpperBound: utils.GetTestKey(1600)})
+	assert.Equal(t, 2, len(iter.indexIters))
+	iter.Close()
+
+	//分裂之后的读写
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("new")))
+	_, err = db.Delete(utils.GetTestKey(2000))
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), val)
+	_, err = db.Get(utils.GetTestKey(2000))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 3001, len(db.ListKeys(DefaultIteratorOptions)))
+
+	//合并分片
+	assert.Nil(t, db.MergeShard([]byte{0}))
+	stats = db.ShardStats()
+	assert.Equal(t, 4, len(stats))
+	assert.Equal(t, 1001, stats[0].KeyNum)
+	assert.Nil(t, stats[0].LowerBound)
+	assert.Equal(t, utils.GetTestKey(1000), stats[1].LowerBound)
+	assert.Equal(t, ErrNoAdjacentShard, db.MergeShard([]byte{0xff}))
+	for i := 0; i < 3000; i++ {
+		if i == 2000 {
+			continue
+		}
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
+
+//数据集中在一个分片中的时候，rebalance会分裂这个分片并合并空的分片，分片的个数保持不变
+func TestDB_RebalanceShards(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.ShardType = RangeShard
+	opts.IndexNum = 4
+	opts.TimeRebalanceShard = 0
+	opts.TimeCheckpoint = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 8000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(16)))
+	}
+	expected := indexSnapshot(db)
+
+	ok, err := db.RebalanceShards()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	stats := db.ShardStats()
+	assert.Equal(t, 4, len(stats))
+	for _, stat := range stats {
+		assert.True(t, stat.KeyNum <= 4000)
+	}
+	assert.Equal(t, expected, indexSnapshot(db))
+	//已经均衡了
+	ok, err = db.RebalanceShards()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	//重新打开之后按照IndexNum均匀的划分
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(db.ShardStats()))
+	assert.Equal(t, len(expected), len(indexPositions(db)))
+}
+
+//rebalance分裂出来的两个分片不会在同一次调整中又和相邻的分片合并
+func TestDB_RebalanceShards_KeepSplit(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.ShardType = RangeShard
+	opts.IndexNum = 4
+	opts.TimeRebalanceShard = 0
+	opts.TimeCheckpoint = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	//第一个分片为空，测试key都在第二个分片中，后面两个分片中也有数据
+	for i := 0; i < 8000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(16)))
+	}
+	for i := 0; i < 3000; i++ {
+		assert.Nil(t, db.Put(append([]byte{0x90}, utils.GetTestKey(i)...), utils.RandomValue(16)))
+		assert.Nil(t, db.Put(append([]byte{0xd0}, utils.GetTestKey(i)...), utils.RandomValue(16)))
+	}
+	expected := indexSnapshot(db)
+
+	ok, err := db.RebalanceShards()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	stats := db.ShardStats()
+	assert.Equal(t, 4, len(stats))
+	//第一个分片和分裂出来的一半的数据加起来最少，但是不会被合并，合并的是后面两个分片
+	assert.Equal(t, 0, stats[0].KeyNum)
+	assert.Equal(t, 8000, stats[1].KeyNum+stats[2].KeyNum)
+	assert.True(t, stats[1].KeyNum > 0 && stats[2].KeyNum > 0)
+	assert.Equal(t, 6000, stats[3].KeyNum)
+	assert.Equal(t, expected, indexSnapshot(db))
+}
+
+func TestDB_RangeShardHashMismatch(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrNotRangeShard, db.SplitShard([]byte("key")))
+	_, err = db.RebalanceShards()
+	assert.Equal(t, ErrNotRangeShard, err)
+
+	opts.ShardType = 10
+	_, err = Open(opts)
+	assert.Equal(t, ErrShardTypeInvalid, err)
+}
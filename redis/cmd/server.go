@@ -2,9 +2,9 @@ package cmd
 
 import (
 	"FlexDB"
+	"FlexDB/logger"
 	"FlexDB/redis/type"
 	"github.com/tidwall/redcon"
-	"log"
 	"sync"
 )
 
@@ -13,25 +13,30 @@ const addr = "127.0.0.1:6380"
 type cmdHandler func(cli *FlexClient, args [][]byte) (interface{}, error)
 
 type FlexServer struct {
-	db *_type.RedisDataStruct //用户的数据库，允许开16个
-	mu *sync.RWMutex
+	db     *_type.RedisDataStruct //用户的数据库，允许开16个
+	mu     *sync.RWMutex
+	logger logger.Logger //服务的日志，和数据库使用同一个日志
 }
 
 func NewFlexServer() (*FlexServer, error) {
 	//默认是打开redis数据结构的服务
-	rds, err := _type.NewRedisDataStruct(FlexDB.DefaultOperations)
+	options := FlexDB.DefaultOperations
+	rds, err := _type.NewRedisDataStruct(options)
 	if err != nil {
 		panic(err)
 	}
 	dbSvr := &FlexServer{
-		db: rds,
-		mu: new(sync.RWMutex),
+		db:     rds,
+		mu:     new(sync.RWMutex),
+		logger: logger.OrDefault(options.Logger),
 	}
+	//ListenAndServe会一直阻塞，所以需要在启动之前输出日志
+	dbSvr.logger.Info("FlexDB server running,ready to accept connection", "addr", addr)
 	err = redcon.ListenAndServe(addr, execClientCommand, dbSvr.Accept, dbSvr.Close)
 	if err != nil {
+		dbSvr.logger.Error("FlexDB server exit", "addr", addr, "err", err)
 		return nil, err
 	}
-	log.Println("FlexDB server running,ready to accept connection")
 	return dbSvr, nil
 }
 
@@ -49,5 +54,8 @@ func (svr *FlexServer) Accept(conn redcon.Conn) bool {
 
 // Close 关闭实例
 func (svr *FlexServer) Close(conn redcon.Conn, err error) {
+	if err != nil {
+		svr.logger.Warn("connection closed with error", "remote", conn.RemoteAddr(), "err", err)
+	}
 	svr.db.Close()
 }
@@ -0,0 +1,216 @@
+package FlexDB
+
+import (
+	"FlexDB/index"
+	"sort"
+	"stathat.com/c/consistent"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	索引分片
+	key通过shardRouter分配到多个索引实例中，降低单个索引上的锁竞争
+	哈希分片通过一致性哈希环分配key，范围分片按照key的范围分配，范围遍历只需要访问相关的索引实例
+	路由和索引实例作为一个整体保存在atomic.Value中，读操作原子地拿到当前的分片，不需要加锁
+	reshard的时候构造一组新的分片，把旧分片中的数据拷贝过去之后再整体替换，拷贝期间读操作仍然读取旧的分片，不会被阻塞
+	写操作在更新索引期间持有indexMu的读锁，reshard的时候持有写锁，保证拷贝期间旧的分片不会再被修改
+*/
+
+//shardRouter 决定key属于哪一个索引实例
+type shardRouter interface {
+	//route 获得key所在的索引实例的名字
+	route(key []byte) (string, error)
+	//routeRange 获得可能包含[lowerBound, upperBound)范围内的key的索引实例的名字，边界为空表示不限制
+	routeRange(lowerBound, upperBound []byte) []string
+	//nodes 所有索引实例的名字，范围分片按照范围从小到大排序
+	nodes() []string
+}
+
+//hashRouter 一致性哈希环，用来保证数据负载均衡式的分配到各个索引中
+type hashRouter struct {
+	ring  *consistent.Consistent
+	names []string
+}
+
+func newHashRouter(num int) *hashRouter {
+	router := &hashRouter{ring: consistent.New(), names: make([]string, 0, num)}
+	for i := 0; i < num; i++ {
+		node := "index" + strconv.Itoa(i)
+		router.ring.Add(node)
+		router.names = append(router.names, node)
+	}
+	sort.Strings(router.names)
+	return router
+}
+
+func (router *hashRouter) route(key []byte) (string, error) {
+	return router.ring.Get(string(key))
+}
+
+//routeRange 哈希分片中任何一个索引实例都可能包含范围内的key
+func (router *hashRouter) routeRange(lowerBound, upperBound []byte) []string {
+	return router.names
+}
+
+func (router *hashRouter) nodes() []string {
+	return router.names
+}
+
+//indexShards 分片的路由和对应的索引实例
+type indexShards struct {
+	router shardRouter              //决定key属于哪一个索引实例
+	index  map[string]index.Indexer //索引实例的名字对应的索引实例
+}
+
+//newIndexShards 按照配置的分片方式创建num个索引实例，创建失败的时候关闭已经创建的索引实例
+func newIndexShards(options Options, num int) (*indexShards, error) {
+	var router shardRouter
+	if options.ShardType == RangeShard {
+		router = newRangeRouter(num)
+	} else {
+		router = newHashRouter(num)
+	}
+	shards := &indexShards{
+		router: router,
+		index:  make(map[string]index.Indexer, num),
+	}
+	for _, node := range router.nodes() {
+		idx, err := newIndexer(options, node) //初始化内存索引
+		if err != nil {
+			_ = shards.close()
+			return nil, err
+		}
+		shards.index[node] = idx
+	}
+	return shards, nil
+}
+
+//newIndexer 创建一个索引实例，B+树索引使用名字作为文件名
+func newIndexer(options Options, name string) (index.Indexer, error) {
+	return index.NewIndex(options.IndexType, options.DirPath, name, options.SyncWrite, options.IndexKeyPrefixLen, options.Logger)
+}
+
+//get 获得key所在的索引实例
+func (shards *indexShards) get(key []byte) (index.Indexer, error) {
+	node, err := shards.router.route(key)
+	if err != nil {
+		return nil, err
+	}
+	return shards.index[node], nil
+}
+
+//close 关闭所有的索引实例
+func (shards *indexShards) close() error {
+	for _, idx := range shards.index {
+		if err := idx.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//checkIndexNum 检查索引实例的个数是否有效，范围分片初始的边界最多只能划分出1<<16个分片
+func checkIndexNum(shardType ShardType, num int) error {
+	if num <= 0 || (shardType == RangeShard && num > maxInitialRangeShards) {
+		return ErrIndexNumInvalid
+	}
+	return nil
+}
+
+//indexShards 获得当前的索引分片
+func (db *DB) indexShards() *indexShards {
+	return db.shards.Load().(*indexShards)
+}
+
+//Reshard 在线调整索引实例的个数，并将数据重新分配到新的索引实例中，范围分片会重新按照均匀的边界划分
+//期间会阻塞写操作，读操作仍然可以读取旧的索引实例，替换完成之后读取新的索引实例
+//B+树的索引是按照索引实例持久化到磁盘中的，不支持reshard
+//索引实例的个数不会被持久化，下一次Open的时候仍然使用Options中的IndexNum
+func (db *DB) Reshard(num int) error {
+	if err := checkIndexNum(db.options.ShardType, num); err != nil {
+		return err
+	}
+	if db.options.IndexType == BPT {
+		return ErrReshardUnsupported
+	}
+	db.indexMu.Lock()
+	defer db.indexMu.Unlock()
+	oldShards := db.indexShards()
+	if len(oldShards.index) == num {
+		return nil
+	}
+	start := time.Now()
+	newShards, err := newIndexShards(db.options, num)
+	if err != nil {
+		return err
+	}
+
+	//每个旧的索引实例启动一个goroutine，将数据拷贝到新的索引实例中，索引实例本身是并发安全的
+	var (
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		copyErr error
+	)
+	for _, idx := range oldShards.index {
+		wg.Add(1)
+		go func(idx index.Indexer) {
+			defer wg.Done()
+			iter, err := idx.Iterator(false)
+			if err != nil {
+				errOnce.Do(func() { copyErr = indexReadError(err) })
+				return
+			}
+			defer iter.Close()
+			for ; iter.Valid(); iter.Next() {
+				newIdx, err := newShards.get(iter.Key())
+				if err != nil {
+					errOnce.Do(func() { copyErr = err })
+					return
+				}
+				if _, err := newIdx.Put(iter.Key(), iter.Value()); err != nil {
+					errOnce.Do(func() { copyErr = indexUpdateError(err) })
+					return
+				}
+			}
+		}(idx)
+	}
+	wg.Wait()
+	if copyErr != nil {
+		_ = newShards.close()
+		return copyErr
+	}
+
+	db.shards.Store(newShards)
+	//正在进行的读操作可能还持有旧的索引实例，内存索引的关闭不会释放其中的数据，不影响这些读操作
+	if err := oldShards.close(); err != nil {
+		return err
+	}
+	db.options.Logger.Info("index reshard", "dir", db.options.DirPath, "from", len(oldShards.index), "to", num, "duration", time.Since(start))
+	return nil
+}
+
+//ShardStat 索引分片的状态
+type ShardStat struct {
+	Name       string //索引实例的名字
+	LowerBound []byte //范围分片负责的key的下界(包含)，为空表示不限制，哈希分片总是为空
+	UpperBound []byte //范围分片负责的key的上界(不包含)，为空表示不限制，哈希分片总是为空
+	KeyNum     int    //索引实例中保存的数据个数
+	Memory     int64  //索引实例占用内存的估算值
+}
+
+//ShardStats 获得所有索引分片的状态，范围分片按照范围从小到大排序
+func (db *DB) ShardStats() []ShardStat {
+	shards := db.indexShards()
+	nodes := shards.router.nodes()
+	stats := make([]ShardStat, 0, len(nodes))
+	for i, node := range nodes {
+		stat := ShardStat{Name: node, KeyNum: shards.index[node].Size(), Memory: shards.index[node].MemoryUsage()}
+		if router, ok := shards.router.(*rangeRouter); ok {
+			stat.LowerBound, stat.UpperBound = router.bounds(i)
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
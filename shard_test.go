@@ -0,0 +1,124 @@
+package FlexDB
+
+import (
+	"FlexDB/utils"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestDB_IndexNumOption(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.IndexNum = 0
+	_, err := Open(opts)
+	assert.Equal(t, ErrIndexNumInvalid, err)
+
+	opts.IndexNum = 3
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(db.indexShards().index))
+}
+
+//reshard之后索引中的数据保持不变，并且每个key都在哈希环对应的索引实例中
+func TestDB_Reshard(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.TimeCheckpoint = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 1000; i++ {
+		_, err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	expected := indexSnapshot(db)
+
+	assert.Equal(t, ErrIndexNumInvalid, db.Reshard(0))
+	for _, num := range []int{8, 2, 2, 1} {
+		assert.Nil(t, db.Reshard(num))
+		shards := db.indexShards()
+		assert.Equal(t, num, len(shards.index))
+		assert.Equal(t, expected, indexSnapshot(db))
+		for node, idx := range shards.index {
+			iter, err := idx.Iterator(false)
+			assert.Nil(t, err)
+			for ; iter.Valid(); iter.Next() {
+				owner, err := shards.router.route(iter.Key())
+				assert.Nil(t, err)
+				assert.Equal(t, node, owner)
+			}
+			iter.Close()
+		}
+	}
+	for i := 1000; i < 5000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	//reshard之后的写入和删除都在新的索引实例中
+	assert.Nil(t, db.Put(utils.GetTestKey(0), []byte("value")))
+	_, err = db.Delete(utils.GetTestKey(1000))
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+	_, err = db.Get(utils.GetTestKey(1000))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+//reshard期间并发的读写不会丢失数据
+func TestDB_ReshardConcurrent(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.TimeCheckpoint = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 2000; i < 4000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for _, num := range []int{7, 3, 9, 4} {
+			assert.Nil(t, db.Reshard(num))
+		}
+	}()
+	wg.Wait()
+
+	assert.Equal(t, 4, len(db.indexShards().index))
+	assert.Equal(t, 4000, len(db.ListKeys(DefaultIteratorOptions)))
+}
+
+func TestDB_ReshardBPT(t *testing.T) {
+	opts := DefaultOperations
+	opts.DirPath = DirPath
+	opts.IndexType = BPT
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrReshardUnsupported, db.Reshard(3))
+}
@@ -0,0 +1,77 @@
+package test
+
+import (
+	"FlexDB/fio"
+	"FlexDB/utils"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//跨越对齐块的追加写入，重新打开之后继续追加，文件大小和内容都和写入的一致
+func TestDirectIO_Append(t *testing.T) {
+	path := filepath.Join(DirPath, "direct.data")
+	defer destroyFile(path)
+	dio, err := fio.NewDirectIOManager(path)
+	assert.Nil(t, err)
+	if !dio.Direct() {
+		//tmpfs等文件系统上退化为普通的读写，不能测试O_DIRECT的对齐写入
+		_ = dio.Close()
+		t.Skip("file system does not support O_DIRECT")
+	}
+
+	var expected []byte
+	for i := 0; i < 20; i++ {
+		value := utils.RandomValue(1000 + i*37)
+		n, err := dio.Write(value)
+		assert.Nil(t, err)
+		assert.Equal(t, len(value), n)
+		expected = append(expected, value...)
+	}
+	size, err := dio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(expected)), size)
+	//文件中按照对齐的块写入
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), stat.Size()%4096)
+	assert.True(t, stat.Size() > size)
+	//最后一个块中填充的0不能被读取到
+	buf := make([]byte, 10)
+	n, err := dio.Read(buf, int64(len(expected)-5))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 5, n)
+	assert.Nil(t, dio.Close())
+	//关闭的时候去掉填充的0
+	stat, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(expected)), stat.Size())
+
+	dio, err = fio.NewDirectIOManager(path)
+	assert.Nil(t, err)
+	defer dio.Close()
+	size, err = dio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(expected)), size)
+	value := utils.RandomValue(5000)
+	_, err = dio.Write(value)
+	assert.Nil(t, err)
+	expected = append(expected, value...)
+
+	buf = make([]byte, len(expected))
+	n, err = dio.Read(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, len(expected), n)
+	assert.Equal(t, expected, buf)
+	//不对齐的偏移
+	buf = make([]byte, 100)
+	_, err = dio.Read(buf, 4090)
+	assert.Nil(t, err)
+	assert.Equal(t, expected[4090:4190], buf)
+	//读取超过文件末尾
+	n, err = dio.Read(buf, int64(len(expected)-10))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 10, n)
+}
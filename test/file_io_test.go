@@ -10,6 +10,13 @@ import (
 
 const DirPath = "/tmp"
 
+//可写的IO类型，下面的测试对每一种类型都执行一遍
+var writableIOTypes = map[string]fio.IOManagerType{
+	"StanderFIO": fio.StanderFIO,
+	"DirectFio":  fio.DirectFio,
+	"MMapRWFio":  fio.MMapRWFio,
+}
+
 func destroyFile(name string) {
 	if err := os.RemoveAll(name); err != nil {
 		panic(err)
@@ -17,76 +24,126 @@ func destroyFile(name string) {
 }
 
 func TestNewFileIOManager(t *testing.T) {
-	//在当前目录的tmp下面构造一个文件
-	path := filepath.Join(DirPath, "a.txt")
-	fio, err := fio.NewFileIOManager(path)
-	//测试完成后将文件删除
-	defer destroyFile(path)
-
-	assert.Nil(t, err)
-	assert.NotNil(t, fio)
+	for name, typ := range writableIOTypes {
+		t.Run(name, func(t *testing.T) {
+			//在当前目录的tmp下面构造一个文件
+			path := filepath.Join(DirPath, "a.txt")
+			fio, err := fio.NewIOManager(path, typ)
+			//测试完成后将文件删除
+			defer destroyFile(path)
+
+			assert.Nil(t, err)
+			assert.NotNil(t, fio)
+		})
+	}
 }
 
 func TestNewFileIO_Write(t *testing.T) {
-	//在当前目录的tmp下面构造一个文件
-	path := filepath.Join(DirPath, "a.txt")
-	fio, err := fio.NewFileIOManager(path)
-
-	//测试完成后将文件删除
-	defer destroyFile(path)
-	assert.Nil(t, err)
-	assert.NotNil(t, fio)
-
-	n, err := fio.Write([]byte("as"))
-	assert.Equal(t, 2, n)
-	n, err = fio.Write([]byte("asasdc"))
-	assert.Equal(t, 6, n)
-
+	for name, typ := range writableIOTypes {
+		t.Run(name, func(t *testing.T) {
+			//在当前目录的tmp下面构造一个文件
+			path := filepath.Join(DirPath, "a.txt")
+			fio, err := fio.NewIOManager(path, typ)
+
+			//测试完成后将文件删除
+			defer destroyFile(path)
+			assert.Nil(t, err)
+			assert.NotNil(t, fio)
+
+			n, err := fio.Write([]byte("as"))
+			assert.Equal(t, 2, n)
+			n, err = fio.Write([]byte("asasdc"))
+			assert.Equal(t, 6, n)
+		})
+	}
 }
 
 func TestFileIO_Read(t *testing.T) {
-	path := filepath.Join(DirPath, "a.txt")
-	fio, err := fio.NewFileIOManager(path)
-	//测试完成后将文件删除
-	defer destroyFile(path)
-	assert.Nil(t, err)
-	assert.NotNil(t, fio)
-
-	_, err = fio.Write([]byte("key-a"))
-	assert.Nil(t, err)
-	_, err = fio.Write([]byte("key-b"))
-	assert.Nil(t, err)
-
-	b1 := make([]byte, 5)
-	n, err := fio.Read(b1, 0)
-	assert.Equal(t, 5, n)
-	assert.Equal(t, []byte("key-a"), b1)
-
-	b2 := make([]byte, 5)
-	n, err = fio.Read(b2, 5)
-	assert.Equal(t, 5, n)
-	assert.Equal(t, []byte("key-b"), b2)
+	for name, typ := range writableIOTypes {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(DirPath, "a.txt")
+			fio, err := fio.NewIOManager(path, typ)
+			//测试完成后将文件删除
+			defer destroyFile(path)
+			assert.Nil(t, err)
+			assert.NotNil(t, fio)
+
+			_, err = fio.Write([]byte("key-a"))
+			assert.Nil(t, err)
+			_, err = fio.Write([]byte("key-b"))
+			assert.Nil(t, err)
+
+			b1 := make([]byte, 5)
+			n, err := fio.Read(b1, 0)
+			assert.Equal(t, 5, n)
+			assert.Equal(t, []byte("key-a"), b1)
+
+			b2 := make([]byte, 5)
+			n, err = fio.Read(b2, 5)
+			assert.Equal(t, 5, n)
+			assert.Equal(t, []byte("key-b"), b2)
+		})
+	}
 }
 
 func TestFileIO_Sync(t *testing.T) {
-	path := filepath.Join(DirPath, "a.txt")
-	fio, err := fio.NewFileIOManager(path)
-	//测试完成后将文件删除
-	defer destroyFile(path)
-	assert.Nil(t, err)
-	assert.NotNil(t, fio)
-	err = fio.Sync()
-	assert.Nil(t, err)
-
+	for name, typ := range writableIOTypes {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(DirPath, "a.txt")
+			fio, err := fio.NewIOManager(path, typ)
+			//测试完成后将文件删除
+			defer destroyFile(path)
+			assert.Nil(t, err)
+			assert.NotNil(t, fio)
+			err = fio.Sync()
+			assert.Nil(t, err)
+		})
+	}
 }
+
 func TestFileIO_Close(t *testing.T) {
-	path := filepath.Join(DirPath, "a.txt")
-	fio, err := fio.NewFileIOManager(path)
-	//测试完成后将文件删除
-	defer destroyFile(path)
-	assert.Nil(t, err)
-	assert.NotNil(t, fio)
-	err = fio.Close()
-	assert.Nil(t, err)
+	for name, typ := range writableIOTypes {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(DirPath, "a.txt")
+			fio, err := fio.NewIOManager(path, typ)
+			//测试完成后将文件删除
+			defer destroyFile(path)
+			assert.Nil(t, err)
+			assert.NotNil(t, fio)
+			err = fio.Close()
+			assert.Nil(t, err)
+		})
+	}
+}
 
+//预分配之后文件的大小是预分配的大小，写入的位置单独记录，关闭的时候裁剪到实际写入的大小
+func TestFileIO_Preallocate(t *testing.T) {
+	for name, typ := range writableIOTypes {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(DirPath, "a.txt")
+			defer destroyFile(path)
+			fio, err := fio.NewIOManagerWithCapacity(path, typ, 8192)
+			assert.Nil(t, err)
+			stat, err := os.Stat(path)
+			assert.Nil(t, err)
+			assert.Equal(t, int64(8192), stat.Size())
+
+			_, err = fio.Write([]byte("key-a"))
+			assert.Nil(t, err)
+			_, err = fio.Write([]byte("key-b"))
+			assert.Nil(t, err)
+			size, err := fio.Size()
+			assert.Nil(t, err)
+			assert.Equal(t, int64(10), size)
+			b := make([]byte, 5)
+			_, err = fio.Read(b, 5)
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("key-b"), b)
+			assert.Nil(t, fio.Sync())
+			assert.Nil(t, fio.Close())
+			stat, err = os.Stat(path)
+			assert.Nil(t, err)
+			assert.Equal(t, int64(10), stat.Size())
+		})
+	}
 }
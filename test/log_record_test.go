@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"hash/crc32"
 	"testing"
+	"unsafe"
 )
 
 func TestEncodeLogRecord(t *testing.T) {
@@ -107,3 +108,10 @@ func TestGetLogRecordCRC(t *testing.T) {
 	assert.Equal(t, uint32(2610249828), crc)
 
 }
+
+func TestPackLogRecordPos(t *testing.T) {
+	pos := &data.LogRecordPos{Fid: 1<<32 - 1, Offset: 1<<40 + 7, Size: 1<<32 - 2, Tstamp: 100}
+	packed := data.PackLogRecordPos(pos)
+	assert.Equal(t, &data.LogRecordPos{Fid: pos.Fid, Offset: pos.Offset, Size: pos.Size}, packed.Unpack())
+	assert.Equal(t, uintptr(data.PackedPosSize), unsafe.Sizeof(packed))
+}
@@ -4,6 +4,7 @@ import (
 	"FlexDB/fio"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"os"
 	"path/filepath"
 	"testing"
 )
@@ -42,3 +43,49 @@ func TestMMap_Read(t *testing.T) {
 	mio1.Close()
 
 }
+
+//可读写的mmap预分配文件，关闭的时候裁剪到实际写入的大小，重新打开之后继续追加
+func TestMMapRW_Write(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-rw")
+	defer destroyFile(path)
+	mio, err := fio.NewMMapRWIOManager(path, 1024)
+	assert.Nil(t, err)
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1024), stat.Size())
+
+	_, err = mio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	//超过预分配的大小
+	_, err = mio.Write(make([]byte, 2000))
+	assert.Nil(t, err)
+	size, err := mio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2005), size)
+	b := make([]byte, 5)
+	n, err := mio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, []byte("key-a"), b)
+	//没有写入数据的部分读取不到
+	n, err = mio.Read(b, 2003)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, mio.Sync())
+	assert.Nil(t, mio.Close())
+	stat, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2005), stat.Size())
+
+	mio, err = fio.NewMMapRWIOManager(path, 4096)
+	assert.Nil(t, err)
+	_, err = mio.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	n, err = mio.Read(b, 2005)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-b"), b)
+	assert.Nil(t, mio.Close())
+	stat, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2010), stat.Size())
+}
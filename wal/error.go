@@ -7,4 +7,5 @@ var (
 	ErrPosNotValid      = errors.New("read pos is not valid")
 	ErrInvalidCrc       = errors.New("invalid crc value,log record maybe error")
 	ErrEmpty            = errors.New("Wal file is empty,can not read")
+	ErrInvalidChunk     = errors.New("invalid chunk type sequence,log record maybe error")
 )
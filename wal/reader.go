@@ -0,0 +1,167 @@
+package wal
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+//Reader 顺序读取wal中的记录，跨越block和segment文件，每次只读取一条记录，不会把所有的数据都加载到内存中
+//读取到没有写完的记录的时候返回io.EOF，不会移动读取的位置，写入完成之后可以继续调用Next读取
+type Reader struct {
+	wal         *Wal
+	segmentID   uint32 //下一条记录所在的segment文件
+	blockID     uint32 //下一条记录所在的block
+	chunkOffset uint32 //下一条记录在block中的偏移
+	skipPartial bool   //从最旧的segment文件开始读取的时候，开头可能是被删除的segment文件中的记录剩下的部分，需要跳过
+}
+
+//NewReader 从startPos开始顺序读取wal，startPos为空的时候从最旧的没有被删除的segment文件开始读取
+//startPos可以是Write或者Reader.Next返回的位置，从这条记录开始读取，也可以是Reader.Pos返回的位置，从这个位置之后继续读取
+func (wal *Wal) NewReader(startPos *ChunkPos) *Reader {
+	reader := &Reader{wal: wal}
+	if startPos != nil {
+		reader.segmentID = startPos.segmentID
+		reader.blockID = startPos.blockID
+		reader.chunkOffset = startPos.chunkOffset
+		return reader
+	}
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	reader.segmentID = wal.firstSegmentID()
+	reader.blockID = reader.segmentID * wal.option.SegmentMaxBlockNum
+	reader.skipPartial = true
+	return reader
+}
+
+//Pos 获得下一条记录开始的位置，保存下来之后可以通过NewReader从这个位置继续读取
+func (r *Reader) Pos() *ChunkPos {
+	return &ChunkPos{segmentID: r.segmentID, blockID: r.blockID, chunkOffset: r.chunkOffset}
+}
+
+//Next 读取下一条记录，返回记录的数据和所在的位置，没有更多完整的记录的时候返回io.EOF
+func (r *Reader) Next() ([]byte, *ChunkPos, error) {
+	r.wal.mu.RLock()
+	defer r.wal.mu.RUnlock()
+	var (
+		segmentID   = r.segmentID
+		blockID     = r.blockID
+		chunkOffset = r.chunkOffset
+		pos         *ChunkPos
+		res         []byte
+	)
+	for {
+		seg := r.wal.segment(segmentID)
+		if seg == nil {
+			if segmentID < r.wal.firstSegmentID() {
+				//所在的segment文件已经被删除了
+				return nil, nil, ErrPosNotValid
+			}
+			return nil, nil, io.EOF
+		}
+		if blockID < seg.blockId {
+			return nil, nil, ErrPosNotValid
+		}
+		segSize, err := seg.Size()
+		if err != nil {
+			return nil, nil, err
+		}
+		blockOffset := (blockID - seg.blockId) * r.wal.option.BlockSize
+		if blockOffset >= segSize {
+			//当前的segment文件读取完了，继续读取下一个segment文件
+			segmentID++
+			blockID = segmentID * r.wal.option.SegmentMaxBlockNum
+			chunkOffset = 0
+			continue
+		}
+		blockSize := segSize - blockOffset
+		if blockSize > r.wal.option.BlockSize {
+			blockSize = r.wal.option.BlockSize
+		}
+		if chunkOffset+headerSize >= r.wal.option.BlockSize {
+			//剩余的空间是padding填充的，从下一个block开始读取
+			blockID++
+			chunkOffset = 0
+			continue
+		}
+		if chunkOffset+headerSize > blockSize {
+			if r.wal.segment(segmentID+1) == nil {
+				//最后一个block还没有写满，后面没有数据了
+				return nil, nil, io.EOF
+			}
+			//segment文件写满之后切换的时候不会填充padding，继续读取下一个segment文件
+			segmentID++
+			blockID = segmentID * r.wal.option.SegmentMaxBlockNum
+			chunkOffset = 0
+			continue
+		}
+		block, err := seg.readBlock(blockID-seg.blockId, blockSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		chunkType, data, err := decodeChunk(block, chunkOffset)
+		if err != nil {
+			return nil, nil, err
+		}
+		if pos == nil && r.skipPartial && (chunkType == Middle || chunkType == Last) {
+			//跳过前一个segment文件中的记录剩下的部分
+			chunkOffset += headerSize + uint32(len(data))
+			if chunkOffset+headerSize >= r.wal.option.BlockSize {
+				blockID++
+				chunkOffset = 0
+			}
+			continue
+		}
+		//记录必须以Full或者First开始，后面跟着Middle和Last
+		if (pos == nil) != (chunkType == Full || chunkType == First) {
+			return nil, nil, ErrInvalidChunk
+		}
+		if pos == nil {
+			pos = &ChunkPos{segmentID: segmentID, blockID: blockID, chunkOffset: chunkOffset}
+		}
+		res = append(res, data...)
+		pos.chunkSize += headerSize + uint32(len(data))
+		chunkOffset += headerSize + uint32(len(data))
+		if chunkOffset+headerSize >= r.wal.option.BlockSize {
+			blockID++
+			chunkOffset = 0
+		}
+		if chunkType == Full || chunkType == Last {
+			break
+		}
+	}
+	r.segmentID, r.blockID, r.chunkOffset = segmentID, blockID, chunkOffset
+	r.skipPartial = false
+	return res, pos, nil
+}
+
+//segment 根据id获得对应的segment文件，不存在的时候返回nil
+func (wal *Wal) segment(segmentID uint32) *Segment {
+	if wal.activeFile != nil && segmentID == wal.segmentID {
+		return wal.activeFile
+	}
+	return wal.olderFile[segmentID]
+}
+
+//decodeChunk 从block中解码begin位置的chunk，chunk没有写完的时候返回io.EOF
+func decodeChunk(block []byte, begin uint32) (ChunkType, []byte, error) {
+	header := block[begin : begin+headerSize]
+	length := uint32(binary.LittleEndian.Uint16(header[4:6]))
+	crc := binary.LittleEndian.Uint32(header[:4])
+	if crc == 0 && length == 0 && header[6] == 0 {
+		//全部是0的header说明后面还没有写入数据
+		return 0, nil, io.EOF
+	}
+	dataEnd := begin + headerSize + length
+	if dataEnd > uint32(len(block)) {
+		return 0, nil, io.EOF
+	}
+	data := block[begin+headerSize : dataEnd]
+	if crc32.Update(crc32.ChecksumIEEE(header[4:]), crc32.IEEETable, data) != crc {
+		return 0, nil, ErrInvalidCrc
+	}
+	if header[6] > Last {
+		return 0, nil, ErrInvalidChunk
+	}
+	return header[6], data, nil
+}
@@ -0,0 +1,145 @@
+package wal
+
+import (
+	"FlexDB/fio"
+	"io"
+	"os"
+)
+
+//segmentScan 扫描一个segment文件的结果
+type segmentScan struct {
+	validEnd       uint32 //最后一条完整的记录结束的位置，之后的数据都是不完整或者损坏的
+	leadingPartial bool   //segment文件开头是前一个segment文件中的记录剩下的部分，并且没有写完
+}
+
+//scanSegment 从头扫描一个segment文件，校验每个chunk的crc以及First/Middle/Last的顺序，找到最后一条完整的记录结束的位置
+//segment文件开头可以是前一个segment文件中没有写完的记录剩下的Middle和Last
+func (wal *Wal) scanSegment(seg *Segment) (*segmentScan, error) {
+	size, err := seg.Size()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		result     = &segmentScan{}
+		offset     uint32 //当前扫描到的位置
+		inRecord   bool   //是否在一条记录的中间
+		continuing = true //是否还在segment文件开头的前一条记录剩下的部分中
+	)
+	for offset < size {
+		chunkOffset := offset % wal.option.BlockSize
+		if chunkOffset+headerSize >= wal.option.BlockSize {
+			//padding，从下一个block开始
+			offset += wal.option.BlockSize - chunkOffset
+			continue
+		}
+		blockSize := size - (offset - chunkOffset)
+		if blockSize > wal.option.BlockSize {
+			blockSize = wal.option.BlockSize
+		}
+		if chunkOffset+headerSize > blockSize {
+			break
+		}
+		block, err := seg.readNByte(blockSize, offset-chunkOffset)
+		if err != nil {
+			return nil, err
+		}
+		chunkType, data, err := decodeChunk(block, chunkOffset)
+		if err != nil {
+			if err == io.EOF || err == ErrInvalidCrc || err == ErrInvalidChunk {
+				break
+			}
+			return nil, err
+		}
+		switch chunkType {
+		case Full, First:
+			if inRecord && !continuing {
+				//上一条记录还没有结束
+				return result, nil
+			}
+			continuing = false
+			inRecord = chunkType == First
+		case Middle, Last:
+			if !inRecord && !continuing {
+				return result, nil
+			}
+			inRecord = chunkType == Middle
+			if continuing {
+				result.leadingPartial = inRecord
+			}
+		}
+		offset += headerSize + uint32(len(data))
+		if !inRecord {
+			result.validEnd = offset
+			continuing = false
+		}
+	}
+	return result, nil
+}
+
+//recoverActiveSegment 打开的时候扫描活跃文件，截断最后一条完整的记录之后不完整或者损坏的数据，并恢复写入的位置
+//如果活跃文件中只有前一个segment文件中没有写完的记录剩下的部分，就删除活跃文件，把前一个segment文件也截断到最后一条完整的记录
+func (wal *Wal) recoverActiveSegment() error {
+	if wal.activeFile == nil {
+		return nil
+	}
+	result, err := wal.scanSegment(wal.activeFile)
+	if err != nil {
+		return err
+	}
+	if err := wal.truncateSegment(wal.activeFile, result.validEnd); err != nil {
+		return err
+	}
+	if result.leadingPartial || result.validEnd == 0 {
+		prev, ok := wal.olderFile[wal.segmentID-1]
+		if ok && wal.segmentID > 0 {
+			prevResult, err := wal.scanSegment(prev)
+			if err != nil {
+				return err
+			}
+			prevSize, err := prev.Size()
+			if err != nil {
+				return err
+			}
+			if prevResult.validEnd < prevSize {
+				//前一个segment文件最后的记录没有写完，切换回前一个segment文件继续写入
+				if err := wal.activeFile.Close(); err != nil {
+					return err
+				}
+				if err := os.Remove(GetSegmentFile(wal.option.DirPath, wal.option.FileSuffix, wal.segmentID)); err != nil {
+					return err
+				}
+				delete(wal.olderFile, prev.SegmentId)
+				if err := prev.SetIOManager(wal.option.DirPath, wal.option.FileSuffix, fio.StanderFIO); err != nil {
+					return err
+				}
+				wal.activeFile = prev
+				wal.segmentID = prev.SegmentId
+				if err := wal.truncateSegment(prev, prevResult.validEnd); err != nil {
+					return err
+				}
+				result = prevResult
+			}
+		}
+	}
+	//恢复写入的位置
+	wal.currSegOffset = result.validEnd
+	wal.currBlcokOffset = result.validEnd % wal.option.BlockSize
+	wal.BlockId = wal.segmentID*wal.option.SegmentMaxBlockNum + result.validEnd/wal.option.BlockSize
+	return nil
+}
+
+//truncateSegment 将segment文件截断到size大小
+func (wal *Wal) truncateSegment(seg *Segment, size uint32) error {
+	segSize, err := seg.Size()
+	if err != nil {
+		return err
+	}
+	if size >= segSize {
+		return nil
+	}
+	wal.option.Logger.Warn("truncate corrupted wal segment", "dir", wal.option.DirPath, "segment_id", seg.SegmentId, "size", segSize, "valid_size", size)
+	if err := os.Truncate(GetSegmentFile(wal.option.DirPath, wal.option.FileSuffix, seg.SegmentId), int64(size)); err != nil {
+		return err
+	}
+	return seg.Sync()
+}
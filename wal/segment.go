@@ -150,6 +150,10 @@ func (seg *Segment) readBlock(curSegBlockId, readByte uint32) ([]byte, error) {
 		blockId = curSegBlockId + seg.SegmentId*seg.opts.SegmentMaxBlockNum
 	)
 
+	if seg.cache == nil {
+		//没有开启缓存
+		return seg.readNByte(readByte, seg.opts.BlockSize*curSegBlockId)
+	}
 	buf, ok = seg.cache.Get(GetCacheKey(seg.SegmentId, blockId)) //从LRU缓存中读取数据
 	if !ok || uint32(len(buf)) < seg.opts.BlockSize {
 		//缓存没有命中或者缓存中读取的数据小于一个block大小，也需要重新进行读取
@@ -0,0 +1,79 @@
+package wal
+
+import "time"
+
+type SyncPolicy = int8
+
+const (
+	//SyncNever 不主动持久化，只在切换segment文件和关闭的时候持久化
+	SyncNever SyncPolicy = iota
+	//SyncAlways 每次写入之后都进行持久化
+	SyncAlways
+	//SyncEveryBytes 累积写入BytesPerSync字节之后进行持久化
+	SyncEveryBytes
+	//SyncEveryInterval 每隔SyncInterval在后台进行持久化
+	SyncEveryInterval
+)
+
+//sync 持久化活跃文件，需要持有写锁
+func (wal *Wal) sync() error {
+	if wal.activeFile == nil {
+		return nil
+	}
+	if err := wal.activeFile.Sync(); err != nil {
+		return err
+	}
+	wal.unsyncedBytes = 0
+	return nil
+}
+
+//syncByPolicy 一次写入完成之后按照持久化策略进行持久化，需要持有写锁
+func (wal *Wal) syncByPolicy() error {
+	switch wal.option.SyncPolicy {
+	case SyncAlways:
+		return wal.sync()
+	case SyncEveryBytes:
+		if wal.unsyncedBytes >= wal.option.BytesPerSync {
+			return wal.sync()
+		}
+	}
+	return nil
+}
+
+//startSyncLoop SyncEveryInterval策略下启动后台的定时持久化
+func (wal *Wal) startSyncLoop() {
+	if wal.option.SyncPolicy != SyncEveryInterval || wal.option.SyncInterval <= 0 {
+		return
+	}
+	wal.closeCh = make(chan struct{})
+	wal.syncWg.Add(1)
+	go func() {
+		defer wal.syncWg.Done()
+		ticker := time.NewTicker(wal.option.SyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				wal.mu.Lock()
+				if wal.unsyncedBytes > 0 {
+					if err := wal.sync(); err != nil {
+						wal.option.Logger.Warn("fail to sync wal", "dir", wal.option.DirPath, "err", err)
+					}
+				}
+				wal.mu.Unlock()
+			case <-wal.closeCh:
+				return
+			}
+		}
+	}()
+}
+
+//stopSyncLoop 停止后台的定时持久化，并等待正在进行的持久化完成
+func (wal *Wal) stopSyncLoop() {
+	if wal.closeCh == nil {
+		return
+	}
+	close(wal.closeCh)
+	wal.syncWg.Wait()
+	wal.closeCh = nil
+}
@@ -0,0 +1,103 @@
+package wal
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+//TruncateBefore 删除pos所在的segment文件之前的所有segment文件，关闭对应的文件句柄，这些文件中的记录都已经不再需要了
+//pos所在的segment文件和活跃文件不会被删除，删除之后从被删除的位置读取会返回ErrPosNotValid
+func (wal *Wal) TruncateBefore(pos *ChunkPos) error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	for _, id := range wal.olderSegmentIDs() {
+		if id >= pos.segmentID {
+			break
+		}
+		if err := wal.removeSegment(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//applyRetention 按照保留策略从最旧的segment文件开始删除，需要持有写锁
+func (wal *Wal) applyRetention() error {
+	if wal.option.RetentionSize <= 0 && wal.option.RetentionAge <= 0 {
+		return nil
+	}
+	var totalSize int64
+	if wal.activeFile != nil {
+		size, err := wal.activeFile.Size()
+		if err != nil {
+			return err
+		}
+		totalSize += int64(size)
+	}
+	ids := wal.olderSegmentIDs()
+	sizes := make([]int64, len(ids))
+	for i, id := range ids {
+		size, err := wal.olderFile[id].Size()
+		if err != nil {
+			return err
+		}
+		sizes[i] = int64(size)
+		totalSize += sizes[i]
+	}
+	for i, id := range ids {
+		oversize := wal.option.RetentionSize > 0 && totalSize > wal.option.RetentionSize
+		expired := false
+		if wal.option.RetentionAge > 0 {
+			info, err := os.Stat(GetSegmentFile(wal.option.DirPath, wal.option.FileSuffix, id))
+			if err != nil {
+				return err
+			}
+			expired = time.Since(info.ModTime()) > wal.option.RetentionAge
+		}
+		//只删除最旧的连续的segment文件，保证剩下的记录是连续的
+		if !oversize && !expired {
+			break
+		}
+		if err := wal.removeSegment(id); err != nil {
+			return err
+		}
+		totalSize -= sizes[i]
+	}
+	return nil
+}
+
+//removeSegment 关闭并删除一个旧的segment文件
+func (wal *Wal) removeSegment(id uint32) error {
+	seg := wal.olderFile[id]
+	if err := seg.Close(); err != nil {
+		return err
+	}
+	delete(wal.olderFile, id)
+	if err := os.Remove(GetSegmentFile(wal.option.DirPath, wal.option.FileSuffix, id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	wal.option.Logger.Debug("remove wal segment", "dir", wal.option.DirPath, "segment_id", id)
+	return nil
+}
+
+//olderSegmentIDs 获得所有旧的segment文件的id，从小到大排序
+func (wal *Wal) olderSegmentIDs() []uint32 {
+	ids := make([]uint32, 0, len(wal.olderFile))
+	for id := range wal.olderFile {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+//firstSegmentID 获得最旧的没有被删除的segment文件的id
+func (wal *Wal) firstSegmentID() uint32 {
+	firstID := wal.segmentID
+	for id := range wal.olderFile {
+		if id < firstID {
+			firstID = id
+		}
+	}
+	return firstID
+}
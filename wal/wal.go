@@ -2,6 +2,7 @@ package wal
 
 import (
 	"FlexDB/fio"
+	"FlexDB/logger"
 	"encoding/binary"
 	"github.com/hashicorp/golang-lru/v2"
 	"hash/crc32"
@@ -11,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Wal struct {
@@ -24,15 +26,27 @@ type Wal struct {
 	option          WalOption                  //当前的wal的配置项
 	cache           *lru.Cache[uint32, []byte] //缓存block数据,key是blockId，value是一个block大小的缓存
 	isEmpty         bool                       //是否为空文件,如果当前为空文件，就不能进行读取操作
+	pending         []byte                     //写缓冲，一次写入中编码之后的chunk，最后一次性写入到活跃文件中
+	unsyncedBytes   uint64                     //上一次持久化之后写入的字节数
+	closeCh         chan struct{}              //通知后台的定时持久化退出
+	syncWg          sync.WaitGroup             //等待后台的定时持久化退出
 }
 
 type WalOption struct {
-	DirPath            string //所在的路经名
-	BlockSize          uint32 //一个block固定是32KB
-	SegmentMaxBlockNum uint32 //一个segment文件中最多可以存放多少个Block
-	SegmentSize        uint32 //一个segment文件最大可以最大的大小
-	BlockCacheNum      int    //lru中可以缓存多少个Block节点
-	FileSuffix         string //文件的后缀名
+	DirPath            string        //所在的路经名
+	BlockSize          uint32        //一个block固定是32KB
+	SegmentMaxBlockNum uint32        //一个segment文件中最多可以存放多少个Block
+	SegmentSize        uint32        //一个segment文件最大可以最大的大小
+	BlockCacheNum      int           //lru中可以缓存多少个Block节点
+	FileSuffix         string        //文件的后缀名
+	Logger             logger.Logger //日志，为空的时候使用默认的日志
+	//持久化策略，切换segment文件和关闭的时候总是会进行持久化
+	SyncPolicy   SyncPolicy    //什么时候将写入的数据持久化到磁盘中
+	BytesPerSync uint64        //SyncEveryBytes策略下累积写入多少字节之后进行持久化
+	SyncInterval time.Duration //SyncEveryInterval策略下每隔多长时间在后台进行持久化
+	//保留策略，切换segment文件和打开的时候从最旧的segment文件开始删除，活跃文件不会被删除
+	RetentionSize int64         //所有segment文件的总大小超过这个值的时候删除最旧的segment文件，为0表示不限制
+	RetentionAge  time.Duration //最后一次写入超过这个时间的segment文件会被删除，为0表示不限制
 }
 
 var DefaultWalOpt = WalOption{
@@ -42,6 +56,11 @@ var DefaultWalOpt = WalOption{
 	SegmentSize:        32 * 1024 * 1024,
 	BlockCacheNum:      20,
 	FileSuffix:         ".seg",
+	SyncPolicy:         SyncNever,
+	BytesPerSync:       0,
+	SyncInterval:       time.Second,
+	RetentionSize:      0,
+	RetentionAge:       0,
 }
 
 //Open 打开一个Wal实例
@@ -53,6 +72,7 @@ func Open(options WalOption) (*Wal, error) {
 			return nil, err
 		}
 	}
+	options.Logger = logger.OrDefault(options.Logger)
 	wal := &Wal{
 		mu:        new(sync.RWMutex),
 		olderFile: make(map[uint32]*Segment),
@@ -69,26 +89,21 @@ func Open(options WalOption) (*Wal, error) {
 		return nil, err
 	}
 	//遍历每个文件ID，打开对应的文件
-	segNum, err := wal.openFiles(fileIds)
-	if err != nil {
+	if _, err := wal.openFiles(fileIds); err != nil {
+		return nil, err
+	}
+	//校验活跃文件，截断最后不完整或者损坏的数据，并恢复wal中写入的位置
+	if err := wal.recoverActiveSegment(); err != nil {
 		return nil, err
 	}
-	//更新wal中的数据
-	blockID := uint32(segNum) * wal.option.SegmentMaxBlockNum
 	if wal.activeFile != nil {
-		activeSize, err := wal.activeFile.Size()
-		if err != nil {
-			return nil, err
-		}
-		wal.currSegOffset = activeSize
-		//blockIdInCurrSeg:=activeSize/BlockSize
-		wal.currBlcokOffset = activeSize % wal.option.BlockSize
-
-		blockID = blockID + activeSize/wal.option.BlockSize //这个问题
-		wal.BlockId = blockID
 		wal.isEmpty = false
 	}
-
+	if err := wal.applyRetention(); err != nil {
+		return nil, err
+	}
+	wal.startSyncLoop()
+	wal.option.Logger.Debug("open wal", "dir", options.DirPath, "segments", len(fileIds), "segment_id", wal.segmentID, "segment_offset", wal.currSegOffset)
 	return wal, nil
 }
 
@@ -182,125 +197,253 @@ func (wal *Wal) closeFiles() error {
 
 //Write 写入一个buf数据,并且返回具体写入的位置信息
 func (wal *Wal) Write(data []byte) (*ChunkPos, error) {
+	positions, err := wal.WriteBatch([][]byte{data})
+	if err != nil {
+		return nil, err
+	}
+	return positions[0], nil
+}
+
+//WriteBatch 将多条数据编码到连续的block中，通过一次写入追加到segment文件中，并且按照持久化策略最多进行一次持久化
+//返回每条数据的位置信息，只有在需要切换segment文件的时候才会先把已经编码的数据写入到旧的segment文件中
+//返回错误的时候写入的位置会回滚到写入之前，这一批数据都不会被读取到
+func (wal *Wal) WriteBatch(batch [][]byte) ([]*ChunkPos, error) {
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
+	//data的数据不能超过一个segmentSize大小，超过的话，直接报错，先检查全部的数据，避免写入一部分之后才失败
+	for _, data := range batch {
+		if uint32(len(data)) >= wal.option.SegmentSize {
+			return nil, ErrPayloadExceedSeg
+		}
+	}
 	if wal.activeFile == nil {
 		//当前没有active文件，就需要新创建一个
 		segfile, err := wal.OpenSegment(wal.segmentID, wal.option, fio.StanderFIO)
 		if err != nil {
-			return nil, nil
+			wal.option.Logger.Error("fail to open wal segment", "dir", wal.option.DirPath, "segment_id", wal.segmentID, "err", err)
+			return nil, err
 		}
 		wal.activeFile = segfile
 	}
-	length := len(data) //获得当前数据的长度
+	state := wal.saveWriteState()
+	positions := make([]*ChunkPos, 0, len(batch))
+	for _, data := range batch {
+		pos, err := wal.writeRecord(data)
+		if err != nil {
+			wal.rollbackWrite(state)
+			return nil, err
+		}
+		positions = append(positions, pos)
+	}
+	//一次性写入所有编码之后的数据
+	if err := wal.flush(); err != nil {
+		wal.rollbackWrite(state)
+		return nil, err
+	}
+	//持久化失败的时候不能确定这次写入的数据是否已经持久化，同样回滚，返回错误的写入不会被读取到
+	if err := wal.syncByPolicy(); err != nil {
+		wal.rollbackWrite(state)
+		return nil, err
+	}
+	wal.isEmpty = false
+	return positions, nil
+}
 
-	//data的数据不能超过一个segmentSize大小，超过的话，直接报错
-	if uint32(length) >= wal.option.SegmentSize {
-		return nil, ErrPayloadExceedSeg
+//writeState 一次写入开始之前的写入位置
+type writeState struct {
+	segmentID     uint32
+	blockID       uint32
+	segOffset     uint32
+	blockOffset   uint32
+	unsyncedBytes uint64
+}
+
+//saveWriteState 保存当前的写入位置，需要持有写锁
+func (wal *Wal) saveWriteState() writeState {
+	return writeState{
+		segmentID:     wal.segmentID,
+		blockID:       wal.BlockId,
+		segOffset:     wal.currSegOffset,
+		blockOffset:   wal.currBlcokOffset,
+		unsyncedBytes: wal.unsyncedBytes,
+	}
+}
+
+//rollbackWrite 一次写入失败之后丢弃写缓冲，删除这次写入切换出来的segment文件，并把活跃文件截断到写入之前的位置
+//保证之后写入返回的位置和文件中的数据一致，需要持有写锁
+func (wal *Wal) rollbackWrite(state writeState) {
+	wal.pending = wal.pending[:0]
+	for wal.segmentID > state.segmentID {
+		prev, ok := wal.olderFile[wal.segmentID-1]
+		if !ok {
+			//之前的segment文件已经被保留策略删除了，只能从当前的segment文件的开头继续写入
+			state = writeState{segmentID: wal.segmentID, blockID: wal.segmentID * wal.option.SegmentMaxBlockNum}
+			break
+		}
+		_ = wal.activeFile.Close()
+		if err := os.Remove(GetSegmentFile(wal.option.DirPath, wal.option.FileSuffix, wal.segmentID)); err != nil {
+			wal.option.Logger.Warn("fail to remove wal segment", "dir", wal.option.DirPath, "segment_id", wal.segmentID, "err", err)
+		}
+		delete(wal.olderFile, prev.SegmentId)
+		if err := prev.SetIOManager(wal.option.DirPath, wal.option.FileSuffix, fio.StanderFIO); err != nil {
+			wal.option.Logger.Warn("fail to reopen wal segment", "dir", wal.option.DirPath, "segment_id", prev.SegmentId, "err", err)
+		}
+		wal.activeFile = prev
+		wal.segmentID = prev.SegmentId
+	}
+	if wal.activeFile != nil {
+		fileName := GetSegmentFile(wal.option.DirPath, wal.option.FileSuffix, wal.segmentID)
+		if size, err := wal.activeFile.Size(); err == nil && size > state.segOffset {
+			if err := os.Truncate(fileName, int64(state.segOffset)); err != nil {
+				wal.option.Logger.Warn("fail to truncate wal segment", "dir", wal.option.DirPath, "segment_id", wal.segmentID, "err", err)
+			}
+		}
 	}
+	wal.BlockId = state.blockID
+	wal.currSegOffset = state.segOffset
+	wal.currBlcokOffset = state.blockOffset
+	wal.unsyncedBytes = state.unsyncedBytes
+}
+
+//writeRecord 将一条数据编码成chunk追加到写缓冲中，需要持有写锁
+func (wal *Wal) writeRecord(data []byte) (*ChunkPos, error) {
+	length := len(data) //获得当前数据的长度
+
 	blockFullWarning := headerSize+wal.currBlcokOffset >= wal.option.BlockSize //当前block无法容纳下一个heaeder
 	if blockFullWarning {
 		//填充占位字符
 		wal.writePadding()
 	}
 
-	pos := &ChunkPos{
-		segmentID:   wal.segmentID,
-		blockID:     wal.BlockId,
-		chunkOffset: wal.currBlcokOffset,
-	}
 	var blockWritable bool = uint32(length)+headerSize+wal.currBlcokOffset <= wal.option.BlockSize //当前的block是否可以被写入
 	if blockWritable {
+		if wal.currSegOffset > 0 && wal.currSegOffset+headerSize+uint32(length) > wal.option.SegmentSize {
+			//写入之后会超过segment文件的大小，先切换segment文件，保证segment文件的大小有上限，保留策略才能删除旧的segment文件
+			if err := wal.rotateSegment(); err != nil {
+				return nil, err
+			}
+		}
 		//如果当前数据长度+头部数据+当前block中的偏移量小于一个block大小，就可以直接放进去
 		//把数据编码，并写入
-		chunkSize, err := wal.writeChunk(data, Full)
-		if err != nil {
-			return nil, err
+		pos := &ChunkPos{
+			segmentID:   wal.segmentID,
+			blockID:     wal.BlockId,
+			chunkOffset: wal.currBlcokOffset,
 		}
-		pos.chunkSize = chunkSize
-		wal.isEmpty = false
-
+		pos.chunkSize = wal.writeChunk(data, Full)
 		return pos, nil
 	}
 	//如果走到这，说明当前的block无法容纳下该data，说明就需要将当前的data分在多个block中间存储
-
+	var pos *ChunkPos
 	var (
 		begin        uint32    = 0 //两个指针指向要截取的数据的位置信息,begin指向的是当前的data读取的起点
 		end          uint32    = uint32(length)
 		chunkType    ChunkType //当前chunk的类型
 		bytesToWrite uint32    //当前写入了多少字节的大小
 	)
-	//times := 0 //循环了多少次，多进行一次循环就多7字节
 	for begin < end {
 		if wal.currSegOffset+headerSize >= wal.option.SegmentSize {
 			//如果当前文件剩余的空间连头部数据都写不进去，就需要新开辟一个文件，因为数据最多不会超过一个文件的大小，所以这边检查一下文件大小
-			//将数据进行持久化到磁盘中
-			//如果是因为文件满了，就不需要添加padding数据
-			if err := wal.Sync(); err != nil {
+			if err := wal.rotateSegment(); err != nil {
 				return nil, err
 			}
-			//设置进旧文件集合中
-			wal.olderFile[wal.segmentID] = wal.activeFile
-			//新打开一个segment文件
-			err := wal.activeFile.SetIOManager(wal.option.DirPath, wal.option.FileSuffix, fio.MMapFio)
-			if err != nil {
-				return nil, err
-			} //该文件达到阈值了，就设置成MMapIO
-
-			wal.segmentID += 1
-			segfile, err := wal.OpenSegment(wal.segmentID, wal.option, fio.StanderFIO)
-			if err != nil {
-				return nil, nil
+		}
+		if pos == nil {
+			//切换segment文件之后记录从新的segment文件开始
+			pos = &ChunkPos{
+				segmentID:   wal.segmentID,
+				blockID:     wal.BlockId,
+				chunkOffset: wal.currBlcokOffset,
 			}
-			wal.activeFile = segfile
-			wal.currSegOffset = 0   //把当前segment文件的指针设置成0
-			wal.currBlcokOffset = 0 //把当前block偏移置为0
 		}
-		if begin == 0 {
-			// This is the first chunk
-			chunkType = First
-			bytesToWrite = wal.option.BlockSize - wal.currBlcokOffset - headerSize
-		} else if end-begin+headerSize >= wal.option.BlockSize {
-			// This is a middle chunk
-			chunkType = Middle
-			bytesToWrite = wal.option.BlockSize - headerSize
-		} else {
-			// This is the last chunk
-			chunkType = Last
+		//当前block剩余的空间能写入的数据
+		bytesToWrite = wal.option.BlockSize - wal.currBlcokOffset - headerSize
+		if end-begin <= bytesToWrite {
 			bytesToWrite = end - begin
 		}
-		chunkSize, err := wal.writeChunk(data[begin:begin+bytesToWrite], chunkType)
-		if err != nil {
-			return nil, err
+		switch {
+		case begin == 0 && bytesToWrite == end:
+			//切换segment文件之后新的block可以容纳全部的数据
+			chunkType = Full
+		case begin == 0:
+			chunkType = First
+		case begin+bytesToWrite == end:
+			chunkType = Last
+		default:
+			chunkType = Middle
 		}
-		pos.chunkSize += chunkSize
+		pos.chunkSize += wal.writeChunk(data[begin:begin+bytesToWrite], chunkType)
 		begin += bytesToWrite
 	}
-	wal.isEmpty = false
 	return pos, nil
 }
 
-// WriteChunk 写入一个chunk数据
+//rotateSegment 当前的segment文件写满了，切换到一个新的segment文件，需要持有写锁
+//先把写缓冲中的数据写入到当前的segment文件中，再将数据进行持久化到磁盘中，因为文件满了，不需要添加padding数据
+func (wal *Wal) rotateSegment() error {
+	if err := wal.flush(); err != nil {
+		return err
+	}
+	if err := wal.sync(); err != nil {
+		return err
+	}
+	//新打开一个segment文件，失败的时候仍然使用当前的活跃文件
+	segfile, err := wal.OpenSegment(wal.segmentID+1, wal.option, fio.StanderFIO)
+	if err != nil {
+		wal.option.Logger.Error("fail to open wal segment", "dir", wal.option.DirPath, "segment_id", wal.segmentID+1, "err", err)
+		return err
+	}
+	//该文件达到阈值了，就设置成MMapIO，并设置进旧文件集合中
+	if err := wal.activeFile.SetIOManager(wal.option.DirPath, wal.option.FileSuffix, fio.MMapFio); err != nil {
+		_ = segfile.Close()
+		return err
+	}
+	wal.olderFile[wal.segmentID] = wal.activeFile
+	wal.segmentID += 1
+	wal.option.Logger.Debug("rotate wal segment", "dir", wal.option.DirPath, "segment_id", wal.segmentID)
+	wal.activeFile = segfile
+	//保留策略只是尽量的删除旧的segment文件，失败的时候不影响写入
+	if err := wal.applyRetention(); err != nil {
+		wal.option.Logger.Warn("fail to apply wal retention", "dir", wal.option.DirPath, "err", err)
+	}
+	wal.currSegOffset = 0   //把当前segment文件的指针设置成0
+	wal.currBlcokOffset = 0 //把当前block偏移置为0
+	//新的segment文件从自己的第一个block开始
+	wal.BlockId = wal.segmentID * wal.option.SegmentMaxBlockNum
+	return nil
+}
+
+// WriteChunk 写入一个chunk数据到写缓冲中
 //返回chunk的大小
-func (wal *Wal) writeChunk(data []byte, chunkType ChunkType) (uint32, error) {
+func (wal *Wal) writeChunk(data []byte, chunkType ChunkType) uint32 {
 	encBuf := encode(data, chunkType)
-	wal.activeFile.append(encBuf)
+	wal.pending = append(wal.pending, encBuf...)
 	wal.BlockId = wal.BlockId + (wal.currBlcokOffset+uint32(len(encBuf)))/wal.option.BlockSize
 	wal.currBlcokOffset = (wal.currBlcokOffset + uint32(len(encBuf))) % wal.option.BlockSize
 	wal.currSegOffset = wal.currSegOffset + uint32(len(encBuf))
-	return uint32(len(encBuf)), nil
+	return uint32(len(encBuf))
 }
 
 //writePadding Block已经不够写了，写一个占位的字符
 func (wal *Wal) writePadding() {
-	buf := make([]byte, wal.option.BlockSize-wal.currBlcokOffset)
-	wal.activeFile.append(buf)
-	wal.BlockId++
 	byteAdd := wal.option.BlockSize - wal.currBlcokOffset
+	wal.pending = append(wal.pending, make([]byte, byteAdd)...)
+	wal.BlockId++
 	wal.currSegOffset += byteAdd
 	wal.currBlcokOffset = 0
 }
 
+//flush 将写缓冲中的数据写入到活跃文件中
+func (wal *Wal) flush() error {
+	if len(wal.pending) == 0 {
+		return nil
+	}
+	n, err := wal.activeFile.append(wal.pending)
+	wal.unsyncedBytes += uint64(n)
+	wal.pending = wal.pending[:0]
+	return err
+}
+
 //Read 根据Pos位置来读取数据
 //读取完pos开始的一系列有效数据之后，返回下一个可以开始读取的chunk的位置信息
 func (wal *Wal) Read(pos *ChunkPos) ([]byte, *ChunkPos, error) {
@@ -322,6 +465,10 @@ func (wal *Wal) Read(pos *ChunkPos) ([]byte, *ChunkPos, error) {
 		//数据在old文件中
 		segFile = wal.olderFile[pos.segmentID]
 	}
+	if segFile == nil {
+		//所在的segment文件已经被删除了
+		return nil, nil, ErrPosNotValid
+	}
 	var (
 		ret            []byte //返回的总数据长度
 		blockId        = pos.blockID
@@ -381,15 +528,17 @@ func (wal *Wal) Read(pos *ChunkPos) ([]byte, *ChunkPos, error) {
 
 //Sync 将当前的活跃文件进行持久化
 func (wal *Wal) Sync() error {
-	if wal.activeFile == nil {
-		return nil
-	}
-	return wal.activeFile.Sync()
-
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	return wal.sync()
 }
 
 //Close 关闭wal文件
 func (wal *Wal) Close() error {
+	//先停止后台的持久化
+	wal.stopSyncLoop()
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
 	//关闭掉所有的文件
 	if err := wal.closeFiles(); err != nil {
 		return err
@@ -416,32 +565,27 @@ func encode(data []byte, chunkType ChunkType) []byte {
 // GetAllChunkInfo 获得所有的chunkPos的信息
 func (wal *Wal) GetAllChunkInfo() ([][]byte, []*ChunkPos, error) {
 	wal.mu.RLock()
-	defer wal.mu.RUnlock()
 	//如果当前为空Wal，也不允许进行读操作
 	if wal.isEmpty {
+		wal.mu.RUnlock()
 		return nil, nil, ErrEmpty
 	}
+	wal.mu.RUnlock()
 	var chunkPosArray []*ChunkPos
-	var chunkPos = &ChunkPos{
-		segmentID:   0,
-		blockID:     0,
-		chunkOffset: 0,
-	}
 	var res [][]byte
+	//从最旧的没有被删除的segment文件开始顺序读取
+	reader := wal.NewReader(nil)
 	for {
-		data, nextchunkPos, err := wal.Read(chunkPos.Clone())
+		data, chunkPos, err := reader.Next()
 		if err != nil {
 			//文件读取完了
-			if err == io.EOF || err == ErrPosNotValid {
+			if err == io.EOF {
 				break
-			} else {
-				return nil, nil, err
 			}
+			return nil, nil, err
 		}
 		res = append(res, data)
-		chunkPosArray = append(chunkPosArray, chunkPos.Clone())
-		chunkPos = nextchunkPos //更新下一次要开始的chunk的位置
-		//走到这个位置之后，就无法继续往下面读取了
+		chunkPosArray = append(chunkPosArray, chunkPos)
 	}
 	return res, chunkPosArray, nil
 }
@@ -1,10 +1,14 @@
 package wal
 
 import (
+	"FlexDB/fio"
 	"FlexDB/utils"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"os"
 	"testing"
+	"time"
 )
 
 func destroyFile(name string) {
@@ -253,3 +257,519 @@ func TestWal_Read1(t *testing.T) {
 	assert.Equal(t, 6, len(chunkPosArr))
 	assert.Nil(t, err)
 }
+
+//顺序读取所有的记录，包括跨越block和segment文件的记录，最后一条记录没有写完的时候返回io.EOF
+func TestWal_Reader(t *testing.T) {
+	opts := DefaultWalOpt
+	opts.BlockSize = 20
+	opts.SegmentMaxBlockNum = 3
+	opts.SegmentSize = opts.BlockSize * opts.SegmentMaxBlockNum
+	wal, err := Open(opts)
+	defer destroyFile(opts.DirPath)
+	assert.Nil(t, err)
+
+	var (
+		values    [][]byte
+		positions []*ChunkPos
+	)
+	for _, size := range []int{2, 4, 12, 19, 27, 3, 40, 1} {
+		val := utils.RandomValue(size)
+		pos, err := wal.Write(val)
+		assert.Nil(t, err)
+		values = append(values, val)
+		positions = append(positions, pos)
+	}
+
+	reader := wal.NewReader(nil)
+	var resume *ChunkPos
+	for i := range values {
+		val, pos, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+		assert.Equal(t, positions[i], pos)
+		if i == 3 {
+			resume = reader.Pos()
+		}
+	}
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+
+	//读取完之后继续写入，可以接着读取
+	last := utils.RandomValue(30)
+	_, err = wal.Write(last)
+	assert.Nil(t, err)
+	val, _, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, last, val)
+
+	//只写入了一部分的记录不可见
+	_, err = wal.Write(utils.RandomValue(30))
+	assert.Nil(t, err)
+	size, err := wal.activeFile.Size()
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(GetSegmentFile(opts.DirPath, opts.FileSuffix, wal.segmentID), int64(size-3)))
+	readerPos := reader.Pos()
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, readerPos, reader.Pos())
+
+	//从保存的位置继续读取
+	reader = wal.NewReader(resume)
+	val, pos, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, values[4], val)
+	assert.Equal(t, positions[4], pos)
+
+	//重启之后从记录的位置开始读取
+	assert.Nil(t, wal.Close())
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	reader = wal.NewReader(positions[6])
+	val, _, err = reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, values[6], val)
+	assert.Nil(t, wal.Close())
+}
+
+//删除pos所在的segment文件之前的所有segment文件
+func TestWal_TruncateBefore(t *testing.T) {
+	opts := DefaultWalOpt
+	opts.BlockSize = 20
+	opts.SegmentMaxBlockNum = 3
+	opts.SegmentSize = opts.BlockSize * opts.SegmentMaxBlockNum
+	wal, err := Open(opts)
+	defer destroyFile(opts.DirPath)
+	assert.Nil(t, err)
+
+	var positions []*ChunkPos
+	for i := 0; i < 10; i++ {
+		pos, err := wal.Write(utils.RandomValue(27))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	truncatePos := positions[5]
+	assert.True(t, truncatePos.segmentID > 0)
+	assert.Nil(t, wal.TruncateBefore(truncatePos))
+	for id := uint32(0); id < truncatePos.segmentID; id++ {
+		_, err := os.Stat(GetSegmentFile(opts.DirPath, opts.FileSuffix, id))
+		assert.True(t, os.IsNotExist(err))
+	}
+	_, _, err = wal.Read(positions[0])
+	assert.Equal(t, ErrPosNotValid, err)
+	_, _, err = wal.NewReader(positions[0]).Next()
+	assert.Equal(t, ErrPosNotValid, err)
+
+	//从最旧的没有被删除的segment文件开始读取
+	reader := wal.NewReader(nil)
+	_, pos, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, truncatePos.segmentID, pos.segmentID)
+
+	//重启之后继续写入
+	assert.Nil(t, wal.Close())
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	val := utils.RandomValue(27)
+	pos, err = wal.Write(val)
+	assert.Nil(t, err)
+	res, _, err := wal.Read(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, val, res)
+	_, chunkPosArr, err := wal.GetAllChunkInfo()
+	assert.Nil(t, err)
+	assert.Equal(t, truncatePos.segmentID, chunkPosArr[0].segmentID)
+	assert.Nil(t, wal.Close())
+}
+
+//超过保留的大小之后删除最旧的segment文件
+func TestWal_Retention(t *testing.T) {
+	opts := DefaultWalOpt
+	opts.BlockSize = 20
+	opts.SegmentMaxBlockNum = 3
+	opts.SegmentSize = opts.BlockSize * opts.SegmentMaxBlockNum
+	opts.RetentionSize = int64(opts.SegmentSize) * 2
+	wal, err := Open(opts)
+	defer destroyFile(opts.DirPath)
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		_, err := wal.Write(utils.RandomValue(27))
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(wal.olderFile) <= 2)
+	fileIds, err := wal.loadFiles()
+	assert.Nil(t, err)
+	assert.Equal(t, len(wal.olderFile)+1, len(fileIds))
+	reader := wal.NewReader(nil)
+	for {
+		_, _, err := reader.Next()
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+	}
+	assert.Nil(t, wal.Close())
+
+	//每条数据都可以放在一个block中的时候，segment文件写满之后也会切换，并按照保留策略删除
+	destroyFile(opts.DirPath)
+	smallOpts := DefaultWalOpt
+	smallOpts.SegmentSize = 64
+	smallOpts.RetentionSize = 64
+	wal, err = Open(smallOpts)
+	assert.Nil(t, err)
+	var last *ChunkPos
+	for i := 0; i < 20; i++ {
+		last, err = wal.Write(utils.RandomValue(25))
+		assert.Nil(t, err)
+	}
+	fileIds, err = wal.loadFiles()
+	assert.Nil(t, err)
+	assert.True(t, len(fileIds) <= 2)
+	assert.Equal(t, uint32(9), wal.segmentID)
+	for _, id := range fileIds {
+		info, err := os.Stat(GetSegmentFile(smallOpts.DirPath, smallOpts.FileSuffix, uint32(id)))
+		assert.Nil(t, err)
+		assert.True(t, info.Size() <= int64(smallOpts.SegmentSize))
+	}
+	val, _, err := wal.Read(last)
+	assert.Nil(t, err)
+	assert.Equal(t, 25, len(val))
+	assert.Nil(t, wal.Close())
+
+	//超过保留时间的segment文件在打开的时候删除
+	opts.RetentionSize = 0
+	opts.RetentionAge = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(wal.olderFile))
+	assert.Nil(t, wal.Close())
+}
+
+//批量写入的数据和逐条写入的位置信息一致，跨越segment文件的时候也可以读取
+func TestWal_WriteBatch(t *testing.T) {
+	opts := DefaultWalOpt
+	opts.BlockSize = 20
+	opts.SegmentMaxBlockNum = 3
+	opts.SegmentSize = opts.BlockSize * opts.SegmentMaxBlockNum
+	wal, err := Open(opts)
+	defer destroyFile(opts.DirPath)
+	assert.Nil(t, err)
+
+	var batch [][]byte
+	for _, size := range []int{2, 4, 12, 19, 27, 3, 40, 1} {
+		batch = append(batch, utils.RandomValue(size))
+	}
+	positions, err := wal.WriteBatch(batch)
+	assert.Nil(t, err)
+	assert.Equal(t, len(batch), len(positions))
+	assert.True(t, wal.segmentID > 0)
+	for i, pos := range positions {
+		val, _, err := wal.Read(pos)
+		assert.Nil(t, err)
+		assert.Equal(t, batch[i], val)
+	}
+	reader := wal.NewReader(nil)
+	for i := range batch {
+		val, pos, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, batch[i], val)
+		assert.Equal(t, positions[i], pos)
+	}
+	assert.Nil(t, wal.Close())
+
+	//逐条写入得到相同的位置信息
+	destroyFile(opts.DirPath)
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	for i, data := range batch {
+		pos, err := wal.Write(data)
+		assert.Nil(t, err)
+		assert.Equal(t, positions[i], pos)
+	}
+
+	//超过segment大小的数据不会写入任何数据
+	segOffset := wal.currSegOffset
+	_, err = wal.WriteBatch([][]byte{utils.RandomValue(2), make([]byte, opts.SegmentSize)})
+	assert.Equal(t, ErrPayloadExceedSeg, err)
+	assert.Equal(t, segOffset, wal.currSegOffset)
+	assert.Nil(t, wal.Close())
+}
+
+//切换segment文件之后新的block可以容纳整条数据，写成一个full chunk
+func TestWal_WriteRotateFull(t *testing.T) {
+	opts := DefaultWalOpt
+	opts.BlockSize = 32
+	opts.SegmentMaxBlockNum = 2
+	opts.SegmentSize = opts.BlockSize * opts.SegmentMaxBlockNum
+	wal, err := Open(opts)
+	defer destroyFile(opts.DirPath)
+	assert.Nil(t, err)
+	var positions []*ChunkPos
+	for i := 0; i < 40; i++ {
+		pos, err := wal.Write([]byte("abcd"))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	assert.True(t, wal.segmentID > 0)
+	reader := wal.NewReader(nil)
+	for i := range positions {
+		val, pos, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("abcd"), val)
+		assert.Equal(t, positions[i], pos)
+	}
+	assert.Nil(t, wal.Close())
+}
+
+//写入失败之后恢复写入的位置，之后的写入不会包含失败的数据
+func TestWal_WriteBatchRollback(t *testing.T) {
+	opts := DefaultWalOpt
+	opts.BlockSize = 20
+	opts.SegmentMaxBlockNum = 3
+	opts.SegmentSize = opts.BlockSize * opts.SegmentMaxBlockNum
+	wal, err := Open(opts)
+	defer destroyFile(opts.DirPath)
+	assert.Nil(t, err)
+	first, err := wal.Write([]byte("abcd"))
+	assert.Nil(t, err)
+	state := wal.saveWriteState()
+
+	//下一个segment文件的位置是一个目录，切换segment文件的时候会失败
+	assert.Nil(t, os.MkdirAll(GetSegmentFile(opts.DirPath, opts.FileSuffix, 1), os.ModePerm))
+	_, err = wal.WriteBatch([][]byte{utils.RandomValue(30), utils.RandomValue(30)})
+	assert.NotNil(t, err)
+	assert.Equal(t, state, wal.saveWriteState())
+	assert.Equal(t, 0, len(wal.pending))
+	size, err := wal.activeFile.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, state.segOffset, size)
+
+	assert.Nil(t, os.Remove(GetSegmentFile(opts.DirPath, opts.FileSuffix, 1)))
+	batch := [][]byte{utils.RandomValue(30), utils.RandomValue(30)}
+	positions, err := wal.WriteBatch(batch)
+	assert.Nil(t, err)
+	reader := wal.NewReader(nil)
+	val, pos, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abcd"), val)
+	assert.Equal(t, first, pos)
+	for i := range batch {
+		val, pos, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, batch[i], val)
+		assert.Equal(t, positions[i], pos)
+	}
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, wal.Close())
+}
+
+//syncFailIO 持久化总是失败的IOManager
+type syncFailIO struct {
+	fio.IOManager
+}
+
+func (f *syncFailIO) Sync() error {
+	return errors.New("sync failed")
+}
+
+//持久化失败之后同样回滚，返回错误的写入不会被读取到
+func TestWal_WriteBatchSyncFailed(t *testing.T) {
+	opts := DefaultWalOpt
+	opts.SyncPolicy = SyncAlways
+	wal, err := Open(opts)
+	defer destroyFile(opts.DirPath)
+	assert.Nil(t, err)
+	first, err := wal.Write([]byte("abcd"))
+	assert.Nil(t, err)
+	state := wal.saveWriteState()
+
+	ioManager := wal.activeFile.IOManager
+	wal.activeFile.IOManager = &syncFailIO{IOManager: ioManager}
+	_, err = wal.WriteBatch([][]byte{utils.RandomValue(30), utils.RandomValue(30)})
+	assert.NotNil(t, err)
+	assert.Equal(t, state, wal.saveWriteState())
+	size, err := wal.activeFile.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, state.segOffset, size)
+
+	wal.activeFile.IOManager = ioManager
+	second, err := wal.Write([]byte("efgh"))
+	assert.Nil(t, err)
+	reader := wal.NewReader(nil)
+	for _, expected := range []struct {
+		val []byte
+		pos *ChunkPos
+	}{{[]byte("abcd"), first}, {[]byte("efgh"), second}} {
+		val, pos, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, expected.val, val)
+		assert.Equal(t, expected.pos, pos)
+	}
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, wal.Close())
+}
+
+//不同的持久化策略
+func TestWal_SyncPolicy(t *testing.T) {
+	opts := DefaultWalOpt
+	opts.SyncPolicy = SyncAlways
+	wal, err := Open(opts)
+	defer destroyFile(opts.DirPath)
+	assert.Nil(t, err)
+	_, err = wal.Write(utils.RandomValue(10))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), wal.unsyncedBytes)
+	assert.Nil(t, wal.Close())
+
+	opts.SyncPolicy = SyncEveryBytes
+	opts.BytesPerSync = 100
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = wal.Write(utils.RandomValue(10))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(17), wal.unsyncedBytes)
+	_, err = wal.WriteBatch([][]byte{utils.RandomValue(50), utils.RandomValue(50)})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), wal.unsyncedBytes)
+	assert.Nil(t, wal.Close())
+
+	opts.SyncPolicy = SyncEveryInterval
+	opts.SyncInterval = 10 * time.Millisecond
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = wal.Write(utils.RandomValue(10))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		wal.mu.RLock()
+		defer wal.mu.RUnlock()
+		return wal.unsyncedBytes == 0
+	}, time.Second, 5*time.Millisecond)
+	assert.Nil(t, wal.Close())
+}
+
+//打开的时候截断活跃文件中最后不完整或者损坏的记录
+func TestWal_RecoverCorruptedTail(t *testing.T) {
+	opts := DefaultWalOpt
+	opts.BlockSize = 20
+	opts.SegmentMaxBlockNum = 3
+	opts.SegmentSize = opts.BlockSize * opts.SegmentMaxBlockNum
+	defer destroyFile(opts.DirPath)
+
+	var (
+		values    [][]byte
+		positions []*ChunkPos
+	)
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	for _, size := range []int{2, 4, 12, 19, 27, 3, 30} {
+		val := utils.RandomValue(size)
+		pos, err := wal.Write(val)
+		assert.Nil(t, err)
+		values = append(values, val)
+		positions = append(positions, pos)
+	}
+	segOffset, blockOffset, blockID := wal.currSegOffset, wal.currBlcokOffset, wal.BlockId
+	segFile := GetSegmentFile(opts.DirPath, opts.FileSuffix, wal.segmentID)
+	assert.Nil(t, wal.Close())
+
+	//重新打开之后写入的位置不变
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, segOffset, wal.currSegOffset)
+	assert.Equal(t, blockOffset, wal.currBlcokOffset)
+	assert.Equal(t, blockID, wal.BlockId)
+	assert.Nil(t, wal.Close())
+
+	//最后追加的垃圾数据会被截断
+	f, err := os.OpenFile(segFile, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9})
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, segOffset, wal.currSegOffset)
+	assert.Equal(t, blockID, wal.BlockId)
+	assert.Nil(t, wal.Close())
+
+	//最后一条记录没有写完，截断到这条记录开始的位置，之后写入的位置和原来一样
+	info, err := os.Stat(segFile)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(segFile, info.Size()-3))
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	last := len(values) - 1
+	_, chunkPosArr, err := wal.GetAllChunkInfo()
+	assert.Nil(t, err)
+	assert.Equal(t, last, len(chunkPosArr))
+	pos, err := wal.Write(values[last])
+	assert.Nil(t, err)
+	assert.Equal(t, positions[last], pos)
+	assert.Nil(t, wal.Close())
+
+	//最后一条记录的crc校验失败
+	info, err = os.Stat(segFile)
+	assert.Nil(t, err)
+	f, err = os.OpenFile(segFile, os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff}, info.Size()-1)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	data, _, err := wal.GetAllChunkInfo()
+	assert.Nil(t, err)
+	assert.Equal(t, values[:last], data)
+	pos, err = wal.Write(values[last])
+	assert.Nil(t, err)
+	assert.Equal(t, positions[last], pos)
+	assert.Nil(t, wal.Close())
+}
+
+//跨越segment文件的记录在切换之后没有写完，删除新的segment文件，回到前一个segment文件继续写入
+func TestWal_RecoverPartialRotation(t *testing.T) {
+	opts := DefaultWalOpt
+	opts.BlockSize = 20
+	opts.SegmentMaxBlockNum = 3
+	opts.SegmentSize = opts.BlockSize * opts.SegmentMaxBlockNum
+	defer destroyFile(opts.DirPath)
+
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	var values [][]byte
+	for _, size := range []int{2, 4, 12, 19} {
+		val := utils.RandomValue(size)
+		_, err := wal.Write(val)
+		assert.Nil(t, err)
+		values = append(values, val)
+	}
+	//padding+first+middle+last，last写入到了新的segment文件中
+	spanning := utils.RandomValue(27)
+	spanPos, err := wal.Write(spanning)
+	assert.Nil(t, err)
+	assert.Equal(t, spanPos.segmentID+1, wal.segmentID)
+	activeFile := GetSegmentFile(opts.DirPath, opts.FileSuffix, wal.segmentID)
+	assert.Nil(t, wal.Close())
+
+	//新的segment文件中只写入了一部分header
+	assert.Nil(t, os.Truncate(activeFile, 3))
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, spanPos.segmentID, wal.segmentID)
+	_, err = os.Stat(activeFile)
+	assert.True(t, os.IsNotExist(err))
+	data, _, err := wal.GetAllChunkInfo()
+	assert.Nil(t, err)
+	assert.Equal(t, values, data)
+
+	//重新写入之后位置信息和原来一样
+	pos, err := wal.Write(spanning)
+	assert.Nil(t, err)
+	assert.Equal(t, spanPos, pos)
+	res, _, err := wal.Read(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, spanning, res)
+	assert.Nil(t, wal.Close())
+}